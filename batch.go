@@ -0,0 +1,161 @@
+package mmdbwriter
+
+import (
+	"bytes"
+	"cmp"
+	"iter"
+	"net/netip"
+	"slices"
+
+	"github.com/maxmind/mmdbwriter/v2/inserter"
+	"github.com/maxmind/mmdbwriter/v2/mmdbtype"
+)
+
+// batchEntry is one normalized InsertBatch entry.
+type batchEntry struct {
+	iRec      *insertRecord
+	value     mmdbtype.DataType
+	prefix    netip.Prefix
+	input     netip.Prefix
+	index     int
+	prefixLen int
+	ip        [16]byte
+}
+
+// InsertBatch inserts every entry of entries, resolving each with pureFunc as
+// InsertPureFunc does, or with Options.Inserter when pureFunc is nil. It is
+// faster than inserting the entries one by one when many of them share values.
+// Each distinct value is interned once, and entries with equal values share
+// one memo of pureFunc results for the whole batch.
+//
+// The entries are applied sorted by network rather than in input order, which
+// keeps consecutive inserts close together in the tree. A network is always
+// applied before any network it contains, and equal networks keep their input
+// order, so with an order-dependent inserter such as inserter.Replace the more
+// specific entry wins.
+//
+// An entry that fails does not stop the batch. InsertBatch returns a
+// *BatchError listing every failed entry, and the rules InsertFunc documents
+// for a partially applied insert apply to each of them.
+//
+// The value ownership rules are the same as for Insert.
+//
+// This is not safe to call from multiple threads.
+func (t *Tree) InsertBatch(
+	entries iter.Seq2[netip.Prefix, mmdbtype.DataType],
+	pureFunc inserter.PureFunc,
+) error {
+	if pureFunc == nil {
+		pureFunc = t.inserter
+	}
+	resolver := insertResolver{pure: pureFunc}
+
+	groups := map[valueRef]*insertRecord{}
+	// The defer is the panic-safety net, as in insert.
+	defer func() {
+		for _, iRec := range groups {
+			iRec.releaseResolved()
+		}
+	}()
+
+	var (
+		batch  []batchEntry
+		failed []*BatchEntryError
+	)
+	fail := func(index int, prefix netip.Prefix, err error) {
+		failed = append(failed, &BatchEntryError{Err: err, Prefix: prefix, Index: index})
+	}
+	index := 0
+	for input, value := range entries {
+		entryIndex := index
+		index++
+
+		prefix, err := t.normalizeInsertPrefix(input)
+		if err != nil {
+			fail(entryIndex, input, err)
+			continue
+		}
+		iRec, err := t.batchInsertRecord(groups, resolver, value)
+		if err != nil {
+			fail(entryIndex, input, err)
+			continue
+		}
+		ip, prefixLen := t.prefixInsertIP(prefix)
+		batch = append(batch, batchEntry{
+			iRec:      iRec,
+			value:     value,
+			prefix:    prefix,
+			input:     input,
+			index:     entryIndex,
+			prefixLen: prefixLen,
+			ip:        ip,
+		})
+	}
+
+	// A containing network has a lower or equal address and a shorter prefix,
+	// so it sorts first.
+	slices.SortStableFunc(batch, func(a, b batchEntry) int {
+		return cmp.Or(
+			bytes.Compare(a.ip[:], b.ip[:]),
+			cmp.Compare(a.prefixLen, b.prefixLen),
+		)
+	})
+	for _, entry := range batch {
+		if err := t.insertPrepared(entry.prefix, entry.iRec); err != nil {
+			fail(entry.index, entry.input, err)
+			continue
+		}
+		t.valueStore.rememberCallerIdentity(entry.value, entry.iRec.value)
+	}
+
+	for _, iRec := range groups {
+		iRec.releaseResolved()
+	}
+	var err error
+	if len(failed) > 0 {
+		slices.SortFunc(failed, func(a, b *BatchEntryError) int {
+			return cmp.Compare(a.Index, b.Index)
+		})
+		err = &BatchError{Entries: failed}
+	}
+	return t.finishInsertAudit(err)
+}
+
+// batchInsertRecord returns the insertRecord shared by the batch entries whose
+// value interns to the same reference as value, creating it on first use.
+func (t *Tree) batchInsertRecord(
+	groups map[valueRef]*insertRecord,
+	resolver insertResolver,
+	value mmdbtype.DataType,
+) (*insertRecord, error) {
+	var ref valueRef
+	if value != nil {
+		var err error
+		ref, err = t.valueStore.intern(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	iRec := t.groupInsertRecord(groups, resolver, ref)
+	t.valueStore.release(ref)
+	return iRec, nil
+}
+
+// groupInsertRecord returns the insertRecord in groups for ref, creating one
+// that holds its own reference on first use.
+func (t *Tree) groupInsertRecord(
+	groups map[valueRef]*insertRecord,
+	resolver insertResolver,
+	ref valueRef,
+) *insertRecord {
+	if iRec, ok := groups[ref]; ok {
+		return iRec
+	}
+	t.valueStore.retain(ref)
+	iRec := t.newInsertRecordRef(recordTypeData, resolver, noNodeIndex, ref)
+	if resolver.hasFunc() {
+		iRec.valueView = t.valueStore.materialize(ref)
+	}
+	groups[ref] = iRec
+	return iRec
+}
@@ -0,0 +1,138 @@
+package mmdbwriter
+
+import (
+	"maps"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/maxmind/mmdbwriter/v2/inserter"
+	"github.com/maxmind/mmdbwriter/v2/mmdbtype"
+)
+
+// batchInput adapts prefix and value pairs to InsertBatch's sequence. An
+// unparsable prefix is passed as the zero Prefix.
+type batchInput []batchPair
+
+type batchPair struct {
+	prefix string
+	value  mmdbtype.DataType
+}
+
+func (b batchInput) seq(yield func(netip.Prefix, mmdbtype.DataType) bool) {
+	for _, entry := range b {
+		prefix, err := netip.ParsePrefix(entry.prefix)
+		if err != nil {
+			prefix = netip.Prefix{}
+		}
+		if !yield(prefix, entry.value) {
+			return
+		}
+	}
+}
+
+// TestInsertBatchMatchesSortedInserts pins that InsertBatch applies its
+// entries in network order, whatever their input order.
+func TestInsertBatchMatchesSortedInserts(t *testing.T) {
+	shared := mmdbtype.Map{"country": mmdbtype.String("US")}
+	input := batchInput{
+		{"1.0.1.0/24", mmdbtype.String("narrow")},
+		{"2.0.0.0/16", shared},
+		{"1.0.0.0/16", mmdbtype.String("wide")},
+		{"1.0.2.0/24", mmdbtype.Map{"country": mmdbtype.String("US")}},
+		{"::ffff:3.0.0.0/120", shared},
+	}
+
+	batch := newTestTree(t, "batch-test")
+	require.NoError(t, batch.InsertBatch(input.seq, nil))
+
+	sequential := newTestTree(t, "batch-test")
+	for _, entry := range (batchInput{
+		{"1.0.0.0/16", mmdbtype.String("wide")},
+		{"1.0.1.0/24", mmdbtype.String("narrow")},
+		{"1.0.2.0/24", shared},
+		{"2.0.0.0/16", shared},
+		{"3.0.0.0/24", shared},
+	}) {
+		require.NoError(t, sequential.Insert(netip.MustParsePrefix(entry.prefix), entry.value))
+	}
+	// The trees were created at different times.
+	require.NoError(t, sequential.SetBuildEpoch(1))
+	require.NoError(t, batch.SetBuildEpoch(1))
+	assert.Equal(t, writeTreeBytes(t, sequential), writeTreeBytes(t, batch))
+
+	_, value := batch.Get(netip.MustParseAddr("1.0.1.1"))
+	assert.Equal(t, mmdbtype.String("narrow"), value)
+	_, value = batch.Get(netip.MustParseAddr("1.0.3.1"))
+	assert.Equal(t, mmdbtype.String("wide"), value)
+	_, value = batch.Get(netip.MustParseAddr("3.0.0.1"))
+	assert.Equal(t, shared, value)
+}
+
+// TestInsertBatchSharesMemo pins that entries with equal values share one memo
+// of pure inserter results across the batch.
+func TestInsertBatchSharesMemo(t *testing.T) {
+	tree := newTestTree(t, "batch-test")
+	require.NoError(t, tree.Insert(
+		netip.MustParsePrefix("1.0.0.0/16"),
+		mmdbtype.Map{"a": mmdbtype.String("a")},
+	))
+
+	calls := 0
+	merge := func(existingValue, newValue mmdbtype.DataType) (mmdbtype.DataType, error) {
+		calls++
+		return inserter.TopLevelMerge(existingValue, newValue)
+	}
+	var input batchInput
+	for _, prefix := range []string{"1.0.7.0/24", "1.0.1.0/24", "1.0.5.0/24", "1.0.3.0/24"} {
+		input = append(input, batchPair{prefix, mmdbtype.Map{"b": mmdbtype.String("b")}})
+	}
+	require.NoError(t, tree.InsertBatch(input.seq, merge))
+	assert.Equal(t, 1, calls)
+
+	_, value := tree.Get(netip.MustParseAddr("1.0.7.1"))
+	assert.Equal(t, mmdbtype.Map{"a": mmdbtype.String("a"), "b": mmdbtype.String("b")}, value)
+}
+
+// TestInsertBatchReportsEntryErrors pins that failed entries are reported by
+// input position without stopping the rest of the batch.
+func TestInsertBatchReportsEntryErrors(t *testing.T) {
+	tree, err := New(Options{IPVersion: 4})
+	require.NoError(t, err)
+
+	input := batchInput{
+		{"1.0.0.0/24", mmdbtype.String("ok")},
+		{"10.0.0.0/24", mmdbtype.String("reserved")},
+		{"invalid", mmdbtype.String("invalid")},
+		{"2001:db8::/32", mmdbtype.String("ipv6")},
+		{"2.0.0.0/24", (*mmdbtype.Uint128)(nil)},
+		{"3.0.0.0/24", mmdbtype.String("ok")},
+	}
+	err = tree.InsertBatch(input.seq, nil)
+
+	var batchErr *BatchError
+	require.ErrorAs(t, err, &batchErr)
+	indexes := make([]int, len(batchErr.Entries))
+	for i, entry := range batchErr.Entries {
+		indexes[i] = entry.Index
+	}
+	assert.Equal(t, []int{1, 2, 3, 4}, indexes)
+	assert.Equal(t, netip.MustParsePrefix("10.0.0.0/24"), batchErr.Entries[0].Prefix)
+
+	var rnErr *ReservedNetworkError
+	require.ErrorAs(t, err, &rnErr)
+	assert.Equal(t, netip.MustParsePrefix("10.0.0.0/24"), rnErr.InsertedNetwork)
+	assert.ErrorContains(t, err, "4 batch entries failed; first: inserting batch entry 1 (10.0.0.0/24)")
+
+	for _, addr := range []string{"1.0.0.1", "3.0.0.1"} {
+		_, value := tree.Get(netip.MustParseAddr(addr))
+		assert.Equal(t, mmdbtype.String("ok"), value)
+	}
+}
+
+func TestInsertBatchEmpty(t *testing.T) {
+	tree := newTestTree(t, "batch-test")
+	require.NoError(t, tree.InsertBatch(maps.All(map[netip.Prefix]mmdbtype.DataType{}), nil))
+}
@@ -0,0 +1,307 @@
+package mmdbwriter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/netip"
+
+	"github.com/maxmind/mmdbwriter/v2/mmdbtype"
+)
+
+var errBulkBuilderDone = errors.New("the BulkBuilder has already built its Tree")
+
+// BulkBuilder builds a Tree from networks inserted in ascending order that do
+// not overlap, such as the rows of a sorted CSV file. It produces the same
+// Tree as calling Insert for each network on a Tree from New, but it builds
+// the nodes below the records New left empty bottom up: it collects each new
+// node's records as the input reaches them and adds the node to the tree once,
+// when the input leaves it, or merges its records into one if they are equal.
+// It never creates the compressed paths and short-lived nodes that a run of
+// Insert calls would, and it never walks from the root. A network that meets
+// a reserved, aliased, or other record New created is inserted as Insert
+// would, from the deepest node it shares with the previous network.
+//
+// Networks are ordered as the tree stores them. In an IPv6 tree, IPv4 networks
+// sort as the ::/96 subtree, before every other IPv6 network, and IPv4-mapped
+// networks are inserted as IPv4.
+//
+// A BulkBuilder is not safe to use from multiple threads.
+type BulkBuilder struct {
+	tree   *Tree
+	groups map[valueRef]*insertRecord
+	// merge runs maybeMergeChildren for nodes the input has left.
+	merge *insertRecord
+	// stack holds the nodes on the path to the previous network that can
+	// contain a later one, the root first.
+	stack []bulkFrame
+	// lastIP and lastAddr are the tree-space first and last addresses of
+	// the previous network.
+	lastIP   [16]byte
+	lastAddr [16]byte
+	hasLast  bool
+	done     bool
+}
+
+// bulkFrame is a node on the path to the previous network. A node in the
+// tree's arena has its index, and parent is the record that points to it, or
+// nil for the root. A pending node is not in the arena yet: its records
+// collect in children until the input leaves it. Every node below a pending
+// node is pending too.
+type bulkFrame struct {
+	parent   *record
+	index    nodeIndex
+	depth    int
+	pending  bool
+	children [2]record
+}
+
+// NewBulkBuilder returns a BulkBuilder for a Tree created with opts, as New
+// creates it. Options.Inserter resolves inserts into reserved networks and
+// any other record New populated.
+func NewBulkBuilder(opts Options) (*BulkBuilder, error) {
+	tree, err := New(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &BulkBuilder{
+		tree:   tree,
+		groups: map[valueRef]*insertRecord{},
+		merge:  tree.newInsertRecordRef(recordTypeData, insertResolver{}, noNodeIndex, nilValueRef),
+		stack:  []bulkFrame{{index: tree.root}},
+	}, nil
+}
+
+// Insert inserts value for prefix, which must start after the previous
+// network inserted ends. It returns an error without inserting anything for a
+// network out of order or overlapping the previous one. The value ownership
+// rules and the errors for reserved and aliased networks are the same as for
+// Tree.Insert. A network whose insert failed still counts as the previous
+// network.
+func (b *BulkBuilder) Insert(prefix netip.Prefix, value mmdbtype.DataType) error {
+	if b.done {
+		return errBulkBuilderDone
+	}
+	t := b.tree
+	prefix, err := t.normalizeInsertPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	ip, prefixLen, err := b.advance(prefix)
+	if err != nil {
+		return err
+	}
+	iRec, err := t.batchInsertRecord(b.groups, insertResolver{pure: t.inserter}, value)
+	if err != nil {
+		return err
+	}
+	err = b.walk(prefix, ip, prefixLen, iRec, t.insertProvenance(prefix))
+	if err != nil {
+		return err
+	}
+	t.valueStore.rememberCallerIdentity(value, iRec.value)
+	return nil
+}
+
+// insertRef inserts the interned value ref, which it borrows, for an already
+// normalized prefix, with the given Tree.provenance index. Its groups resolve
+// directly, so it must not be mixed with Insert on one BulkBuilder.
+func (b *BulkBuilder) insertRef(
+	prefix netip.Prefix,
+	ref valueRef,
+	provenance nodeIndex,
+) error {
+	ip, prefixLen, err := b.advance(prefix)
+	if err != nil {
+		return err
+	}
+	iRec := b.tree.groupInsertRecord(b.groups, insertResolver{}, ref)
+	return b.walk(prefix, ip, prefixLen, iRec, provenance)
+}
+
+// advance checks that prefix starts after the previous network, pops the
+// nodes that cannot contain it, and makes it the previous network.
+func (b *BulkBuilder) advance(prefix netip.Prefix) ([16]byte, int, error) {
+	t := b.tree
+	ip, prefixLen := t.prefixInsertIP(prefix)
+	if b.hasLast && bytes.Compare(ip[:], b.lastAddr[:]) <= 0 {
+		return ip, prefixLen, fmt.Errorf(
+			"network %s does not start after the previous network; BulkBuilder requires sorted, non-overlapping networks",
+			prefix,
+		)
+	}
+	if err := b.popFrames(ip, prefixLen); err != nil {
+		return ip, prefixLen, err
+	}
+	b.hasLast = true
+	b.lastIP = ip
+	b.lastAddr = lastTreeAddr(ip, prefixLen, t.treeDepth)
+	return ip, prefixLen, nil
+}
+
+// walk inserts the network below the deepest node that can contain it. It
+// builds the nodes below an empty record as pending frames and places the
+// network's record in the deepest one. It hands any other record to
+// insertNode, which walks down from that node as Insert would.
+func (b *BulkBuilder) walk(
+	prefix netip.Prefix,
+	ip [16]byte,
+	prefixLen int,
+	iRec *insertRecord,
+	provenance nodeIndex,
+) error {
+	t := b.tree
+	t.targetInsert(prefix, iRec)
+	iRec.provenance = provenance
+	if prefixLen == 0 {
+		// The network covers the root, which is the only frame left.
+		return iRec.insertNode(t.root, 0)
+	}
+	for {
+		top := &b.stack[len(b.stack)-1]
+		bit := bitAt(ip, top.depth)
+		var child *record
+		if top.pending {
+			child = &top.children[bit]
+		} else {
+			child = &t.nodeAt(top.index).children[bit]
+			if child.recordType != recordTypeEmpty {
+				err := iRec.insertNode(top.index, top.depth)
+				b.pushFrames(ip, prefixLen)
+				return err
+			}
+		}
+		if top.depth+1 == prefixLen {
+			value, owned, err := iRec.resolveValue(nilValueRef, prefixLen, noNodeIndex)
+			if err != nil || value == nilValueRef {
+				return err
+			}
+			iRec.replaceDataRecord(child, value, owned)
+			return nil
+		}
+		b.stack = append(b.stack, bulkFrame{depth: top.depth + 1, pending: true})
+	}
+}
+
+// popFrames pops the nodes that cannot contain the network at ip and
+// prefixLen, finishing each as popFrame does. The root is never popped.
+func (b *BulkBuilder) popFrames(ip [16]byte, prefixLen int) error {
+	shared := sharedPrefixBits(ip, b.lastIP)
+	for len(b.stack) > 1 {
+		frame := b.stack[len(b.stack)-1]
+		if frame.depth < prefixLen && frame.depth <= shared {
+			return nil
+		}
+		if err := b.popFrame(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// popFrame pops the top node, which the input has left. A pending node's
+// records merge into one if they can, as Tree.insert's walk merges them when
+// it unwinds, and otherwise the node is added to the arena. Either way, the
+// result becomes the record in the parent node. A node already in the arena
+// is checked for merging.
+func (b *BulkBuilder) popFrame() error {
+	frame := b.stack[len(b.stack)-1]
+	b.stack = b.stack[:len(b.stack)-1]
+	if !frame.pending {
+		if frame.parent.recordType != recordTypeNode {
+			return nil
+		}
+		return b.merge.maybeMergeChildren(frame.parent)
+	}
+
+	t := b.tree
+	merged, ok, err := b.merge.mergedRecord(&frame.children[0], &frame.children[1])
+	if err != nil {
+		return err
+	}
+	if !ok {
+		merged = record{nodeIndex: t.newNode(frame.children), recordType: recordTypeNode}
+	}
+	parent := &b.stack[len(b.stack)-1]
+	bit := bitAt(b.lastIP, parent.depth)
+	if parent.pending {
+		parent.children[bit] = merged
+	} else {
+		t.nodeAt(parent.index).children[bit] = merged
+	}
+	return nil
+}
+
+// pushFrames pushes the nodes below the stack's top on the path to the
+// network insertNode just inserted that a later network could still fall in.
+// They are all in the arena.
+func (b *BulkBuilder) pushFrames(ip [16]byte, prefixLen int) {
+	t := b.tree
+	for {
+		top := b.stack[len(b.stack)-1]
+		childDepth := top.depth + 1
+		if childDepth >= prefixLen {
+			return
+		}
+		child := &t.nodeAt(top.index).children[bitAt(ip, top.depth)]
+		if child.recordType != recordTypeNode && child.recordType != recordTypeFixedNode {
+			return
+		}
+		b.stack = append(b.stack, bulkFrame{
+			parent: child,
+			index:  child.nodeIndex,
+			depth:  childDepth,
+		})
+	}
+}
+
+// Tree finishes the build and returns the Tree. The BulkBuilder cannot be used
+// afterward, but the Tree can be modified as usual.
+func (b *BulkBuilder) Tree() (*Tree, error) {
+	if b.done {
+		return nil, errBulkBuilderDone
+	}
+	b.done = true
+	var err error
+	for len(b.stack) > 1 {
+		err = errors.Join(err, b.popFrame())
+	}
+	for _, iRec := range b.groups {
+		iRec.releaseResolved()
+	}
+	b.groups = nil
+	if err = b.tree.finishInsertAudit(err); err != nil {
+		return nil, err
+	}
+	return b.tree, nil
+}
+
+// prefixBitsEqual reports whether a and b agree in their first n bits.
+func prefixBitsEqual(a, b [16]byte, n int) bool {
+	return sharedPrefixBits(a, b) >= n
+}
+
+// sharedPrefixBits returns the number of leading bits in which a and b agree.
+func sharedPrefixBits(a, b [16]byte) int {
+	for i := range a {
+		if diff := a[i] ^ b[i]; diff != 0 {
+			return i*8 + bits.LeadingZeros8(diff)
+		}
+	}
+	return 128
+}
+
+// lastTreeAddr returns the last tree-space address in the network at ip and
+// depth, for a tree of treeDepth bits.
+func lastTreeAddr(ip [16]byte, depth, treeDepth int) [16]byte {
+	byteIndex := depth / 8
+	if remainingBits := depth % 8; remainingBits != 0 {
+		ip[byteIndex] |= 0xff >> remainingBits
+		byteIndex++
+	}
+	for i := byteIndex; i < treeDepth/8; i++ {
+		ip[i] = 0xff
+	}
+	return ip
+}
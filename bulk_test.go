@@ -0,0 +1,216 @@
+package mmdbwriter
+
+import (
+	"bytes"
+	"cmp"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/maxmind/mmdbwriter/v2/mmdbtype"
+)
+
+// TestBulkBuilderMatchesInsert pins that BulkBuilder builds the same tree as
+// repeated Insert, including the inserts that fail on reserved and aliased
+// networks.
+func TestBulkBuilderMatchesInsert(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+	}{
+		{"IPv4", Options{IPVersion: 4}},
+		{"IPv4 with reserved", Options{IPVersion: 4, IncludeReservedNetworks: true}},
+		{"IPv6", Options{IPVersion: 6}},
+		{"IPv6 with provenance", Options{IPVersion: 6, TrackProvenance: true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for seed := range uint64(20) {
+				test.options.BuildEpoch = 1
+				test.options.DatabaseType = "bulk-test"
+				test.options.Description = map[string]string{"en": "Bulk test"}
+				sequential, err := New(test.options)
+				require.NoError(t, err)
+				builder, err := NewBulkBuilder(test.options)
+				require.NoError(t, err)
+
+				for _, spec := range bulkBuilderSpecs(sequential, seed) {
+					insertErr := sequential.Insert(spec.network, spec.value)
+					bulkErr := builder.Insert(spec.network, spec.value)
+					require.Equal(t, insertErr == nil, bulkErr == nil, "%s: %v, %v", spec.network, insertErr, bulkErr)
+				}
+				bulk, err := builder.Tree()
+				require.NoError(t, err)
+				require.Equal(t, writeTreeBytes(t, sequential), writeTreeBytes(t, bulk), "seed %d", seed)
+				if seed == 0 {
+					checkWrittenTree(t, bulk)
+				}
+			}
+		})
+	}
+}
+
+// TestBulkBuilderRootNetwork pins that a /0 network, which covers the root,
+// builds the same tree as Tree.Insert, or fails the same way.
+func TestBulkBuilderRootNetwork(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+		network string
+	}{
+		{"IPv4", Options{IPVersion: 4, IncludeReservedNetworks: true}, "0.0.0.0/0"},
+		{"IPv4 without reserved", Options{IPVersion: 4}, "0.0.0.0/0"},
+		{
+			"IPv6",
+			Options{IPVersion: 6, DisableIPv4Aliasing: true, IncludeReservedNetworks: true},
+			"::/0",
+		},
+		{"IPv6 with aliases", Options{IPVersion: 6, IncludeReservedNetworks: true}, "::/0"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.options.BuildEpoch = 1
+			test.options.DatabaseType = "bulk-test"
+			test.options.Description = map[string]string{"en": "Bulk test"}
+			sequential, err := New(test.options)
+			require.NoError(t, err)
+			builder, err := NewBulkBuilder(test.options)
+			require.NoError(t, err)
+
+			network := netip.MustParsePrefix(test.network)
+			value := mmdbtype.String("root")
+			insertErr := sequential.Insert(network, value)
+			bulkErr := builder.Insert(network, value)
+			require.Equal(t, insertErr == nil, bulkErr == nil, "%v, %v", insertErr, bulkErr)
+
+			bulk, err := builder.Tree()
+			require.NoError(t, err)
+			require.Equal(t, writeTreeBytes(t, sequential), writeTreeBytes(t, bulk))
+			checkWrittenTree(t, bulk)
+		})
+	}
+}
+
+// bulkBuilderSpecs returns random sorted, non-overlapping networks for tree,
+// with few distinct values and many adjacent networks, so their records merge.
+func bulkBuilderSpecs(tree *Tree, seed uint64) []benchmarkInsertSpec {
+	r := rand.New(rand.NewPCG(seed, seed))
+	values := []mmdbtype.DataType{
+		mmdbtype.String("a"),
+		mmdbtype.String("b"),
+		mmdbtype.Map{"country": mmdbtype.String("US")},
+	}
+	var specs []benchmarkInsertSpec
+	for range 400 {
+		var prefix netip.Prefix
+		if tree.treeDepth == 32 || r.IntN(2) == 0 {
+			// Cluster the addresses, so networks are often adjacent.
+			addr := ipv4Addr(r.Uint32N(1<<12) << 20)
+			prefix = netip.PrefixFrom(addr, 8+r.IntN(17)).Masked()
+		} else {
+			var addr [16]byte
+			addr[0] = 0x20
+			addr[1] = byte(r.IntN(4))
+			addr[2] = byte(r.IntN(256))
+			prefix = netip.PrefixFrom(netip.AddrFrom16(addr), 12+r.IntN(30)).Masked()
+		}
+		specs = append(specs, benchmarkInsertSpec{
+			network: prefix,
+			value:   values[r.IntN(len(values))],
+		})
+	}
+	sortBulkSpecs(tree, specs)
+
+	kept := specs[:0]
+	for _, spec := range specs {
+		if len(kept) > 0 && kept[len(kept)-1].network.Overlaps(spec.network) {
+			continue
+		}
+		kept = append(kept, spec)
+	}
+	return kept
+}
+
+func sortBulkSpecs(tree *Tree, specs []benchmarkInsertSpec) {
+	slices.SortFunc(specs, func(a, b benchmarkInsertSpec) int {
+		aIP, aLen := tree.prefixInsertIP(a.network)
+		bIP, bLen := tree.prefixInsertIP(b.network)
+		return cmp.Or(bytes.Compare(aIP[:], bIP[:]), cmp.Compare(aLen, bLen))
+	})
+}
+
+func TestBulkBuilderRejectsUnsortedInput(t *testing.T) {
+	builder, err := NewBulkBuilder(Options{IPVersion: 6})
+	require.NoError(t, err)
+	require.NoError(t, builder.Insert(netip.MustParsePrefix("1.0.0.0/24"), mmdbtype.String("a")))
+
+	for _, prefix := range []string{
+		"1.0.0.0/24",
+		"1.0.0.128/25",
+		"1.0.0.0/16",
+		"0.0.0.0/8",
+		"::ffff:1.0.0.0/120",
+	} {
+		err := builder.Insert(netip.MustParsePrefix(prefix), mmdbtype.String("b"))
+		require.ErrorContains(t, err, "requires sorted, non-overlapping networks", prefix)
+	}
+	require.NoError(t, builder.Insert(netip.MustParsePrefix("1.0.1.0/24"), mmdbtype.String("b")))
+	require.NoError(t, builder.Insert(netip.MustParsePrefix("2600::/16"), mmdbtype.String("b")))
+
+	tree, err := builder.Tree()
+	require.NoError(t, err)
+	_, value := tree.Get(netip.MustParseAddr("1.0.1.1"))
+	assert.Equal(t, mmdbtype.String("b"), value)
+
+	_, err = builder.Tree()
+	require.EqualError(t, err, "the BulkBuilder has already built its Tree")
+	err = builder.Insert(netip.MustParsePrefix("2700::/16"), mmdbtype.String("c"))
+	require.EqualError(t, err, "the BulkBuilder has already built its Tree")
+}
+
+func TestBulkBuilderEndOfAddressSpace(t *testing.T) {
+	builder, err := NewBulkBuilder(Options{IPVersion: 4, IncludeReservedNetworks: true})
+	require.NoError(t, err)
+	require.NoError(t, builder.Insert(netip.MustParsePrefix("255.255.255.255/32"), mmdbtype.String("a")))
+	err = builder.Insert(netip.MustParsePrefix("255.255.255.255/32"), mmdbtype.String("a"))
+	require.ErrorContains(t, err, "does not start after the previous network")
+}
+
+// TestBulkBuilderAddsEachNodeOnce pins that BulkBuilder builds the nodes below
+// empty records bottom up: it creates no compressed paths, and every node it
+// allocates is still in the tree, because equal records merge before their
+// node is added.
+func TestBulkBuilderAddsEachNodeOnce(t *testing.T) {
+	builder, err := NewBulkBuilder(Options{IPVersion: 4, IncludeReservedNetworks: true})
+	require.NoError(t, err)
+	for _, insert := range []struct {
+		network string
+		value   mmdbtype.String
+	}{
+		{"1.0.0.0/25", "a"},
+		{"1.0.0.128/25", "a"},
+		{"1.0.1.0/24", "a"},
+		{"1.0.2.0/24", "b"},
+		{"10.0.0.0/32", "c"},
+		{"10.0.0.1/32", "c"},
+		{"200.0.0.0/8", "d"},
+	} {
+		require.NoError(t, builder.Insert(netip.MustParsePrefix(insert.network), insert.value))
+	}
+	tree, err := builder.Tree()
+	require.NoError(t, err)
+
+	assert.Empty(t, tree.paths)
+	network, value := tree.Get(netip.MustParseAddr("1.0.0.1"))
+	assert.Equal(t, netip.MustParsePrefix("1.0.0.0/23"), network)
+	assert.Equal(t, mmdbtype.String("a"), value)
+	network, _ = tree.Get(netip.MustParseAddr("10.0.0.1"))
+	assert.Equal(t, netip.MustParsePrefix("10.0.0.0/31"), network)
+
+	writeTreeBytes(t, tree)
+	assert.Equal(t, tree.nodeCountAllocated, tree.nodeCount)
+}
@@ -0,0 +1,755 @@
+package mmdbwriter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"maps"
+	"math"
+	"net/netip"
+	"os"
+	"slices"
+
+	"github.com/oschwald/maxminddb-golang/v2/mmdbdata"
+
+	"github.com/maxmind/mmdbwriter/v2/inserter"
+	"github.com/maxmind/mmdbwriter/v2/mmdbtype"
+)
+
+// checkpointMagic starts every checkpoint. The leading byte keeps it from
+// being mistaken for text.
+var checkpointMagic = []byte("\xABMMDBWRITER-CHECKPOINT")
+
+// checkpointVersion is the version of the checkpoint format. Resume rejects
+// any other version.
+const checkpointVersion = 1
+
+// checkpointRecordSize is the size of a record in a checkpoint.
+const checkpointRecordSize = 9
+
+// Checkpoint writes the tree's in-progress state to w in a native format that
+// Resume reads back, so a long build can restart from its last checkpoint
+// instead of from the beginning or from a database that Load must decode
+// again.
+//
+// The checkpoint holds the search tree nodes, including the aliased and
+// reserved networks, the compressed insertion paths, the value store, the
+// provenance table and source, and every setting that New takes from Options
+// other than Inserter, Storage, StorageDir, and RefcountAudit, which Resume
+// takes from its own Options. It also holds the metadata set after New, such
+// as with SetBuildEpoch or SetExtraMetadata. Only the nodes and values the
+// tree still uses are written. Conflicts not yet taken with TakeConflicts are
+// not written.
+//
+// The format is versioned and checksummed, but it is specific to this
+// package and is not a MaxMind DB file.
+func (t *Tree) Checkpoint(w io.Writer) error {
+	layout, err := t.checkpointLayout()
+	if err != nil {
+		return err
+	}
+
+	crc := crc32.NewIEEE()
+	cw := &checkpointWriter{w: bufio.NewWriter(io.MultiWriter(w, crc))}
+	cw.write(checkpointMagic)
+	cw.uvarint(checkpointVersion)
+	if err := t.writeCheckpointSettings(cw); err != nil {
+		return err
+	}
+
+	cw.uvarint(uint64(len(t.provenance)))
+	for _, provenance := range t.provenance {
+		cw.prefix(provenance.Network)
+		cw.string(provenance.Source)
+	}
+
+	cw.uvarint(uint64(len(layout.values)))
+	for _, ref := range layout.values {
+		node := t.valueStore.node(ref)
+		cw.write([]byte{byte(node.kind)})
+		cw.bytes(t.valueStore.payload(node))
+		children := t.valueStore.childRefs(node)
+		cw.uvarint(uint64(len(children)))
+		for _, child := range children {
+			cw.uint32(uint32(layout.valueRefs[child]))
+		}
+	}
+
+	cw.uvarint(uint64(len(layout.paths)))
+	for _, index := range layout.paths {
+		path := t.paths[index]
+		r, err := layout.translate(path.record)
+		if err != nil {
+			return err
+		}
+		cw.write(path.ip[:])
+		cw.write([]byte{byte(path.endDepth)})
+		cw.record(r)
+	}
+
+	cw.uvarint(uint64(len(layout.nodes)))
+	for _, index := range layout.nodes {
+		for _, child := range t.nodeAt(index).children {
+			r, err := layout.translate(child)
+			if err != nil {
+				return err
+			}
+			cw.record(r)
+		}
+	}
+
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	if cw.err != nil {
+		return fmt.Errorf("writing checkpoint: %w", cw.err)
+	}
+	if _, err := w.Write(binary.BigEndian.AppendUint32(nil, crc.Sum32())); err != nil {
+		return fmt.Errorf("writing checkpoint: %w", err)
+	}
+	return nil
+}
+
+func (t *Tree) writeCheckpointSettings(cw *checkpointWriter) error {
+	cw.varint(t.buildEpoch)
+	cw.string(t.databaseType)
+	cw.uvarint(uint64(len(t.description)))
+	for _, language := range slices.Sorted(maps.Keys(t.description)) {
+		cw.string(language)
+		cw.string(t.description[language])
+	}
+	cw.bool(t.disableMetadataPointers)
+	cw.uvarint(uint64(t.ipVersion))
+	cw.uvarint(uint64(len(t.languages)))
+	for _, language := range t.languages {
+		cw.string(language)
+	}
+	cw.uvarint(uint64(t.recordSize))
+	cw.prefixes(t.ipv4Aliases)
+	cw.prefixes(t.reservedNetworks)
+	cw.bool(t.extraMetadata != nil)
+	if t.extraMetadata != nil {
+		dw := newDataWriter(newValueStore(), false)
+		if _, err := t.extraMetadata.WriteTo(dw); err != nil {
+			return fmt.Errorf("encoding extra metadata: %w", err)
+		}
+		cw.bytes(dw.Bytes())
+	}
+	cw.uvarint(uint64(t.binaryFormatMinorVersion))
+	cw.uvarint(uint64(t.conflictPolicy))
+	cw.bool(t.trackProvenance)
+	cw.string(t.provenanceSource)
+	cw.uvarint(uint64(len(t.mapKeyOrder.Priority)))
+	for _, key := range t.mapKeyOrder.Priority {
+		cw.string(key)
+	}
+	cw.bool(t.mapKeyOrder.ByFrequency)
+	return nil
+}
+
+// checkpointLayout lists what a checkpoint writes and numbers it afresh. Nodes
+// are numbered in preorder from the root, so every child's number is greater
+// than its parent's. Values are numbered from one, children first.
+type checkpointLayout struct {
+	trackProvenance bool
+	// nodes and paths hold the written entries' current indexes, in their
+	// new order.
+	nodes []nodeIndex
+	paths []nodeIndex
+	// nodeIndexes and pathIndexes map current indexes to new ones, with
+	// noNodeIndex for entries the tree no longer uses.
+	nodeIndexes []nodeIndex
+	pathIndexes []nodeIndex
+	// values holds the written values' current refs, in their new order, and
+	// valueRefs maps current refs to new ones, with nilValueRef for values
+	// the tree no longer uses.
+	values    []valueRef
+	valueRefs []valueRef
+}
+
+func (t *Tree) checkpointLayout() (*checkpointLayout, error) {
+	layout := &checkpointLayout{
+		trackProvenance: t.trackProvenance,
+		nodeIndexes:     make([]nodeIndex, t.nodeCountAllocated),
+		pathIndexes:     make([]nodeIndex, len(t.paths)),
+		valueRefs:       make([]valueRef, len(t.valueStore.nodes)),
+	}
+	for i := range layout.nodeIndexes {
+		layout.nodeIndexes[i] = noNodeIndex
+	}
+	for i := range layout.pathIndexes {
+		layout.pathIndexes[i] = noNodeIndex
+	}
+
+	var walk func(index nodeIndex) error
+	walk = func(index nodeIndex) error {
+		if layout.nodeIndexes[index] != noNodeIndex {
+			return fmt.Errorf("node %d is reachable twice", index)
+		}
+		layout.nodeIndexes[index] = newNodeIndex(len(layout.nodes))
+		layout.nodes = append(layout.nodes, index)
+		for _, child := range t.nodeAt(index).children {
+			switch child.recordType {
+			case recordTypeNode, recordTypeFixedNode:
+				if err := walk(child.nodeIndex); err != nil {
+					return err
+				}
+			case recordTypePath:
+				layout.pathIndexes[child.nodeIndex] = newNodeIndex(len(layout.paths))
+				layout.paths = append(layout.paths, child.nodeIndex)
+				layout.addValue(t.valueStore, t.paths[child.nodeIndex].record.value)
+			case recordTypeData:
+				layout.addValue(t.valueStore, child.value)
+			case recordTypeEmpty, recordTypeAlias, recordTypeReserved:
+			}
+		}
+		return nil
+	}
+	if err := walk(t.root); err != nil {
+		return nil, fmt.Errorf("writing checkpoint: %w", err)
+	}
+	return layout, nil
+}
+
+// addValue lists ref after its children, unless it is already listed.
+func (l *checkpointLayout) addValue(store *valueStore, ref valueRef) {
+	if l.valueRefs[ref] != nilValueRef {
+		return
+	}
+	for _, child := range store.childRefs(store.node(ref)) {
+		l.addValue(store, child)
+	}
+	l.values = append(l.values, ref)
+	l.valueRefs[ref] = valueRef(len(l.values)) //nolint:gosec // bounded by the store's refs
+}
+
+// translate renumbers the indexes in r. Fields the record type leaves unread
+// are zeroed, so they do not carry stale indexes into the checkpoint.
+func (l *checkpointLayout) translate(r record) (record, error) {
+	switch r.recordType {
+	case recordTypeNode, recordTypeFixedNode, recordTypeAlias:
+		index := l.nodeIndexes[r.nodeIndex]
+		if index == noNodeIndex {
+			return record{}, fmt.Errorf(
+				"writing checkpoint: alias target node %d is not in the tree",
+				r.nodeIndex,
+			)
+		}
+		return record{nodeIndex: index, recordType: r.recordType}, nil
+	case recordTypePath:
+		return record{nodeIndex: l.pathIndexes[r.nodeIndex], recordType: r.recordType}, nil
+	case recordTypeData:
+		r.value = l.valueRefs[r.value]
+		if !l.trackProvenance {
+			r.nodeIndex = noNodeIndex
+		}
+		return r, nil
+	default:
+		return record{recordType: r.recordType}, nil
+	}
+}
+
+// Resume returns the Tree saved by Checkpoint. The checkpoint supplies every
+// setting it holds. Of opts, Resume uses only Inserter, Storage, StorageDir,
+// and RefcountAudit, since an inserter cannot be saved and the others
+// describe this process rather than the tree.
+func Resume(r io.Reader, opts Options) (*Tree, error) {
+	cr := &checkpointReader{r: bufio.NewReader(r), crc: crc32.NewIEEE()}
+	if magic := cr.read(len(checkpointMagic)); cr.err == nil &&
+		!bytes.Equal(magic, checkpointMagic) {
+		return nil, errors.New("resuming tree: not a checkpoint")
+	}
+	if version := cr.uvarint(); cr.err == nil && version != checkpointVersion {
+		return nil, fmt.Errorf("resuming tree: unsupported checkpoint version %d", version)
+	}
+
+	tree := &Tree{
+		nodeCountAllocated: 1,
+		root:               rootNodeIndex,
+		inserter:           opts.Inserter,
+		refcountAudit: opts.RefcountAudit ||
+			os.Getenv("MMDBWRITER_REFCOUNT_AUDIT") != "",
+	}
+	tree.valueStore = newValueStore()
+	tree.valueStore.poisonFreedRefs = tree.refcountAudit
+	if err := tree.readCheckpointSettings(cr); err != nil {
+		return nil, fmt.Errorf("resuming tree: %w", err)
+	}
+	if err := tree.initStorage(opts); err != nil {
+		return nil, err
+	}
+	if err := tree.readCheckpointBody(cr); err != nil {
+		return nil, tree.closeAfter(fmt.Errorf("resuming tree: %w", err))
+	}
+	if err := tree.maybeAuditValueStore(); err != nil {
+		return nil, tree.closeAfter(err)
+	}
+	return tree, nil
+}
+
+func (t *Tree) readCheckpointSettings(cr *checkpointReader) error {
+	t.buildEpoch = cr.varint()
+	t.databaseType = cr.string()
+	t.description = map[string]string{}
+	for range cr.count("description") {
+		language := cr.string()
+		t.description[language] = cr.string()
+	}
+	t.disableMetadataPointers = cr.bool()
+	t.ipVersion = int(cr.uvarint()) //nolint:gosec // validated below
+	for range cr.count("language") {
+		t.languages = append(t.languages, cr.string())
+	}
+	t.recordSize = int(cr.uvarint()) //nolint:gosec // validated below
+	t.ipv4Aliases = cr.prefixes()
+	t.reservedNetworks = cr.prefixes()
+	if cr.bool() {
+		encoded := cr.bytes()
+		if cr.err == nil {
+			unmarshaler := mmdbtype.NewUnmarshaler()
+			decoder := mmdbdata.NewDecoder(encoded, 0)
+			if err := unmarshaler.UnmarshalMaxMindDB(decoder); err != nil {
+				return fmt.Errorf("decoding extra metadata: %w", err)
+			}
+			extra, ok := unmarshaler.Result().(mmdbtype.Map)
+			if !ok {
+				return fmt.Errorf("extra metadata is a %T, not a Map", unmarshaler.Result())
+			}
+			t.extraMetadata = extra
+		}
+	}
+	minorVersion := cr.uvarint()
+	t.binaryFormatMinorVersion = int(min(minorVersion, math.MaxUint16+1)) //nolint:gosec // bounded
+	t.conflictPolicy = ConflictPolicy(min(cr.uvarint(), math.MaxInt32))   //nolint:gosec // bounded
+	t.trackProvenance = cr.bool()
+	t.provenanceSource = cr.string()
+	for range cr.count("map key") {
+		t.mapKeyOrder.Priority = append(t.mapKeyOrder.Priority, cr.string())
+	}
+	t.mapKeyOrder.ByFrequency = cr.bool()
+	if cr.err != nil {
+		return cr.err
+	}
+
+	switch t.ipVersion {
+	case 6:
+		t.treeDepth = 128
+	case 4:
+		t.treeDepth = 32
+	default:
+		return fmt.Errorf("unsupported IPVersion: %d", t.ipVersion)
+	}
+	switch t.recordSize {
+	case 24, 28, 32:
+	default:
+		return fmt.Errorf("unsupported RecordSize: %d", t.recordSize)
+	}
+	if t.buildEpoch < 0 {
+		return fmt.Errorf("BuildEpoch must not be negative: %d", t.buildEpoch)
+	}
+	if minorVersion > math.MaxUint16 {
+		return fmt.Errorf("unsupported binary_format_minor_version: %d", minorVersion)
+	}
+	switch t.conflictPolicy {
+	case ConflictError, ConflictSkip, ConflictCollect:
+	default:
+		return fmt.Errorf("unsupported ConflictPolicy: %d", t.conflictPolicy)
+	}
+	return t.mapKeyOrder.validate()
+}
+
+func (t *Tree) readCheckpointBody(cr *checkpointReader) error {
+	for range cr.count("provenance entry") {
+		network := cr.prefix()
+		t.provenance = append(t.provenance, inserter.Provenance{
+			Network: network,
+			Source:  cr.string(),
+		})
+	}
+
+	store := t.valueStore
+	for range cr.count("value") {
+		kind := valueKind(cr.read(1)[0])
+		payload := cr.bytes()
+		children := make([]valueRef, cr.count("child"))
+		for i := range children {
+			children[i] = valueRef(cr.uint32())
+		}
+		if cr.err != nil {
+			return cr.err
+		}
+		if err := store.restoreNode(kind, payload, children); err != nil {
+			return err
+		}
+	}
+
+	for range cr.count("path") {
+		var path compressedPath
+		copy(path.ip[:], cr.read(16))
+		path.endDepth = int(cr.read(1)[0])
+		path.record = cr.record()
+		if cr.err != nil {
+			return cr.err
+		}
+		if path.endDepth > t.treeDepth || path.record.recordType != recordTypeData {
+			return errors.New("checkpoint has an invalid compressed path")
+		}
+		if err := t.restoreDataRecord(path.record); err != nil {
+			return err
+		}
+		if t.storage != nil {
+			paths, err := growMapped(t.storage.paths, t.paths, 1)
+			if err != nil {
+				return err
+			}
+			t.paths = paths
+		}
+		t.paths = append(t.paths, path)
+	}
+
+	nodeCount := cr.count("node")
+	if cr.err == nil && nodeCount == 0 {
+		return errors.New("checkpoint has no root node")
+	}
+	for index := range nodeCount {
+		var n node
+		for i := range n.children {
+			n.children[i] = cr.record()
+		}
+		if cr.err != nil {
+			return cr.err
+		}
+		for _, child := range n.children {
+			if err := t.restoreRecord(child, index, nodeCount); err != nil {
+				return err
+			}
+		}
+		if index == 0 {
+			*t.nodeAt(rootNodeIndex) = n
+		} else {
+			t.newNode(n.children)
+		}
+	}
+
+	want := crc32.NewIEEE().Sum32()
+	if cr.err == nil {
+		want = cr.crc.Sum32()
+	}
+	var trailer [4]byte
+	if _, err := io.ReadFull(cr.r, trailer[:]); err != nil {
+		return checkpointReadError(err)
+	}
+	if binary.BigEndian.Uint32(trailer[:]) != want {
+		return errors.New("checkpoint checksum mismatch")
+	}
+
+	for index := 1; index < len(store.nodes); index++ {
+		if store.nodes[index].refCount == 0 {
+			return fmt.Errorf("checkpoint value %d is unused", index)
+		}
+	}
+	return nil
+}
+
+// restoreRecord validates a record of the node at index and takes the
+// references it holds.
+func (t *Tree) restoreRecord(r record, index, nodeCount int) error {
+	switch r.recordType {
+	case recordTypeEmpty, recordTypeReserved:
+		return nil
+	case recordTypeData:
+		return t.restoreDataRecord(r)
+	case recordTypeNode, recordTypeFixedNode:
+		// Preorder numbering puts every child after its parent, which also
+		// rules out cycles.
+		if int(r.nodeIndex) <= index || int(r.nodeIndex) >= nodeCount {
+			return fmt.Errorf("checkpoint node %d has an invalid child %d", index, r.nodeIndex)
+		}
+	case recordTypeAlias:
+		if int(r.nodeIndex) >= nodeCount {
+			return fmt.Errorf("checkpoint node %d has an invalid alias %d", index, r.nodeIndex)
+		}
+	case recordTypePath:
+		if int(r.nodeIndex) >= len(t.paths) {
+			return fmt.Errorf("checkpoint node %d has an invalid path %d", index, r.nodeIndex)
+		}
+	default:
+		return fmt.Errorf("checkpoint node %d has record type %d", index, r.recordType)
+	}
+	return nil
+}
+
+// restoreDataRecord validates a data record and takes its value reference.
+func (t *Tree) restoreDataRecord(r record) error {
+	store := t.valueStore
+	if r.value == nilValueRef || int(r.value) >= len(store.nodes) {
+		return fmt.Errorf("checkpoint record has an invalid value %d", r.value)
+	}
+	if t.trackProvenance && r.nodeIndex != noNodeIndex &&
+		int(r.nodeIndex) >= len(t.provenance) {
+		return fmt.Errorf("checkpoint record has an invalid provenance %d", r.nodeIndex)
+	}
+	store.retain(r.value)
+	return nil
+}
+
+// restoreNode appends a value read from a checkpoint to the store. Its
+// children must already be restored. It starts with no references. Its
+// parents and the tree's records take theirs as they are restored.
+func (s *valueStore) restoreNode(
+	kind valueKind,
+	payload []byte,
+	children []valueRef,
+) error {
+	if uint64(len(s.nodes)) > math.MaxUint32 {
+		return errors.New("checkpoint contains too many values")
+	}
+	ref := valueRef(len(s.nodes)) //nolint:gosec // node count was bounded above
+	if kind == valueKindInvalid || kind > valueKindUint128 ||
+		(kind == valueKindMap && len(children)%2 != 0) {
+		return fmt.Errorf("checkpoint value %d has an invalid kind %d", ref, kind)
+	}
+	for _, child := range children {
+		if child == nilValueRef || child >= ref {
+			return fmt.Errorf("checkpoint value %d has an invalid child %d", ref, child)
+		}
+	}
+	hash := s.hashNode(kind, payload, children)
+	for other := s.buckets[hash]; other != nilValueRef; other = s.nodes[other].nextInBucket {
+		node := &s.nodes[other]
+		if node.kind == kind &&
+			bytes.Equal(s.payload(node), payload) &&
+			slices.Equal(s.childRefs(node), children) {
+			return fmt.Errorf("checkpoint values %d and %d are equal", other, ref)
+		}
+	}
+	payloadOffset, err := s.payloads.put(payload)
+	if err != nil {
+		return err
+	}
+	childrenOffset, err := s.children.put(children)
+	if err != nil {
+		return err
+	}
+	s.nodes = append(s.nodes, valueNode{
+		hash:           hash,
+		payloadOffset:  payloadOffset,
+		payloadLen:     uint32(len(payload)), //nolint:gosec // payload arena accepted this length
+		childrenOffset: childrenOffset,
+		childrenLen:    uint32(len(children)), //nolint:gosec // child arena accepted this length
+		nextInBucket:   s.buckets[hash],
+		kind:           kind,
+	})
+	s.buckets[hash] = ref
+	for _, child := range children {
+		s.retain(child)
+	}
+	return nil
+}
+
+// checkpointWriter encodes checkpoint fields. The first error sticks, and
+// every later write does nothing.
+type checkpointWriter struct {
+	w   *bufio.Writer
+	err error
+	buf []byte
+}
+
+func (cw *checkpointWriter) write(b []byte) {
+	if cw.err == nil {
+		_, cw.err = cw.w.Write(b)
+	}
+}
+
+func (cw *checkpointWriter) uvarint(v uint64) {
+	cw.buf = binary.AppendUvarint(cw.buf[:0], v)
+	cw.write(cw.buf)
+}
+
+func (cw *checkpointWriter) varint(v int64) {
+	cw.buf = binary.AppendVarint(cw.buf[:0], v)
+	cw.write(cw.buf)
+}
+
+func (cw *checkpointWriter) uint32(v uint32) {
+	cw.buf = binary.BigEndian.AppendUint32(cw.buf[:0], v)
+	cw.write(cw.buf)
+}
+
+func (cw *checkpointWriter) bool(v bool) {
+	b := byte(0)
+	if v {
+		b = 1
+	}
+	cw.write([]byte{b})
+}
+
+func (cw *checkpointWriter) bytes(b []byte) {
+	cw.uvarint(uint64(len(b)))
+	cw.write(b)
+}
+
+func (cw *checkpointWriter) string(s string) {
+	cw.uvarint(uint64(len(s)))
+	if cw.err == nil {
+		_, cw.err = cw.w.WriteString(s)
+	}
+}
+
+func (cw *checkpointWriter) prefix(prefix netip.Prefix) {
+	encoded, err := prefix.MarshalBinary()
+	if err != nil && cw.err == nil {
+		cw.err = err
+	}
+	cw.bytes(encoded)
+}
+
+func (cw *checkpointWriter) prefixes(prefixes []netip.Prefix) {
+	cw.uvarint(uint64(len(prefixes)))
+	for _, prefix := range prefixes {
+		cw.prefix(prefix)
+	}
+}
+
+func (cw *checkpointWriter) record(r record) {
+	cw.buf = binary.BigEndian.AppendUint32(cw.buf[:0], uint32(r.value))
+	cw.buf = binary.BigEndian.AppendUint32(cw.buf, uint32(r.nodeIndex))
+	cw.buf = append(cw.buf, byte(r.recordType))
+	cw.write(cw.buf)
+}
+
+// checkpointReader decodes checkpoint fields and checksums what it reads. The
+// first error sticks, and every later read returns zero values.
+type checkpointReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+	err error
+	buf []byte
+}
+
+// read returns the next n bytes. They are valid until the next read.
+func (cr *checkpointReader) read(n int) []byte {
+	if cap(cr.buf) < n {
+		cr.buf = make([]byte, n)
+	}
+	buf := cr.buf[:n]
+	if cr.err != nil {
+		clear(buf)
+		return buf
+	}
+	if _, err := io.ReadFull(cr.r, buf); err != nil {
+		cr.err = checkpointReadError(err)
+		clear(buf)
+		return buf
+	}
+	_, _ = cr.crc.Write(buf)
+	return buf
+}
+
+// ReadByte lets binary.ReadUvarint read through the checksum.
+func (cr *checkpointReader) ReadByte() (byte, error) {
+	b := cr.read(1)[0]
+	return b, cr.err
+}
+
+func (cr *checkpointReader) uvarint() uint64 {
+	if cr.err != nil {
+		return 0
+	}
+	v, err := binary.ReadUvarint(cr)
+	if err != nil && cr.err == nil {
+		cr.err = checkpointReadError(err)
+	}
+	return v
+}
+
+func (cr *checkpointReader) varint() int64 {
+	if cr.err != nil {
+		return 0
+	}
+	v, err := binary.ReadVarint(cr)
+	if err != nil && cr.err == nil {
+		cr.err = checkpointReadError(err)
+	}
+	return v
+}
+
+// count reads an element count. A count that could not fit in the remaining
+// input is not rejected here, but a corrupt one fails on the first missing
+// element rather than allocating for it up front.
+func (cr *checkpointReader) count(what string) int {
+	n := cr.uvarint()
+	if n > math.MaxUint32 && cr.err == nil {
+		cr.err = fmt.Errorf("checkpoint %s count %d is too large", what, n)
+	}
+	if cr.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (cr *checkpointReader) uint32() uint32 {
+	return binary.BigEndian.Uint32(cr.read(4))
+}
+
+func (cr *checkpointReader) bool() bool {
+	return cr.read(1)[0] != 0
+}
+
+// bytes reads a length-prefixed byte string into a new slice.
+func (cr *checkpointReader) bytes() []byte {
+	n := cr.count("byte")
+	var b []byte
+	// Read in bounded chunks, so a corrupt length cannot force a huge
+	// allocation before the input runs out.
+	for n > 0 && cr.err == nil {
+		chunk := min(n, 1<<20)
+		b = append(b, cr.read(chunk)...)
+		n -= chunk
+	}
+	return b
+}
+
+func (cr *checkpointReader) string() string {
+	return string(cr.bytes())
+}
+
+func (cr *checkpointReader) prefix() netip.Prefix {
+	encoded := cr.bytes()
+	var prefix netip.Prefix
+	if cr.err == nil {
+		if err := prefix.UnmarshalBinary(encoded); err != nil {
+			cr.err = fmt.Errorf("decoding checkpoint network: %w", err)
+		}
+	}
+	return prefix
+}
+
+func (cr *checkpointReader) prefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for range cr.count("network") {
+		prefixes = append(prefixes, cr.prefix())
+	}
+	return prefixes
+}
+
+func (cr *checkpointReader) record() record {
+	buf := cr.read(checkpointRecordSize)
+	return record{
+		value:      valueRef(binary.BigEndian.Uint32(buf)),
+		nodeIndex:  nodeIndex(binary.BigEndian.Uint32(buf[4:])),
+		recordType: recordType(buf[8]),
+	}
+}
+
+func checkpointReadError(err error) error {
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("reading checkpoint: %w", err)
+}
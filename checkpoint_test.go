@@ -0,0 +1,160 @@
+package mmdbwriter
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/maxmind/mmdbwriter/v2/inserter"
+	"github.com/maxmind/mmdbwriter/v2/mmdbtype"
+)
+
+// TestCheckpointResume pins that a resumed tree writes the same database as
+// the tree it was checkpointed from, and keeps doing so as both receive the
+// rest of the inserts.
+func TestCheckpointResume(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+	}{
+		{"IPv4", Options{IPVersion: 4, RecordSize: 24}},
+		{"IPv6", Options{IPVersion: 6, Languages: []string{"en", "fr"}}},
+		{"IPv6 with provenance", Options{IPVersion: 6, TrackProvenance: true}},
+		{"IPv6 with deep merge", Options{
+			IPVersion:               6,
+			IncludeReservedNetworks: true,
+			Inserter:                inserter.DeepMerge,
+			ConflictPolicy:          ConflictCollect,
+		}},
+		{"IPv6 on disk", Options{IPVersion: 6, Storage: StorageDisk}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.options.BuildEpoch = 1
+			test.options.DatabaseType = "checkpoint-test"
+			test.options.Description = map[string]string{"en": "Checkpoint test", "de": "Test"}
+			if test.options.Storage == StorageDisk {
+				test.options.StorageDir = t.TempDir()
+			}
+			tree, err := New(test.options)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, tree.Close()) }()
+			require.NoError(t, tree.SetExtraMetadata(mmdbtype.Map{
+				"source": mmdbtype.Slice{mmdbtype.String("checkpoint"), mmdbtype.Uint32(7)},
+			}))
+
+			specs := randomInsertSpecs(t, tree, 3, true)
+			for _, spec := range specs[:len(specs)/2] {
+				tree.SetProvenanceSource(spec.network.String())
+				require.NoError(t, tree.Insert(spec.network, spec.value))
+			}
+			tree.TakeConflicts()
+
+			var checkpoint bytes.Buffer
+			require.NoError(t, tree.Checkpoint(&checkpoint))
+			resumed, err := Resume(bytes.NewReader(checkpoint.Bytes()), test.options)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, resumed.Close()) }()
+			require.Equal(t, writeTreeBytes(t, tree), writeTreeBytes(t, resumed))
+
+			for _, spec := range specs[len(specs)/2:] {
+				tree.SetProvenanceSource(spec.network.String())
+				resumed.SetProvenanceSource(spec.network.String())
+				require.NoError(t, tree.Insert(spec.network, spec.value))
+				require.NoError(t, resumed.Insert(spec.network, spec.value))
+			}
+			assert.Equal(t, tree.TakeConflicts(), resumed.TakeConflicts())
+			require.Equal(t, writeTreeBytes(t, tree), writeTreeBytes(t, resumed))
+			checkWrittenTree(t, resumed)
+
+			// Both trees hold only the state the checkpoint captures, so
+			// they checkpoint identically.
+			var fromTree, fromResumed bytes.Buffer
+			require.NoError(t, tree.Checkpoint(&fromTree))
+			require.NoError(t, resumed.Checkpoint(&fromResumed))
+			assert.Equal(t, fromTree.Bytes(), fromResumed.Bytes())
+
+			if test.options.TrackProvenance {
+				r := rand.New(rand.NewPCG(3, 0))
+				for range 100 {
+					addr := netip.AddrFrom16([16]byte{0x20, byte(r.IntN(4)), byte(r.IntN(256))})
+					wantPrefix, want, wantOK := tree.Provenance(addr)
+					gotPrefix, got, gotOK := resumed.Provenance(addr)
+					assert.Equal(t, wantOK, gotOK, addr)
+					assert.Equal(t, wantPrefix, gotPrefix, addr)
+					assert.Equal(t, want, got, addr)
+				}
+			}
+		})
+	}
+}
+
+// TestResumeKeepsAliasesAndReservedNetworks pins that a resumed tree still
+// rejects inserts into aliased and reserved networks.
+func TestResumeKeepsAliasesAndReservedNetworks(t *testing.T) {
+	tree, err := New(Options{BuildEpoch: 1})
+	require.NoError(t, err)
+	require.NoError(t, tree.Insert(netip.MustParsePrefix("1.1.1.0/24"), mmdbtype.String("a")))
+
+	var checkpoint bytes.Buffer
+	require.NoError(t, tree.Checkpoint(&checkpoint))
+	resumed, err := Resume(&checkpoint, Options{})
+	require.NoError(t, err)
+
+	assert.Equal(t, writeTreeBytes(t, tree), writeTreeBytes(t, resumed))
+
+	err = resumed.Insert(netip.MustParsePrefix("10.0.0.0/24"), mmdbtype.String("b"))
+	var reservedErr *ReservedNetworkError
+	require.ErrorAs(t, err, &reservedErr)
+	err = resumed.Insert(netip.MustParsePrefix("2002::/24"), mmdbtype.String("b"))
+	var aliasErr *AliasedNetworkError
+	require.ErrorAs(t, err, &aliasErr)
+}
+
+// TestResumeRejectsCorruptCheckpoint pins that Resume reports damaged input
+// instead of returning a tree built from it.
+func TestResumeRejectsCorruptCheckpoint(t *testing.T) {
+	tree, err := New(Options{BuildEpoch: 1})
+	require.NoError(t, err)
+	for _, insert := range []struct {
+		network string
+		value   mmdbtype.DataType
+	}{
+		{"1.0.0.0/8", mmdbtype.String("a")},
+		{"1.1.0.0/16", mmdbtype.Map{"country": mmdbtype.String("US")}},
+		{"2600::/16", mmdbtype.Slice{mmdbtype.Uint32(1), mmdbtype.String("b")}},
+		{"2600:1::/32", mmdbtype.Map{"tags": mmdbtype.Slice{mmdbtype.Bool(true)}}},
+	} {
+		require.NoError(t, tree.Insert(netip.MustParsePrefix(insert.network), insert.value))
+	}
+	var checkpoint bytes.Buffer
+	require.NoError(t, tree.Checkpoint(&checkpoint))
+	data := checkpoint.Bytes()
+
+	_, err = Resume(bytes.NewReader([]byte("MMDB")), Options{})
+	require.EqualError(t, err, "resuming tree: reading checkpoint: unexpected EOF")
+	_, err = Resume(bytes.NewReader(bytes.Repeat([]byte{1}, 64)), Options{})
+	require.EqualError(t, err, "resuming tree: not a checkpoint")
+
+	for _, size := range []int{len(checkpointMagic) + 1, len(data) / 2, len(data) - 1} {
+		_, err := Resume(bytes.NewReader(data[:size]), Options{})
+		require.Error(t, err, "size %d", size)
+	}
+
+	r := rand.New(rand.NewPCG(4, 0))
+	for range 200 {
+		corrupt := bytes.Clone(data)
+		corrupt[len(checkpointMagic)+r.IntN(len(corrupt)-len(checkpointMagic))] ^= byte(1 + r.IntN(255))
+		_, err := Resume(bytes.NewReader(corrupt), Options{})
+		require.Error(t, err)
+	}
+
+	corrupt := bytes.Clone(data)
+	corrupt[len(corrupt)-1] ^= 1
+	_, err = Resume(bytes.NewReader(corrupt), Options{})
+	require.EqualError(t, err, "resuming tree: checkpoint checksum mismatch")
+}
@@ -0,0 +1,243 @@
+package mmdbwriter
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"sync/atomic"
+)
+
+// Clone returns an independent copy of the tree, so variants can be built
+// from one expensive base without loading or building it again.
+//
+// Clone copies the search tree nodes, the compressed insertion paths, and the
+// per-value bookkeeping, including the reference counts, as flat arrays. The
+// encoded values themselves are not copied: the two trees share the value
+// arenas copy-on-write, as well as the read-only value views. While the trees
+// share an arena, neither reuses the space in it that the other might still
+// read, and the first insert that grows it copies it. Closing either tree
+// ends its share. So inserting into, closing, or discarding either tree does
+// not affect the other. The clone keeps the original's settings, provenance,
+// and pending conflicts.
+//
+// A tree kept on disk is cloned into new temporary files in the same
+// directory, and copies the value arenas into its own files when it first
+// grows them. Clone is not safe to call concurrently with any other Tree
+// method, but the original and the clone may then be used concurrently.
+func (t *Tree) Clone() (*Tree, error) {
+	clone := *t
+	clone.description = maps.Clone(t.description)
+	clone.languages = slices.Clone(t.languages)
+	clone.mapKeyOrder.Priority = slices.Clone(t.mapKeyOrder.Priority)
+	clone.ipv4Aliases = slices.Clone(t.ipv4Aliases)
+	clone.reservedNetworks = slices.Clone(t.reservedNetworks)
+	clone.conflicts = slices.Clone(t.conflicts)
+	clone.provenance = slices.Clone(t.provenance)
+	// finalize rebuilds these before every write.
+	clone.nodeNumbers = nil
+	clone.collapsedValues = nil
+	clone.nodeCount = 0
+
+	clone.storage = nil
+	var payloadFile, childFile, pathFile *mappedFile
+	if t.storage != nil {
+		storage, err := newDiskStorage(t.storage.dir)
+		if err != nil {
+			return nil, err
+		}
+		clone.storage = storage
+		payloadFile = storage.payloads
+		childFile = storage.children
+		pathFile = storage.paths
+	}
+
+	// Until the clone has its own value store, closing it would release the
+	// original's arenas, so failures release only the new files.
+	fail := func(err error) (*Tree, error) {
+		if clone.storage != nil {
+			err = errors.Join(err, clone.storage.close())
+		}
+		return nil, err
+	}
+
+	clone.nodeBlocks = make([][]node, 0, len(t.nodeBlocks))
+	for _, block := range t.nodeBlocks {
+		var cloneBlock []node
+		if clone.storage == nil {
+			cloneBlock = make([]node, nodeBlockSize)
+		} else {
+			var err error
+			cloneBlock, err = clone.storage.nodeBlock()
+			if err != nil {
+				return fail(err)
+			}
+		}
+		copy(cloneBlock, block)
+		clone.nodeBlocks = append(clone.nodeBlocks, cloneBlock)
+	}
+
+	paths, err := cloneMapped(pathFile, t.paths)
+	if err != nil {
+		return fail(err)
+	}
+	clone.paths = paths
+	clone.valueStore = t.valueStore.clone(payloadFile, childFile)
+
+	if err := clone.maybeAuditValueStore(); err != nil {
+		return nil, clone.closeAfter(err)
+	}
+	return &clone, nil
+}
+
+// clone returns a copy of the store that shares its arenas, which grow into
+// the given files, or on the heap for nil files. The copy also shares the
+// materialized views, which are never modified.
+func (s *valueStore) clone(payloadFile, childFile *mappedFile) *valueStore {
+	return &valueStore{
+		nodes:    slices.Clone(s.nodes),
+		freeRefs: slices.Clone(s.freeRefs),
+		buckets:  maps.Clone(s.buckets),
+		payloads: byteArena{
+			data:         slices.Clip(s.payloads.data),
+			free:         cloneFreeLists(s.payloads.free),
+			file:         payloadFile,
+			arenaSharing: s.payloads.shareWith(s.payloads.file, len(s.payloads.data)),
+		},
+		children: refArena{
+			data:         slices.Clip(s.children.data),
+			free:         cloneFreeLists(s.children.free),
+			file:         childFile,
+			arenaSharing: s.children.shareWith(s.children.file, len(s.children.data)),
+		},
+		materializedByIdentity: maps.Clone(s.materializedByIdentity),
+		callerByIdentity:       maps.Clone(s.callerByIdentity),
+		callerIdentity:         slices.Clone(s.callerIdentity),
+		callerIdentityHead:     s.callerIdentityHead,
+		callerIdentityTail:     s.callerIdentityTail,
+		callerIdentityLimit:    s.callerIdentityLimit,
+		poisonFreedRefs:        s.poisonFreedRefs,
+		hashFunc:               s.hashFunc,
+	}
+}
+
+// arenaShare counts the arenas reading one array since Clone shared it.
+type arenaShare struct {
+	arenas atomic.Int32
+}
+
+// arenaSharing is the copy-on-write state of a value arena. While another
+// arena shares its array, the arena writes nothing below sharedLen, which that
+// arena may read: it leaves extents freed there on its free list without
+// reusing or clearing them, and copies the array before appending would
+// write into it. The array past sharedLen is the arena's own, since a clone's
+// array has no spare capacity.
+type arenaSharing struct {
+	share     *arenaShare
+	sharedLen uint32
+	// borrowed is the mapped file holding the array, when it is another
+	// tree's. The arena holds a reference to it until it copies the array
+	// into its own file.
+	borrowed *mappedFile
+}
+
+// shareWith marks the arena's first length elements as shared with a copy
+// reading the same array, and returns the copy's sharing state. file is the
+// arena's own file.
+func (s *arenaSharing) shareWith(file *mappedFile, length int) arenaSharing {
+	if s.share == nil {
+		s.share = &arenaShare{}
+		s.share.arenas.Store(1)
+	}
+	s.share.arenas.Add(1)
+	s.sharedLen = uint32(length) //nolint:gosec // arenas are bounded by MaxUint32
+	borrowed := s.borrowed
+	if borrowed == nil {
+		borrowed = file
+	}
+	if borrowed != nil {
+		borrowed.retain()
+	}
+	return arenaSharing{share: s.share, sharedLen: s.sharedLen, borrowed: borrowed}
+}
+
+// writable reports whether no other arena reads the extent at offset.
+func (s *arenaSharing) writable(offset uint32) bool {
+	if s.share == nil || offset >= s.sharedLen {
+		return true
+	}
+	if s.share.arenas.Load() > 1 {
+		return false
+	}
+	// The other arenas have left, so the array is this arena's alone.
+	s.share = nil
+	s.sharedLen = 0
+	return true
+}
+
+// leave ends the arena's use of a shared array, once it has copied the array
+// or its tree is closing.
+func (s *arenaSharing) leave() error {
+	if s.share != nil {
+		s.share.arenas.Add(-1)
+	}
+	var err error
+	if s.borrowed != nil {
+		err = s.borrowed.close()
+	}
+	*s = arenaSharing{}
+	return err
+}
+
+// growArena gives *data room to append n more elements without reallocating,
+// as growMapped does, for an arena with the given sharing state and own file.
+// An array another tree's file holds is first copied into file. On the heap,
+// append's reallocation is the copy, so a shared array is grown here, and
+// the arena then leaves the share.
+func growArena[T any](s *arenaSharing, file *mappedFile, data *[]T, n int) error {
+	if len(*data)+n <= cap(*data) {
+		return nil
+	}
+	switch {
+	case s.borrowed != nil:
+		copied, err := cloneMapped(file, *data)
+		if err != nil {
+			return err
+		}
+		*data = copied
+		if err := s.leave(); err != nil {
+			return err
+		}
+	case file == nil && s.share != nil:
+		*data = slices.Grow(*data, n)
+		return s.leave()
+	}
+	grown, err := growMapped(file, *data, n)
+	if err != nil {
+		return err
+	}
+	*data = grown
+	return nil
+}
+
+// cloneMapped copies data into m, or onto the heap for a nil m.
+func cloneMapped[T any](m *mappedFile, data []T) ([]T, error) {
+	if m == nil {
+		return slices.Clone(data), nil
+	}
+	clone, err := growMapped(m, []T(nil), len(data))
+	if err != nil {
+		return nil, err
+	}
+	return append(clone, data...), nil
+}
+
+func cloneFreeLists(free map[uint32][]uint32) map[uint32][]uint32 {
+	if free == nil {
+		return nil
+	}
+	clone := make(map[uint32][]uint32, len(free))
+	for length, offsets := range free {
+		clone[length] = slices.Clone(offsets)
+	}
+	return clone
+}
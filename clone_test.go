@@ -0,0 +1,130 @@
+package mmdbwriter
+
+import (
+	"net/netip"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/maxmind/mmdbwriter/v2/inserter"
+	"github.com/maxmind/mmdbwriter/v2/mmdbtype"
+)
+
+// TestCloneIsIndependent pins that a clone writes the same database as its
+// original, and that later inserts into either tree leave the other as it
+// was.
+func TestCloneIsIndependent(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+	}{
+		{"IPv4", Options{IPVersion: 4}},
+		{"IPv6 with provenance", Options{IPVersion: 6, TrackProvenance: true}},
+		{"IPv6 with deep merge", Options{IPVersion: 6, Inserter: inserter.DeepMerge}},
+		{"IPv6 on disk", Options{IPVersion: 6, Storage: StorageDisk}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.options.BuildEpoch = 1
+			test.options.DatabaseType = "clone-test"
+			test.options.Description = map[string]string{"en": "Clone test"}
+			test.options.RefcountAudit = true
+			if test.options.Storage == StorageDisk {
+				test.options.StorageDir = t.TempDir()
+			}
+			base, err := New(test.options)
+			require.NoError(t, err)
+			baseOnly, err := New(test.options)
+			require.NoError(t, err)
+			overlaid, err := New(test.options)
+			require.NoError(t, err)
+
+			specs := randomInsertSpecs(t, base, 5, true)
+			half := len(specs) / 2
+			for _, spec := range specs[:half] {
+				require.NoError(t, base.Insert(spec.network, spec.value))
+				require.NoError(t, baseOnly.Insert(spec.network, spec.value))
+				require.NoError(t, overlaid.Insert(spec.network, spec.value))
+			}
+			// Materialize views in the base, which the clone shares.
+			for _, spec := range specs[:half] {
+				base.Get(spec.network.Addr())
+			}
+
+			clone, err := base.Clone()
+			require.NoError(t, err)
+			require.Equal(t, writeTreeBytes(t, base), writeTreeBytes(t, clone))
+
+			overlay := mmdbtype.Map{"customer": mmdbtype.String("overlay")}
+			for _, spec := range specs[half:] {
+				require.NoError(t, clone.Insert(spec.network, overlay))
+				require.NoError(t, overlaid.Insert(spec.network, overlay))
+			}
+			require.NoError(t, base.Insert(netip.MustParsePrefix("1.2.3.0/24"), overlay))
+			require.NoError(t, baseOnly.Insert(netip.MustParsePrefix("1.2.3.0/24"), overlay))
+
+			assert.Equal(t, writeTreeBytes(t, overlaid), writeTreeBytes(t, clone))
+			assert.Equal(t, writeTreeBytes(t, baseOnly), writeTreeBytes(t, base))
+
+			require.NoError(t, base.Close())
+			assert.Equal(t, writeTreeBytes(t, overlaid), writeTreeBytes(t, clone))
+			checkWrittenTree(t, clone)
+			require.NoError(t, clone.Close())
+		})
+	}
+}
+
+// TestCloneSharesValueArenas pins that a clone reads the original's value
+// arenas instead of copying them, that the original does not reuse the space
+// it frees there while the clone can still read it, and that it does once the
+// clone is closed.
+func TestCloneSharesValueArenas(t *testing.T) {
+	tests := []struct {
+		name    string
+		storage Storage
+	}{
+		{"memory", StorageMemory},
+		{"disk", StorageDisk},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := Options{IPVersion: 4, BuildEpoch: 1, RefcountAudit: true, Storage: test.storage}
+			if test.storage == StorageDisk {
+				opts.StorageDir = t.TempDir()
+			}
+			base, err := New(opts)
+			require.NoError(t, err)
+			defer func() { require.NoError(t, base.Close()) }()
+			require.NoError(t, base.Insert(netip.MustParsePrefix("1.0.0.0/8"), mmdbtype.String("aaaa")))
+			require.NoError(t, base.Insert(netip.MustParsePrefix("2.0.0.0/8"), mmdbtype.String("bbbb")))
+
+			clone, err := base.Clone()
+			require.NoError(t, err)
+			expected := writeTreeBytes(t, clone)
+			assert.Equal(t,
+				unsafe.SliceData(base.valueStore.payloads.data),
+				unsafe.SliceData(clone.valueStore.payloads.data),
+			)
+			assert.Equal(t,
+				unsafe.SliceData(base.valueStore.children.data),
+				unsafe.SliceData(clone.valueStore.children.data),
+			)
+
+			// Replacing "aaaa" frees its extent, which the clone still reads.
+			require.NoError(t, base.Insert(netip.MustParsePrefix("1.0.0.0/8"), mmdbtype.String("bbbb")))
+			require.NoError(t, base.Insert(netip.MustParsePrefix("3.0.0.0/8"), mmdbtype.String("cccc")))
+			assert.Equal(t, expected, writeTreeBytes(t, clone))
+			_, value := clone.Get(netip.MustParseAddr("1.0.0.1"))
+			assert.Equal(t, mmdbtype.String("aaaa"), value)
+
+			require.NoError(t, clone.Close())
+			size := len(base.valueStore.payloads.data)
+			require.NoError(t, base.Insert(netip.MustParsePrefix("4.0.0.0/8"), mmdbtype.String("dddd")))
+			assert.Equal(t, size, len(base.valueStore.payloads.data))
+			_, value = base.Get(netip.MustParseAddr("4.0.0.1"))
+			assert.Equal(t, mmdbtype.String("dddd"), value)
+		})
+	}
+}
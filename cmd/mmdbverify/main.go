@@ -0,0 +1,47 @@
+// Command mmdbverify checks that MaxMind DB files are structurally sound. It
+// prints each problem found to standard error and exits with status 1 if any
+// file fails.
+//
+// Usage:
+//
+//	mmdbverify file.mmdb...
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/maxmind/mmdbwriter/v2"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s file.mmdb...\n", os.Args[0])
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, path := range flag.Args() {
+		if err := verify(path); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func verify(path string) error {
+	file, err := os.Open(path) //nolint:gosec // the user chose the path
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return mmdbwriter.Verify(file)
+}
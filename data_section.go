@@ -2,12 +2,119 @@ package mmdbwriter
 
 import (
 	"bytes"
+	"cmp"
 	"fmt"
+	"maps"
 	"math"
+	"slices"
 
 	"github.com/maxmind/mmdbwriter/v2/mmdbtype"
 )
 
+// MapKeyOrder selects the order in which Tree.WriteTo writes the keys of the
+// maps in the data section. The zero value writes them in lexical order.
+// Readers that decode a map in order and stop once they have the field they
+// need, such as a country lookup, decode less when that field comes first.
+//
+// Every order is a function of the tree's contents alone, so builds stay
+// reproducible. The order does not change which values are equal, and Get and
+// Load always see maps as unordered.
+type MapKeyOrder struct {
+	// Priority lists the keys written before all others, in this order, such
+	// as "country" and "continent". It applies to maps at any depth. A key
+	// must not be listed twice.
+	Priority []string
+
+	// ByFrequency writes the keys not in Priority in descending order of the
+	// number of distinct maps in the data section that hold them, rather
+	// than in lexical order. Keys held by equally many maps are written in
+	// lexical order.
+	ByFrequency bool
+}
+
+func (o MapKeyOrder) validate() error {
+	seen := make(map[string]bool, len(o.Priority))
+	for _, key := range o.Priority {
+		if seen[key] {
+			return fmt.Errorf("MapKeyOrder.Priority lists %q twice", key)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// mapKeyRanks returns the position of every map key in the data section
+// under the tree's MapKeyOrder, indexed by the key's valueRef, or nil for the
+// lexical order that the store already keeps map children in. It must run
+// after finalize.
+func (t *Tree) mapKeyRanks() []uint32 {
+	order := t.mapKeyOrder
+	if len(order.Priority) == 0 && !order.ByFrequency {
+		return nil
+	}
+	store := t.valueStore
+
+	// counts holds the number of distinct written maps holding each key.
+	counts := map[valueRef]int{}
+	visited := make([]bool, len(store.nodes))
+	var visit func(ref valueRef)
+	visit = func(ref valueRef) {
+		if visited[ref] {
+			return
+		}
+		visited[ref] = true
+		node := store.node(ref)
+		children := store.childRefs(node)
+		if node.kind != valueKindMap {
+			for _, child := range children {
+				visit(child)
+			}
+			return
+		}
+		for i := 0; i < len(children); i += 2 {
+			counts[children[i]]++
+			visit(children[i+1])
+		}
+	}
+	for record := range t.dataRecords() {
+		visit(record.value)
+	}
+
+	priority := make(map[string]int, len(order.Priority))
+	for i, key := range order.Priority {
+		priority[key] = i
+	}
+	names := make(map[valueRef]string, len(counts))
+	for ref := range counts {
+		names[ref] = string(scalarPayload(store.payload(store.node(ref))))
+	}
+	keys := slices.Collect(maps.Keys(counts))
+	slices.SortFunc(keys, func(left, right valueRef) int {
+		leftPriority, leftListed := priority[names[left]]
+		rightPriority, rightListed := priority[names[right]]
+		switch {
+		case leftListed && rightListed:
+			return cmp.Compare(leftPriority, rightPriority)
+		case leftListed:
+			return -1
+		case rightListed:
+			return 1
+		}
+		if order.ByFrequency {
+			if c := cmp.Compare(counts[right], counts[left]); c != 0 {
+				return c
+			}
+		}
+		return cmp.Compare(names[left], names[right])
+	})
+
+	ranks := make([]uint32, len(store.nodes))
+	for rank, ref := range keys {
+		ranks[ref] = uint32(rank) //nolint:gosec // bounded by the number of values
+	}
+	return ranks
+}
+
 type writtenType struct {
 	pointer mmdbtype.Pointer
 	size    int64
@@ -22,6 +129,9 @@ type dataWriter struct {
 	// hashing and exact comparison the previous writer needed for every value.
 	offsets     []writtenType
 	usePointers bool
+	// keyRanks orders the keys of every map written, indexed by the key's
+	// valueRef. A nil slice keeps the store's lexical order.
+	keyRanks []uint32
 }
 
 func newDataWriter(store *valueStore, usePointers bool) *dataWriter {
@@ -82,7 +192,11 @@ func (dw *dataWriter) writeValue(ref valueRef) (int64, error) {
 	if err := writeContainerHeader(dw, node.kind, size); err != nil {
 		return int64(dw.Len() - start), err
 	}
-	for _, child := range dw.store.childRefs(node) {
+	children := dw.store.childRefs(node)
+	if node.kind == valueKindMap && dw.keyRanks != nil {
+		children = dw.orderMapChildren(children)
+	}
+	for _, child := range children {
 		if _, err := dw.writeOrWritePointer(child); err != nil {
 			return int64(dw.Len() - start), err
 		}
@@ -90,6 +204,24 @@ func (dw *dataWriter) writeValue(ref valueRef) (int64, error) {
 	return int64(dw.Len() - start), nil
 }
 
+// orderMapChildren returns a copy of a map's key and value refs with the pairs
+// sorted by keyRanks. It copies because writing the values can reach nested
+// maps, and because the store's children must stay in lexical order.
+func (dw *dataWriter) orderMapChildren(children []valueRef) []valueRef {
+	pairs := make([][2]valueRef, 0, len(children)/2)
+	for i := 0; i < len(children); i += 2 {
+		pairs = append(pairs, [2]valueRef{children[i], children[i+1]})
+	}
+	slices.SortFunc(pairs, func(left, right [2]valueRef) int {
+		return cmp.Compare(dw.keyRanks[left[0]], dw.keyRanks[right[0]])
+	})
+	ordered := make([]valueRef, 0, len(children))
+	for _, pair := range pairs {
+		ordered = append(ordered, pair[0], pair[1])
+	}
+	return ordered
+}
+
 func (dw *dataWriter) rememberOffset(ref valueRef, offset int, size int64) error {
 	dw.ensureOffset(ref)
 	if dw.offsets[ref].written {
@@ -2,8 +2,11 @@ package mmdbwriter
 
 import (
 	"bytes"
+	"net/netip"
 	"testing"
 
+	"github.com/oschwald/maxminddb-golang/v2"
+	"github.com/oschwald/maxminddb-golang/v2/mmdbdata"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -175,3 +178,149 @@ func TestWriteContainerHeaderSizeBoundaries(t *testing.T) {
 	err := writeContainerHeader(&output, valueKindMap, 16843037)
 	require.ErrorContains(t, err, "cannot store")
 }
+
+// mapKeyRecorder records the keys of every map in a decoded value, in the
+// order they were written, as dotted paths.
+type mapKeyRecorder struct {
+	keys []string
+}
+
+func (r *mapKeyRecorder) UnmarshalMaxMindDB(d *mmdbdata.Decoder) error {
+	return r.record(d, "")
+}
+
+func (r *mapKeyRecorder) record(d *mmdbdata.Decoder, path string) error {
+	kind, err := d.PeekKind()
+	if err != nil {
+		return err
+	}
+	if kind != mmdbdata.KindMap {
+		return d.SkipValue()
+	}
+	entries, _, err := d.ReadMap()
+	if err != nil {
+		return err
+	}
+	for key, err := range entries {
+		if err != nil {
+			return err
+		}
+		name := path + string(key)
+		r.keys = append(r.keys, name)
+		if err := r.record(d, name+"."); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TestMapKeyOrder pins the order in which each MapKeyOrder writes map keys,
+// at every depth, and that Clone and Resume keep the order.
+func TestMapKeyOrder(t *testing.T) {
+	records := []struct {
+		network string
+		value   mmdbtype.Map
+	}{
+		{"1.0.0.0/24", mmdbtype.Map{
+			"alpha": mmdbtype.Uint32(1),
+			"city":  mmdbtype.String("x"),
+			"country": mmdbtype.Map{
+				"iso": mmdbtype.String("AA"),
+				"names": mmdbtype.Map{
+					"de": mmdbtype.String("B"),
+					"en": mmdbtype.String("A"),
+				},
+			},
+			"zeta": mmdbtype.Uint32(1),
+		}},
+		{"2.0.0.0/24", mmdbtype.Map{"beta": mmdbtype.Uint32(2), "zeta": mmdbtype.Uint32(2)}},
+		{"3.0.0.0/24", mmdbtype.Map{
+			"beta": mmdbtype.Uint32(3),
+			"city": mmdbtype.String("y"),
+			"zeta": mmdbtype.Uint32(3),
+		}},
+	}
+	tests := []struct {
+		name  string
+		order MapKeyOrder
+		// expected holds the keys written for the first and last record.
+		expected [2][]string
+	}{
+		{
+			name: "lexical",
+			expected: [2][]string{
+				{"alpha", "city", "country", "country.iso", "country.names",
+					"country.names.de", "country.names.en", "zeta"},
+				{"beta", "city", "zeta"},
+			},
+		},
+		{
+			name:  "priority",
+			order: MapKeyOrder{Priority: []string{"country", "city", "names"}},
+			expected: [2][]string{
+				{"country", "country.names", "country.names.de", "country.names.en",
+					"country.iso", "city", "alpha", "zeta"},
+				{"city", "beta", "zeta"},
+			},
+		},
+		{
+			name: "priority and frequency",
+			order: MapKeyOrder{
+				Priority:    []string{"country", "city", "names"},
+				ByFrequency: true,
+			},
+			expected: [2][]string{
+				{"country", "country.names", "country.names.de", "country.names.en",
+					"country.iso", "city", "zeta", "alpha"},
+				{"city", "zeta", "beta"},
+			},
+		},
+		{
+			name:  "frequency",
+			order: MapKeyOrder{ByFrequency: true},
+			expected: [2][]string{
+				{"zeta", "city", "alpha", "country", "country.iso", "country.names",
+					"country.names.de", "country.names.en"},
+				{"zeta", "beta", "city"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tree, err := New(Options{
+				IPVersion:    4,
+				BuildEpoch:   1,
+				DatabaseType: "map-key-order-test",
+				Description:  map[string]string{"en": "Map key order test"},
+				MapKeyOrder:  test.order,
+			})
+			require.NoError(t, err)
+			for _, record := range records {
+				require.NoError(t, tree.Insert(netip.MustParsePrefix(record.network), record.value))
+			}
+			written := writeTreeBytes(t, tree)
+			checkWrittenTree(t, tree)
+
+			reader, err := maxminddb.OpenBytes(written)
+			require.NoError(t, err)
+			for i, ip := range []string{"1.0.0.1", "3.0.0.1"} {
+				var recorder mapKeyRecorder
+				require.NoError(t, reader.Lookup(netip.MustParseAddr(ip)).Decode(&recorder))
+				assert.Equal(t, test.expected[i], recorder.keys, ip)
+			}
+
+			clone, err := tree.Clone()
+			require.NoError(t, err)
+			assert.Equal(t, written, writeTreeBytes(t, clone))
+
+			var checkpoint bytes.Buffer
+			require.NoError(t, tree.Checkpoint(&checkpoint))
+			resumed, err := Resume(&checkpoint, Options{})
+			require.NoError(t, err)
+			assert.Equal(t, written, writeTreeBytes(t, resumed))
+		})
+	}
+
+	_, err := New(Options{MapKeyOrder: MapKeyOrder{Priority: []string{"city", "city"}}})
+	require.EqualError(t, err, `MapKeyOrder.Priority lists "city" twice`)
+}
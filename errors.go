@@ -14,7 +14,8 @@ import (
 var errNilInserterFunc = errors.New("inserter function must not be nil")
 
 // AliasedNetworkError is returned when inserting a aliased network into
-// a Tree where DisableIPv4Aliasing in Options is false.
+// a Tree where DisableIPv4Aliasing in Options is false. Tree.IPv4Aliases lists
+// the aliased networks.
 type AliasedNetworkError struct {
 	// AliasedNetwork is the aliased network being inserted into.
 	AliasedNetwork netip.Prefix
@@ -118,3 +119,88 @@ func (r *ReservedNetworkError) Error() string {
 		r.ReservedNetwork,
 	)
 }
+
+// ConflictPolicy selects how an insert handles the portion of its network that
+// falls inside a reserved or aliased network. An insert that merely contains
+// such a network always skips it silently, whatever the policy.
+type ConflictPolicy int
+
+const (
+	// ConflictError returns a *ReservedNetworkError or *AliasedNetworkError
+	// from the insert. It is the default.
+	ConflictError ConflictPolicy = iota
+	// ConflictSkip silently drops the conflicting portion of the insert and
+	// continues with the rest of the network.
+	ConflictSkip
+	// ConflictCollect drops the conflicting portion like ConflictSkip, and
+	// records a *ReservedNetworkError or *AliasedNetworkError for it.
+	// Tree.TakeConflicts returns the recorded errors.
+	ConflictCollect
+)
+
+// conflict applies the tree's ConflictPolicy to an insert into a reserved or
+// aliased network. newErr builds the typed error, and runs only when the
+// policy needs it.
+func (iRec *insertRecord) conflict(newErr func() error) error {
+	switch iRec.tree.conflictPolicy {
+	case ConflictSkip:
+		return nil
+	case ConflictCollect:
+		iRec.tree.conflicts = append(iRec.tree.conflicts, newErr())
+		return nil
+	default:
+		return newErr()
+	}
+}
+
+// TakeConflicts returns the conflicts recorded under ConflictCollect since the
+// last call, in the order they occurred, and clears them. Each is a
+// *ReservedNetworkError or an *AliasedNetworkError. A conflict whose network
+// could not be reported is joined with the error that prevented it, so use
+// errors.As to reach the typed error.
+func (t *Tree) TakeConflicts() []error {
+	conflicts := t.conflicts
+	t.conflicts = nil
+	return conflicts
+}
+
+// BatchError is returned by Tree.InsertBatch when any of its entries fails. The
+// other entries are still inserted.
+type BatchError struct {
+	// Entries lists the failed entries in input order.
+	Entries []*BatchEntryError
+}
+
+func (e *BatchError) Error() string {
+	if len(e.Entries) == 1 {
+		return e.Entries[0].Error()
+	}
+	return fmt.Sprintf("%d batch entries failed; first: %v", len(e.Entries), e.Entries[0])
+}
+
+// Unwrap returns the entry errors, so errors.Is and errors.As see each of them.
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, len(e.Entries))
+	for i, entry := range e.Entries {
+		errs[i] = entry
+	}
+	return errs
+}
+
+// BatchEntryError is the failure of one Tree.InsertBatch entry.
+type BatchEntryError struct {
+	// Err is the error inserting the entry returned.
+	Err error
+	// Prefix is the entry's network as passed to InsertBatch.
+	Prefix netip.Prefix
+	// Index is the entry's zero-based position in the input sequence.
+	Index int
+}
+
+func (e *BatchEntryError) Error() string {
+	return fmt.Sprintf("inserting batch entry %d (%s): %v", e.Index, e.Prefix, e.Err)
+}
+
+func (e *BatchEntryError) Unwrap() error {
+	return e.Err
+}
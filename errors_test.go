@@ -6,6 +6,8 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/maxmind/mmdbwriter/v2/mmdbtype"
 )
 
 func TestPrefixFromInsertIPLayouts(t *testing.T) {
@@ -37,3 +39,73 @@ func TestAliasedNetworkErrorFormatsIPv4SubtreePrefixes(t *testing.T) {
 		"attempt to insert 1.2.3.0/24 into 1.0.0.0/8, which is an aliased network",
 	)
 }
+
+func TestConflictPolicy(t *testing.T) {
+	newTree := func(t *testing.T, policy ConflictPolicy) *Tree {
+		t.Helper()
+		tree, err := New(Options{ConflictPolicy: policy})
+		require.NoError(t, err)
+		return tree
+	}
+	insertConflicts := func(t *testing.T, tree *Tree) error {
+		t.Helper()
+		err := tree.Insert(netip.MustParsePrefix("10.1.0.0/16"), mmdbtype.String("private"))
+		if err != nil {
+			return err
+		}
+		err = tree.InsertRange(
+			netip.MustParseAddr("9.255.255.0"),
+			netip.MustParseAddr("10.0.0.255"),
+			mmdbtype.String("range"),
+		)
+		if err != nil {
+			return err
+		}
+		return tree.Insert(netip.MustParsePrefix("2002::/24"), mmdbtype.String("6to4"))
+	}
+
+	t.Run("error", func(t *testing.T) {
+		tree := newTree(t, ConflictError)
+		var rnErr *ReservedNetworkError
+		require.ErrorAs(t, insertConflicts(t, tree), &rnErr)
+		assert.Empty(t, tree.TakeConflicts())
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		tree := newTree(t, ConflictSkip)
+		require.NoError(t, insertConflicts(t, tree))
+		assert.Empty(t, tree.TakeConflicts())
+
+		_, value := tree.Get(netip.MustParseAddr("9.255.255.1"))
+		assert.Equal(t, mmdbtype.String("range"), value)
+		_, value = tree.Get(netip.MustParseAddr("10.0.0.1"))
+		assert.Nil(t, value)
+		_, value = tree.Get(netip.MustParseAddr("10.1.0.1"))
+		assert.Nil(t, value)
+	})
+
+	t.Run("collect", func(t *testing.T) {
+		tree := newTree(t, ConflictCollect)
+		require.NoError(t, insertConflicts(t, tree))
+
+		conflicts := tree.TakeConflicts()
+		require.Len(t, conflicts, 3)
+		var rnErr *ReservedNetworkError
+		require.ErrorAs(t, conflicts[0], &rnErr)
+		assert.Equal(t, netip.MustParsePrefix("10.1.0.0/16"), rnErr.InsertedNetwork)
+		require.ErrorAs(t, conflicts[1], &rnErr)
+		assert.Equal(t, netip.MustParsePrefix("10.0.0.0/24"), rnErr.InsertedNetwork)
+		var anErr *AliasedNetworkError
+		require.ErrorAs(t, conflicts[2], &anErr)
+		assert.Equal(t, netip.MustParsePrefix("2002::/16"), anErr.AliasedNetwork)
+
+		assert.Empty(t, tree.TakeConflicts())
+		_, value := tree.Get(netip.MustParseAddr("9.255.255.1"))
+		assert.Equal(t, mmdbtype.String("range"), value)
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		_, err := New(Options{ConflictPolicy: ConflictCollect + 1})
+		require.ErrorContains(t, err, "unsupported ConflictPolicy: 3")
+	})
+}
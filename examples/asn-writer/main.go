@@ -1,5 +1,8 @@
 // asn-writer is an example of how to create an ASN MaxMind DB file from the
 // GeoLite2 ASN CSVs. You must have the CSVs in the current working directory.
+//
+// The CSVs list sorted, non-overlapping networks, with the IPv4 file sorting
+// before the IPv6 one in the tree, so it builds the tree with a BulkBuilder.
 package main
 
 import (
@@ -16,7 +19,7 @@ import (
 )
 
 func main() {
-	writer, err := mmdbwriter.New(
+	builder, err := mmdbwriter.NewBulkBuilder(
 		mmdbwriter.Options{
 			DatabaseType: "My-ASN-DB",
 			RecordSize:   24,
@@ -70,19 +73,19 @@ func main() {
 				record["autonomous_system_organization"] = mmdbtype.String(row[2])
 			}
 
-			err = writer.Insert(network, record)
+			err = builder.Insert(network, record)
 			if err != nil {
 				log.Fatal(err)
 			}
 		}
 	}
 
-	fh, err := os.Create("out.mmdb")
+	writer, err := builder.Tree()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	_, err = writer.WriteTo(fh)
+	err = writer.WriteFile("out.mmdb", mmdbwriter.WriteFileOptions{Verify: true})
 	if err != nil {
 		log.Fatal(err)
 	}
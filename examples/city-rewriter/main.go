@@ -2,7 +2,6 @@ package main
 
 import (
 	"log"
-	"os"
 
 	"github.com/maxmind/mmdbwriter/v2"
 )
@@ -15,12 +14,7 @@ func main() {
 
 	// Insert your own data...
 
-	fh, err := os.Create("out.mmdb")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	_, err = writer.WriteTo(fh)
+	err = writer.WriteFile("out.mmdb", mmdbwriter.WriteFileOptions{Verify: true})
 	if err != nil {
 		log.Fatal(err)
 	}
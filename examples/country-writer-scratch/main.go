@@ -60,13 +60,8 @@ func main() {
 		}
 	}
 
-	fh2, err := os.Create("country-scratch-out.mmdb")
-	if err != nil {
-		log.Fatal(err)
-	}
-
 	// write to the mmdb file
-	_, err = writer.WriteTo(fh2)
+	err = writer.WriteFile("country-scratch-out.mmdb", mmdbwriter.WriteFileOptions{Verify: true})
 	if err != nil {
 		log.Fatal(err)
 	}
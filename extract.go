@@ -0,0 +1,153 @@
+package mmdbwriter
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"net/netip"
+	"slices"
+)
+
+// Extract returns a new Tree, created with opts as New creates it, holding the
+// tree's data inside prefixes, such as a regional database cut from a global
+// one. A record that contains one of the prefixes is cut down to it. The
+// prefixes may overlap and may be in any order.
+//
+// The new tree's metadata, aliases, and reserved networks come from opts, not
+// from this tree. Data that falls inside one of its reserved or aliased
+// networks is handled by opts.ConflictPolicy. The values are copied between
+// the value stores as they are stored, without materializing them. With
+// Options.TrackProvenance set on both trees, each record keeps the provenance
+// it has here. Otherwise the new tree records provenance as if its networks
+// had been inserted.
+//
+// Extract returns an error without a Tree for a prefix that cannot be looked
+// up in this tree or data that cannot be inserted into the new one.
+func (t *Tree) Extract(prefixes []netip.Prefix, opts Options) (*Tree, error) {
+	networks, err := t.extractNetworks(prefixes)
+	if err != nil {
+		return nil, err
+	}
+	b, err := NewBulkBuilder(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.extractInto(b, networks); err != nil {
+		return nil, b.tree.closeAfter(err)
+	}
+	tree, err := b.Tree()
+	if err != nil {
+		return nil, b.tree.closeAfter(err)
+	}
+	return tree, nil
+}
+
+// extractNetwork is a network in tree space.
+type extractNetwork struct {
+	ip    [16]byte
+	depth int
+	last  [16]byte
+}
+
+// extractNetworks returns prefixes in tree space, in address order, without
+// any network contained in another.
+func (t *Tree) extractNetworks(prefixes []netip.Prefix) ([]extractNetwork, error) {
+	networks := make([]extractNetwork, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		normalized, err := t.normalizeInsertPrefix(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("extracting %s: %w", prefix, err)
+		}
+		ip, depth := t.prefixInsertIP(normalized)
+		networks = append(networks, extractNetwork{
+			ip:    ip,
+			depth: depth,
+			last:  lastTreeAddr(ip, depth, t.treeDepth),
+		})
+	}
+	slices.SortFunc(networks, func(a, b extractNetwork) int {
+		return cmp.Or(bytes.Compare(a.ip[:], b.ip[:]), cmp.Compare(a.depth, b.depth))
+	})
+	// Sorted by address and then by length, a network contained in another
+	// follows it before any network that does not.
+	kept := networks[:0]
+	for _, network := range networks {
+		if len(kept) != 0 && bytes.Compare(network.ip[:], kept[len(kept)-1].last[:]) <= 0 {
+			continue
+		}
+		kept = append(kept, network)
+	}
+	return kept, nil
+}
+
+// extractInto inserts into b the intersection of the tree's data records with
+// networks. Both are in address order, and two networks either nest or are
+// disjoint, so each intersection is the longer of the two.
+func (t *Tree) extractInto(b *BulkBuilder, networks []extractNetwork) error {
+	target := b.tree
+	values := map[valueRef]valueRef{}
+	provenance := map[nodeIndex]nodeIndex{}
+	defer func() {
+		for _, ref := range values {
+			target.valueStore.release(ref)
+		}
+	}()
+
+	insert := func(ip [16]byte, depth int, record dataRecord) error {
+		prefix, err := prefixFromInsertIP(ip, depth, t.treeDepth)
+		if err != nil {
+			return err
+		}
+		normalized, err := target.normalizeInsertPrefix(prefix)
+		if err != nil {
+			return fmt.Errorf("extracting %s: %w", prefix, err)
+		}
+		ref, err := target.valueStore.internFrom(t.valueStore, record.value, values)
+		if err != nil {
+			return err
+		}
+		// values holds a reference, so the one internFrom returned can go.
+		target.valueStore.release(ref)
+
+		recordProvenance := noNodeIndex
+		switch {
+		case !target.trackProvenance:
+		case t.trackProvenance && record.provenance != noNodeIndex:
+			var ok bool
+			recordProvenance, ok = provenance[record.provenance]
+			if !ok {
+				recordProvenance = target.newProvenance(t.provenance[record.provenance])
+				provenance[record.provenance] = recordProvenance
+			}
+		default:
+			recordProvenance = target.insertProvenance(normalized)
+		}
+		return b.insertRef(normalized, ref, recordProvenance)
+	}
+
+	for record := range t.dataRecords() {
+		if len(networks) == 0 {
+			break
+		}
+		last := lastTreeAddr(record.ip, record.depth, t.treeDepth)
+		for len(networks) != 0 && bytes.Compare(networks[0].last[:], record.ip[:]) < 0 {
+			networks = networks[1:]
+		}
+		for len(networks) != 0 && bytes.Compare(networks[0].ip[:], last[:]) <= 0 {
+			network := networks[0]
+			if network.depth <= record.depth {
+				// The network contains the record, and may contain the
+				// records after it too.
+				if err := insert(record.ip, record.depth, record); err != nil {
+					return err
+				}
+				break
+			}
+			if err := insert(network.ip, network.depth, record); err != nil {
+				return err
+			}
+			networks = networks[1:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package mmdbwriter
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/maxmind/mmdbwriter/v2/mmdbtype"
+)
+
+// TestExtractMatchesInsert pins that Extract builds the same tree as inserting
+// the intersection of every data record with every prefix into a Tree from
+// New.
+func TestExtractMatchesInsert(t *testing.T) {
+	tests := []struct {
+		name   string
+		source Options
+		target Options
+		// ipv4Only limits the extracted prefixes to IPv4 networks.
+		ipv4Only bool
+	}{
+		{
+			name:   "IPv6",
+			source: Options{IPVersion: 6},
+			target: Options{IPVersion: 6},
+		},
+		{
+			name:     "IPv6 to IPv4",
+			source:   Options{IPVersion: 6},
+			target:   Options{IPVersion: 4, RecordSize: 32},
+			ipv4Only: true,
+		},
+		{
+			name:   "IPv4 to IPv6",
+			source: Options{IPVersion: 4},
+			target: Options{IPVersion: 6, DisableIPv4Aliasing: true},
+		},
+		{
+			name:   "reserved networks skipped",
+			source: Options{IPVersion: 6, IncludeReservedNetworks: true},
+			target: Options{IPVersion: 6, ConflictPolicy: ConflictSkip},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for seed := range uint64(5) {
+				source, err := New(test.source)
+				require.NoError(t, err)
+				for _, spec := range randomInsertSpecs(t, source, seed, true) {
+					require.NoError(t, source.Insert(spec.network, spec.value))
+				}
+				var prefixes []netip.Prefix
+				for _, spec := range randomInsertSpecs(t, source, seed+100, true)[:30] {
+					if test.ipv4Only && !spec.network.Addr().Is4() {
+						continue
+					}
+					prefixes = append(prefixes, spec.network)
+				}
+
+				test.target.BuildEpoch = 1
+				test.target.DatabaseType = "extract-test"
+				test.target.Description = map[string]string{"en": "Extract test"}
+				test.target.RefcountAudit = true
+				expected, err := New(test.target)
+				require.NoError(t, err)
+				for record := range source.dataRecords() {
+					for _, prefix := range prefixes {
+						ip, depth := source.prefixInsertIP(prefix)
+						switch {
+						case depth <= record.depth && prefixBitsEqual(ip, record.ip, depth):
+							ip, depth = record.ip, record.depth
+						case record.depth <= depth && prefixBitsEqual(ip, record.ip, record.depth):
+						default:
+							continue
+						}
+						network, err := prefixFromInsertIP(ip, depth, source.treeDepth)
+						require.NoError(t, err)
+						value := source.valueStore.materialize(record.value)
+						require.NoError(t, expected.Insert(network, value))
+					}
+				}
+
+				extracted, err := source.Extract(prefixes, test.target)
+				require.NoError(t, err)
+				require.Equal(t, writeTreeBytes(t, expected), writeTreeBytes(t, extracted), "seed %d", seed)
+				if seed == 0 {
+					checkWrittenTree(t, extracted)
+				}
+			}
+		})
+	}
+}
+
+// TestExtractKeepsProvenance pins that extracted records keep the provenance
+// of the records they were cut from.
+func TestExtractKeepsProvenance(t *testing.T) {
+	source, err := New(Options{TrackProvenance: true})
+	require.NoError(t, err)
+	source.SetProvenanceSource("feed")
+	require.NoError(t, source.Insert(netip.MustParsePrefix("2600::/16"), mmdbtype.String("a")))
+
+	extracted, err := source.Extract(
+		[]netip.Prefix{netip.MustParsePrefix("2600:1::/32")},
+		Options{TrackProvenance: true},
+	)
+	require.NoError(t, err)
+	network, provenance, ok := extracted.Provenance(netip.MustParseAddr("2600:1::1"))
+	require.True(t, ok)
+	assert.Equal(t, netip.MustParsePrefix("2600:1::/32"), network)
+	assert.Equal(t, netip.MustParsePrefix("2600::/16"), provenance.Network)
+	assert.Equal(t, "feed", provenance.Source)
+
+	_, value := extracted.Get(netip.MustParseAddr("2600:2::1"))
+	assert.Nil(t, value)
+}
+
+// TestExtractErrors pins that Extract reports prefixes this tree cannot hold
+// and data the target cannot hold, without returning a Tree.
+func TestExtractErrors(t *testing.T) {
+	source, err := New(Options{IPVersion: 4, IncludeReservedNetworks: true})
+	require.NoError(t, err)
+	require.NoError(t, source.Insert(netip.MustParsePrefix("10.0.0.0/8"), mmdbtype.String("a")))
+
+	_, err = source.Extract([]netip.Prefix{netip.MustParsePrefix("2600::/16")}, Options{})
+	require.EqualError(t, err,
+		"extracting 2600::/16: IPv6 prefixes cannot be inserted into an IPv4 tree")
+
+	tree, err := source.Extract([]netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}, Options{})
+	require.EqualError(t, err,
+		"attempt to insert 10.1.0.0/16 into 10.0.0.0/8, which is a reserved network")
+	assert.Nil(t, tree)
+}
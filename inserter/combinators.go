@@ -0,0 +1,152 @@
+package inserter
+
+import (
+	"fmt"
+
+	"github.com/maxmind/mmdbwriter/v2/mmdbtype"
+)
+
+// The combinators below build an inserter from others. Chain, When, and
+// ByExistingType take and return PureFunc values, so a policy composed only of
+// pure parts is itself pure and stays memoizable by
+// mmdbwriter.Tree.InsertPureFunc. A policy that needs metadata uses ChainFunc
+// and WhenFunc, wrapping its pure parts with IgnoreMetadata. A Func is never
+// memoized, so that policy gives up memoization for the whole insert.
+
+// Predicate reports whether an inserter applies to an insertion. Like a
+// PureFunc, its result must depend only on its arguments, and it must not
+// modify them.
+type Predicate func(existingValue, newValue mmdbtype.DataType) bool
+
+// FuncPredicate is a Predicate that also receives the insertion metadata.
+type FuncPredicate func(existingValue, newValue mmdbtype.DataType, metadata Metadata) bool
+
+// Chain returns an inserter that applies fns in order. Each function receives
+// the previous function's result as its existing value and the inserted value
+// as its new value. An error stops the chain. Chain with no functions keeps the
+// existing value.
+func Chain(fns ...PureFunc) PureFunc {
+	fns = append([]PureFunc(nil), fns...)
+	return func(existingValue, newValue mmdbtype.DataType) (mmdbtype.DataType, error) {
+		value := existingValue
+		for i, fn := range fns {
+			var err error
+			value, err = fn(value, newValue)
+			if err != nil {
+				return nil, fmt.Errorf("chain step %d: %w", i, err)
+			}
+		}
+		return value, nil
+	}
+}
+
+// ChainFunc is like Chain for Func values. Every function receives the same
+// metadata, which describes the record as it stood before the first one ran.
+func ChainFunc(fns ...Func) Func {
+	fns = append([]Func(nil), fns...)
+	return func(
+		existingValue,
+		newValue mmdbtype.DataType,
+		metadata Metadata,
+	) (mmdbtype.DataType, error) {
+		value := existingValue
+		for i, fn := range fns {
+			var err error
+			value, err = fn(value, newValue, metadata)
+			if err != nil {
+				return nil, fmt.Errorf("chain step %d: %w", i, err)
+			}
+		}
+		return value, nil
+	}
+}
+
+// When returns an inserter that applies fn when predicate reports true and
+// keeps the existing value otherwise.
+func When(predicate Predicate, fn PureFunc) PureFunc {
+	return func(existingValue, newValue mmdbtype.DataType) (mmdbtype.DataType, error) {
+		if !predicate(existingValue, newValue) {
+			return existingValue, nil
+		}
+		return fn(existingValue, newValue)
+	}
+}
+
+// WhenFunc is like When for Func values.
+func WhenFunc(predicate FuncPredicate, fn Func) Func {
+	return func(
+		existingValue,
+		newValue mmdbtype.DataType,
+		metadata Metadata,
+	) (mmdbtype.DataType, error) {
+		if !predicate(existingValue, newValue, metadata) {
+			return existingValue, nil
+		}
+		return fn(existingValue, newValue, metadata)
+	}
+}
+
+// TypeDispatch selects the inserter ByExistingType applies for each kind of
+// existing value. A nil field falls back to Default, and a nil Default to
+// Replace.
+type TypeDispatch struct {
+	// Empty applies to an empty record.
+	Empty PureFunc
+	// Map applies to an existing Map.
+	Map PureFunc
+	// Slice applies to an existing Slice.
+	Slice PureFunc
+	// Default applies to any other existing value and to kinds whose field is
+	// nil.
+	Default PureFunc
+}
+
+// ByExistingType returns an inserter that applies the TypeDispatch field
+// matching the existing value. For example, merging into Maps while replacing
+// everything else is
+//
+//	ByExistingType(TypeDispatch{Map: DeepMerge})
+func ByExistingType(dispatch TypeDispatch) PureFunc {
+	fallback := dispatch.Default
+	if fallback == nil {
+		fallback = Replace
+	}
+	orDefault := func(fn PureFunc) PureFunc {
+		if fn == nil {
+			return fallback
+		}
+		return fn
+	}
+	empty := orDefault(dispatch.Empty)
+	mapFn := orDefault(dispatch.Map)
+	sliceFn := orDefault(dispatch.Slice)
+
+	return func(existingValue, newValue mmdbtype.DataType) (mmdbtype.DataType, error) {
+		switch existingValue.(type) {
+		case nil:
+			return empty(existingValue, newValue)
+		case mmdbtype.Map:
+			return mapFn(existingValue, newValue)
+		case mmdbtype.Slice:
+			return sliceFn(existingValue, newValue)
+		default:
+			return fallback(existingValue, newValue)
+		}
+	}
+}
+
+// IgnoreMetadata adapts a PureFunc to a Func that discards the metadata, for
+// use with ChainFunc and WhenFunc.
+func IgnoreMetadata(fn PureFunc) Func {
+	return func(existingValue, newValue mmdbtype.DataType, _ Metadata) (mmdbtype.DataType, error) {
+		return fn(existingValue, newValue)
+	}
+}
+
+// IgnoreMetadataPredicate adapts a Predicate to a FuncPredicate that discards
+// the metadata.
+func IgnoreMetadataPredicate(predicate Predicate) FuncPredicate {
+	return func(existingValue, newValue mmdbtype.DataType, _ Metadata) bool {
+		return predicate(existingValue, newValue)
+	}
+}
@@ -0,0 +1,138 @@
+package inserter
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/maxmind/mmdbwriter/v2/mmdbtype"
+)
+
+func TestChain(t *testing.T) {
+	chain := Chain(
+		SetPath([]string{"a"}),
+		IncrementPath([]string{"count"}),
+	)
+	v, err := chain(mmdbtype.Map{"count": mmdbtype.Uint32(1)}, mmdbtype.Uint32(2))
+	require.NoError(t, err)
+	assert.Equal(t, mmdbtype.Map{
+		"a":     mmdbtype.Uint32(2),
+		"count": mmdbtype.Uint32(3),
+	}, v)
+
+	v, err = Chain()(mmdbtype.String("existing"), mmdbtype.String("new"))
+	require.NoError(t, err)
+	assert.Equal(t, mmdbtype.String("existing"), v)
+
+	errFail := errors.New("fail")
+	_, err = Chain(Replace, func(_, _ mmdbtype.DataType) (mmdbtype.DataType, error) {
+		return nil, errFail
+	})(nil, mmdbtype.String("new"))
+	require.ErrorIs(t, err, errFail)
+	require.EqualError(t, err, "chain step 1: fail")
+}
+
+func TestChainFunc(t *testing.T) {
+	var depths []int
+	recordDepth := func(
+		existingValue, _ mmdbtype.DataType,
+		metadata Metadata,
+	) (mmdbtype.DataType, error) {
+		depths = append(depths, metadata.InsertedDepth())
+		return existingValue, nil
+	}
+	metadata := Metadata{
+		InsertedNetwork: netip.MustParsePrefix("1.0.0.0/24"),
+		TreeDepth:       32,
+	}
+
+	v, err := ChainFunc(IgnoreMetadata(Replace), recordDepth, recordDepth)(
+		mmdbtype.String("existing"),
+		mmdbtype.String("new"),
+		metadata,
+	)
+	require.NoError(t, err)
+	assert.Equal(t, mmdbtype.String("new"), v)
+	assert.Equal(t, []int{24, 24}, depths)
+}
+
+func TestWhen(t *testing.T) {
+	onlyMaps := When(
+		func(existingValue, _ mmdbtype.DataType) bool {
+			_, ok := existingValue.(mmdbtype.Map)
+			return ok
+		},
+		Replace,
+	)
+	v, err := onlyMaps(mmdbtype.Map{}, mmdbtype.String("new"))
+	require.NoError(t, err)
+	assert.Equal(t, mmdbtype.String("new"), v)
+
+	v, err = onlyMaps(mmdbtype.String("existing"), mmdbtype.String("new"))
+	require.NoError(t, err)
+	assert.Equal(t, mmdbtype.String("existing"), v)
+}
+
+func TestWhenFunc(t *testing.T) {
+	narrow := WhenFunc(
+		func(_, _ mmdbtype.DataType, metadata Metadata) bool {
+			return metadata.InsertedDepth() >= 24
+		},
+		IgnoreMetadata(Replace),
+	)
+	metadata := func(prefix string) Metadata {
+		return Metadata{InsertedNetwork: netip.MustParsePrefix(prefix), TreeDepth: 32}
+	}
+
+	v, err := narrow(mmdbtype.String("existing"), mmdbtype.String("new"), metadata("1.0.0.0/24"))
+	require.NoError(t, err)
+	assert.Equal(t, mmdbtype.String("new"), v)
+
+	v, err = narrow(mmdbtype.String("existing"), mmdbtype.String("new"), metadata("1.0.0.0/16"))
+	require.NoError(t, err)
+	assert.Equal(t, mmdbtype.String("existing"), v)
+
+	always := IgnoreMetadataPredicate(func(_, _ mmdbtype.DataType) bool { return true })
+	assert.True(t, always(nil, nil, Metadata{}))
+}
+
+func TestByExistingType(t *testing.T) {
+	dispatch := ByExistingType(TypeDispatch{
+		Empty: Remove,
+		Map:   TopLevelMerge,
+		Slice: KeepExisting,
+	})
+	newValue := mmdbtype.Map{"b": mmdbtype.Bool(true)}
+
+	tests := []struct {
+		description string
+		existing    mmdbtype.DataType
+		expected    mmdbtype.DataType
+	}{
+		{"empty", nil, nil},
+		{
+			"map",
+			mmdbtype.Map{"a": mmdbtype.Bool(true)},
+			mmdbtype.Map{"a": mmdbtype.Bool(true), "b": mmdbtype.Bool(true)},
+		},
+		{"slice", mmdbtype.Slice{mmdbtype.Bool(true)}, mmdbtype.Slice{mmdbtype.Bool(true)}},
+		{"default replaces", mmdbtype.String("a"), newValue},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			v, err := dispatch(test.existing, newValue)
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, v)
+		})
+	}
+
+	v, err := ByExistingType(TypeDispatch{Default: KeepExisting})(
+		mmdbtype.Map{},
+		mmdbtype.String("new"),
+	)
+	require.NoError(t, err)
+	assert.Equal(t, mmdbtype.Map{}, v)
+}
@@ -0,0 +1,321 @@
+package inserter
+
+import (
+	"fmt"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/maxmind/mmdbwriter/v2/mmdbtype"
+)
+
+// SliceStrategy selects how a deep merge combines an existing Slice with a
+// new Slice.
+type SliceStrategy int
+
+const (
+	// SliceMergeByIndex merges the elements at each index recursively and
+	// keeps the tail of the longer slice. This is what DeepMerge does.
+	SliceMergeByIndex SliceStrategy = iota
+	// SliceReplace replaces the existing slice with the new one.
+	SliceReplace
+	// SliceAppend appends the new elements to the existing ones.
+	SliceAppend
+	// SliceUnion appends the new elements that are not Equal to an existing
+	// element or to an earlier new element. The existing elements are kept as
+	// they are, including any duplicates among them.
+	SliceUnion
+)
+
+// String returns the name of the strategy.
+func (s SliceStrategy) String() string {
+	switch s {
+	case SliceMergeByIndex:
+		return "SliceMergeByIndex"
+	case SliceReplace:
+		return "SliceReplace"
+	case SliceAppend:
+		return "SliceAppend"
+	case SliceUnion:
+		return "SliceUnion"
+	default:
+		return fmt.Sprintf("SliceStrategy(%d)", int(s))
+	}
+}
+
+// DeepMergeOptions configures the inserter returned by NewDeepMerge. The zero
+// value merges exactly as DeepMerge does.
+type DeepMergeOptions struct {
+	// Slices is the strategy for slices without a matching override.
+	Slices SliceStrategy
+
+	// SliceOverrides sets the strategy for the slices at specific key paths.
+	SliceOverrides []SliceOverride
+
+	// ErrorOnTypeConflict makes the merge return a *TypeConflictError when an
+	// existing value would be replaced by a non-nil value of a different type,
+	// such as a String by a Uint32 or a Map by a String. With several
+	// conflicts, it reports the first with Map keys in sorted order. By
+	// default, the new value replaces the existing one.
+	ErrorOnTypeConflict bool
+}
+
+// SliceOverride sets the slice strategy for one key path.
+type SliceOverride struct {
+	// Path lists the Map keys leading from the top-level value to the slice,
+	// such as {"traits", "tags"}. Slice elements do not add a path component,
+	// so a Map inside an index-merged slice continues the slice's path. An
+	// empty Path matches a top-level slice.
+	Path []string
+
+	// Strategy is the strategy for slices at Path.
+	Strategy SliceStrategy
+}
+
+// TypeConflictError is returned by an inserter from NewDeepMerge, when
+// configured with ErrorOnTypeConflict, for a value that would change type.
+type TypeConflictError struct {
+	// Path lists the Map keys leading to the conflicting value, as
+	// SliceOverride.Path does.
+	Path []string
+
+	// Existing and New are the conflicting values.
+	Existing mmdbtype.DataType
+	New      mmdbtype.DataType
+}
+
+func (e *TypeConflictError) Error() string {
+	return fmt.Sprintf(
+		"deep merge would replace a %T with a %T at %q",
+		e.Existing,
+		e.New,
+		strings.Join(e.Path, "."),
+	)
+}
+
+// NewDeepMerge returns a DeepMerge inserter configured by opts. It returns an
+// error for an unknown SliceStrategy or for two overrides of one path.
+//
+// The returned function is pure, so it is safe to pass to
+// mmdbwriter.Tree.InsertPureFunc. Like DeepMerge, its result may share
+// unchanged containers with the existing value and must be treated as
+// immutable.
+func NewDeepMerge(opts DeepMergeOptions) (PureFunc, error) {
+	if err := validateSliceStrategy(opts.Slices); err != nil {
+		return nil, err
+	}
+	m := deepMerger{
+		slices:              opts.Slices,
+		errorOnTypeConflict: opts.ErrorOnTypeConflict,
+	}
+	for _, override := range opts.SliceOverrides {
+		if err := validateSliceStrategy(override.Strategy); err != nil {
+			return nil, fmt.Errorf("override for %q: %w", strings.Join(override.Path, "."), err)
+		}
+		if m.overrides == nil {
+			m.overrides = &overrideNode{}
+		}
+		node := m.overrides
+		for _, key := range override.Path {
+			child, ok := node.children[key]
+			if !ok {
+				child = &overrideNode{}
+				if node.children == nil {
+					node.children = map[string]*overrideNode{}
+				}
+				node.children[key] = child
+			}
+			node = child
+		}
+		if node.set {
+			return nil, fmt.Errorf("duplicate override for %q", strings.Join(override.Path, "."))
+		}
+		node.set = true
+		node.strategy = override.Strategy
+	}
+
+	return func(existingValue, newValue mmdbtype.DataType) (mmdbtype.DataType, error) {
+		value, _, err := m.merge(existingValue, newValue, m.overrides, nil)
+		return value, err
+	}, nil
+}
+
+func validateSliceStrategy(s SliceStrategy) error {
+	if s < SliceMergeByIndex || s > SliceUnion {
+		return fmt.Errorf("unsupported SliceStrategy: %d", int(s))
+	}
+	return nil
+}
+
+// overrideNode is one Map key of the override paths. node.set reports whether
+// a SliceOverride ends at it.
+type overrideNode struct {
+	children map[string]*overrideNode
+	strategy SliceStrategy
+	set      bool
+}
+
+func (n *overrideNode) child(key string) *overrideNode {
+	if n == nil {
+		return nil
+	}
+	return n.children[key]
+}
+
+type deepMerger struct {
+	overrides           *overrideNode
+	slices              SliceStrategy
+	errorOnTypeConflict bool
+}
+
+// merge returns the merged value and whether it differs from existingValue.
+// node is the override node for path, or nil. path is only read to build
+// errors.
+func (m deepMerger) merge(
+	existingValue,
+	newValue mmdbtype.DataType,
+	node *overrideNode,
+	path []string,
+) (mmdbtype.DataType, bool, error) {
+	if existingValue == nil {
+		return newValue, newValue != nil, nil
+	}
+	if newValue == nil {
+		return existingValue, false, nil
+	}
+	if m.errorOnTypeConflict && reflect.TypeOf(existingValue) != reflect.TypeOf(newValue) {
+		return nil, false, &TypeConflictError{
+			Path:     slices.Clone(path),
+			Existing: existingValue,
+			New:      newValue,
+		}
+	}
+	switch existingValue := existingValue.(type) {
+	case mmdbtype.Map:
+		newMap, ok := newValue.(mmdbtype.Map)
+		if !ok {
+			// The new value is not a map. Overwrite the existing value
+			return newValue, true, nil
+		}
+
+		// With errorOnTypeConflict, the first conflict in key order is the
+		// one reported, so the error does not depend on map iteration order.
+		keys := maps.Keys(newMap)
+		if m.errorOnTypeConflict {
+			keys = slices.Values(slices.Sorted(keys))
+		}
+		var returnMap mmdbtype.Map
+		for k := range keys {
+			v := newMap[k]
+			existingChild, exists := existingValue[k]
+			nv, changed, err := m.merge(existingChild, v, node.child(string(k)), append(path, string(k)))
+			if err != nil {
+				return nil, false, err
+			}
+			if exists && !changed {
+				continue
+			}
+			if returnMap == nil {
+				returnMap = make(mmdbtype.Map, len(existingValue)+len(newMap))
+				maps.Copy(returnMap, existingValue)
+			}
+			returnMap[k] = nv
+		}
+		if returnMap == nil {
+			return existingValue, false, nil
+		}
+		return returnMap, true, nil
+	case mmdbtype.Slice:
+		newSlice, ok := newValue.(mmdbtype.Slice)
+		if !ok {
+			return newValue, true, nil
+		}
+		strategy := m.slices
+		if node != nil && node.set {
+			strategy = node.strategy
+		}
+		switch strategy {
+		case SliceReplace:
+			if existingValue.Equal(newSlice) {
+				return existingValue, false, nil
+			}
+			return newSlice, true, nil
+		case SliceAppend:
+			if len(newSlice) == 0 {
+				return existingValue, false, nil
+			}
+			return slices.Concat(existingValue, newSlice), true, nil
+		case SliceUnion:
+			return sliceUnion(existingValue, newSlice)
+		default:
+			return m.mergeSliceByIndex(existingValue, newSlice, node, path)
+		}
+	default:
+		if existingValue.Equal(newValue) {
+			return existingValue, false, nil
+		}
+		return newValue, true, nil
+	}
+}
+
+func (m deepMerger) mergeSliceByIndex(
+	existingValue,
+	newSlice mmdbtype.Slice,
+	node *overrideNode,
+	path []string,
+) (mmdbtype.DataType, bool, error) {
+	length := max(len(newSlice), len(existingValue))
+
+	var rv mmdbtype.Slice
+	for i := range length {
+		var ev, nv mmdbtype.DataType
+		if i < len(existingValue) {
+			ev = existingValue[i]
+		}
+		if i < len(newSlice) {
+			nv = newSlice[i]
+		}
+		merged, changed, err := m.merge(ev, nv, node, path)
+		if err != nil {
+			return nil, false, err
+		}
+		if i < len(existingValue) && !changed {
+			continue
+		}
+		if rv == nil {
+			rv = make(mmdbtype.Slice, length)
+			// Restore skipped existing indices; new tail indices are
+			// assigned below, so the result cannot contain accidental holes.
+			copy(rv, existingValue)
+		}
+		rv[i] = merged
+	}
+	if rv == nil {
+		return existingValue, false, nil
+	}
+	return rv, true, nil
+}
+
+func sliceUnion(existingValue, newSlice mmdbtype.Slice) (mmdbtype.DataType, bool, error) {
+	var rv mmdbtype.Slice
+	for _, v := range newSlice {
+		if v == nil || containsEqual(existingValue, v) || containsEqual(rv, v) {
+			continue
+		}
+		if rv == nil {
+			rv = slices.Clone(existingValue)
+		}
+		rv = append(rv, v)
+	}
+	if rv == nil {
+		return existingValue, false, nil
+	}
+	return rv, true, nil
+}
+
+func containsEqual(values mmdbtype.Slice, v mmdbtype.DataType) bool {
+	return slices.ContainsFunc(values, func(e mmdbtype.DataType) bool {
+		return e != nil && e.Equal(v)
+	})
+}
@@ -0,0 +1,196 @@
+package inserter
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/maxmind/mmdbwriter/v2/mmdbtype"
+)
+
+func TestNewDeepMergeSliceStrategies(t *testing.T) {
+	existing := mmdbtype.Map{
+		"tags": mmdbtype.Slice{mmdbtype.String("a"), mmdbtype.String("b")},
+	}
+	newValue := mmdbtype.Map{
+		"tags": mmdbtype.Slice{mmdbtype.String("b"), mmdbtype.String("c"), mmdbtype.String("c")},
+	}
+
+	tests := []struct {
+		strategy SliceStrategy
+		expected mmdbtype.Slice
+	}{
+		{
+			strategy: SliceMergeByIndex,
+			expected: mmdbtype.Slice{mmdbtype.String("b"), mmdbtype.String("c"), mmdbtype.String("c")},
+		},
+		{
+			strategy: SliceReplace,
+			expected: mmdbtype.Slice{mmdbtype.String("b"), mmdbtype.String("c"), mmdbtype.String("c")},
+		},
+		{
+			strategy: SliceAppend,
+			expected: mmdbtype.Slice{
+				mmdbtype.String("a"),
+				mmdbtype.String("b"),
+				mmdbtype.String("b"),
+				mmdbtype.String("c"),
+				mmdbtype.String("c"),
+			},
+		},
+		{
+			strategy: SliceUnion,
+			expected: mmdbtype.Slice{mmdbtype.String("a"), mmdbtype.String("b"), mmdbtype.String("c")},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.strategy.String(), func(t *testing.T) {
+			merge, err := NewDeepMerge(DeepMergeOptions{Slices: test.strategy})
+			require.NoError(t, err)
+			v, err := merge(existing, newValue)
+			require.NoError(t, err)
+			assert.Equal(t, mmdbtype.Map{"tags": test.expected}, v)
+			assert.Equal(t, mmdbtype.Slice{mmdbtype.String("a"), mmdbtype.String("b")}, existing["tags"])
+		})
+	}
+}
+
+func TestNewDeepMergeReturnsExistingWhenUnchanged(t *testing.T) {
+	tests := []struct {
+		strategy SliceStrategy
+		newSlice mmdbtype.Slice
+	}{
+		{SliceReplace, mmdbtype.Slice{mmdbtype.Uint32(1), mmdbtype.Uint32(2)}},
+		{SliceAppend, mmdbtype.Slice{}},
+		{SliceUnion, mmdbtype.Slice{mmdbtype.Uint32(2), mmdbtype.Uint32(1)}},
+	}
+	for _, test := range tests {
+		t.Run(test.strategy.String(), func(t *testing.T) {
+			merge, err := NewDeepMerge(DeepMergeOptions{Slices: test.strategy})
+			require.NoError(t, err)
+
+			existing := mmdbtype.Map{
+				"asns": mmdbtype.Slice{mmdbtype.Uint32(1), mmdbtype.Uint32(2)},
+			}
+			merged, err := merge(existing, mmdbtype.Map{"asns": test.newSlice})
+			require.NoError(t, err)
+			assert.Equal(t,
+				reflect.ValueOf(existing).Pointer(),
+				reflect.ValueOf(merged.(mmdbtype.Map)).Pointer(),
+			)
+		})
+	}
+}
+
+func TestNewDeepMergeOverrides(t *testing.T) {
+	merge, err := NewDeepMerge(DeepMergeOptions{
+		Slices: SliceReplace,
+		SliceOverrides: []SliceOverride{
+			{Path: []string{"traits", "tags"}, Strategy: SliceUnion},
+			{Path: []string{"networks"}, Strategy: SliceMergeByIndex},
+			{Path: []string{"networks", "asns"}, Strategy: SliceAppend},
+		},
+	})
+	require.NoError(t, err)
+
+	existing := mmdbtype.Map{
+		"traits": mmdbtype.Map{
+			"tags":  mmdbtype.Slice{mmdbtype.String("a")},
+			"other": mmdbtype.Slice{mmdbtype.String("a")},
+		},
+		"networks": mmdbtype.Slice{
+			mmdbtype.Map{"asns": mmdbtype.Slice{mmdbtype.Uint32(1)}},
+		},
+	}
+	newValue := mmdbtype.Map{
+		"traits": mmdbtype.Map{
+			"tags":  mmdbtype.Slice{mmdbtype.String("a"), mmdbtype.String("b")},
+			"other": mmdbtype.Slice{mmdbtype.String("b")},
+		},
+		"networks": mmdbtype.Slice{
+			mmdbtype.Map{"asns": mmdbtype.Slice{mmdbtype.Uint32(2)}},
+		},
+	}
+	v, err := merge(existing, newValue)
+	require.NoError(t, err)
+	assert.Equal(t, mmdbtype.Map{
+		"traits": mmdbtype.Map{
+			"tags":  mmdbtype.Slice{mmdbtype.String("a"), mmdbtype.String("b")},
+			"other": mmdbtype.Slice{mmdbtype.String("b")},
+		},
+		"networks": mmdbtype.Slice{
+			mmdbtype.Map{"asns": mmdbtype.Slice{mmdbtype.Uint32(1), mmdbtype.Uint32(2)}},
+		},
+	}, v)
+}
+
+func TestNewDeepMergeTypeConflict(t *testing.T) {
+	merge, err := NewDeepMerge(DeepMergeOptions{ErrorOnTypeConflict: true})
+	require.NoError(t, err)
+
+	existing := mmdbtype.Map{"traits": mmdbtype.Map{"asn": mmdbtype.Uint32(1)}}
+	_, err = merge(existing, mmdbtype.Map{"traits": mmdbtype.Map{"asn": mmdbtype.String("1")}})
+	var conflictErr *TypeConflictError
+	require.ErrorAs(t, err, &conflictErr)
+	assert.Equal(t, []string{"traits", "asn"}, conflictErr.Path)
+	assert.Equal(t, mmdbtype.Uint32(1), conflictErr.Existing)
+	assert.Equal(t, mmdbtype.String("1"), conflictErr.New)
+	assert.EqualError(
+		t,
+		err,
+		`deep merge would replace a mmdbtype.Uint32 with a mmdbtype.String at "traits.asn"`,
+	)
+
+	_, err = merge(existing, mmdbtype.Map{"traits": mmdbtype.String("x")})
+	require.ErrorAs(t, err, &conflictErr)
+
+	v, err := merge(existing, mmdbtype.Map{"traits": mmdbtype.Map{"asn": mmdbtype.Uint32(2)}})
+	require.NoError(t, err)
+	assert.Equal(t, mmdbtype.Map{"traits": mmdbtype.Map{"asn": mmdbtype.Uint32(2)}}, v)
+
+	merge, err = NewDeepMerge(DeepMergeOptions{})
+	require.NoError(t, err)
+	v, err = merge(existing, mmdbtype.Map{"traits": mmdbtype.String("x")})
+	require.NoError(t, err)
+	assert.Equal(t, mmdbtype.Map{"traits": mmdbtype.String("x")}, v)
+}
+
+// TestNewDeepMergeTypeConflictKeyOrder pins that with several conflicting
+// keys, the error reports the first in key order, whatever the map order.
+func TestNewDeepMergeTypeConflictKeyOrder(t *testing.T) {
+	merge, err := NewDeepMerge(DeepMergeOptions{ErrorOnTypeConflict: true})
+	require.NoError(t, err)
+
+	existing := mmdbtype.Map{
+		"traits": mmdbtype.Map{"asn": mmdbtype.Uint32(1), "domain": mmdbtype.String("a")},
+	}
+	newValue := mmdbtype.Map{
+		"traits": mmdbtype.Map{"asn": mmdbtype.String("1"), "domain": mmdbtype.Uint32(2)},
+	}
+	for range 20 {
+		_, err = merge(existing, newValue)
+		var conflictErr *TypeConflictError
+		require.ErrorAs(t, err, &conflictErr)
+		require.Equal(t, []string{"traits", "asn"}, conflictErr.Path)
+	}
+}
+
+func TestNewDeepMergeInvalidOptions(t *testing.T) {
+	_, err := NewDeepMerge(DeepMergeOptions{Slices: SliceUnion + 1})
+	require.EqualError(t, err, "unsupported SliceStrategy: 4")
+
+	_, err = NewDeepMerge(DeepMergeOptions{
+		SliceOverrides: []SliceOverride{{Path: []string{"a"}, Strategy: -1}},
+	})
+	require.EqualError(t, err, `override for "a": unsupported SliceStrategy: -1`)
+
+	_, err = NewDeepMerge(DeepMergeOptions{
+		SliceOverrides: []SliceOverride{
+			{Path: []string{"a", "b"}, Strategy: SliceAppend},
+			{Path: []string{"a", "b"}, Strategy: SliceUnion},
+		},
+	})
+	require.EqualError(t, err, `duplicate override for "a.b"`)
+}
@@ -1,10 +1,12 @@
 // Package inserter provides some common inserter functions for
 // mmdbwriter.Tree.
 //
-// Every function in this package is pure: its result and error depend only on
-// its arguments. They are all safe to pass to mmdbwriter.Tree.InsertPureFunc
-// and mmdbwriter.Tree.InsertRangePureFunc, which may memoize repeated argument
-// pairs and share a result across records.
+// Every function in this package that matches PureFunc is pure: its result and
+// error depend only on its arguments. They are all safe to pass to
+// mmdbwriter.Tree.InsertPureFunc and mmdbwriter.Tree.InsertRangePureFunc, which
+// may memoize repeated argument pairs and share a result across records. The
+// functions that match Func read the insertion metadata and must be passed to
+// mmdbwriter.Tree.InsertFunc or mmdbwriter.Tree.InsertRangeFunc instead.
 package inserter
 
 import (
@@ -18,9 +20,10 @@ import (
 
 // Metadata describes the insertion an inserter is resolving and the record it
 // is about to change. That record is what a Tree.Get for an address in it would
-// have returned just before the insertion. Metadata does not identify the
-// network that established an existing value, so a policy that needs that
-// provenance must store it in the value.
+// have returned just before the insertion. Metadata identifies the network that
+// established an existing value only when the tree was created with
+// Options.TrackProvenance. Without it, a policy that needs that provenance must
+// store it in the value.
 //
 // For a range insert, each decomposed prefix is a separate insertion, and
 // metadata for a later prefix reflects the changes earlier prefixes made.
@@ -84,6 +87,31 @@ type Metadata struct {
 	// TreeDepth is 32 for an IPv4 tree and 128 for an IPv6 tree. It is needed
 	// to interpret ExistingAddr's layout.
 	TreeDepth int
+
+	// ExistingProvenance identifies the insertion that established the
+	// existing value. It is the zero Provenance for an empty record or a tree
+	// created without Options.TrackProvenance.
+	ExistingProvenance Provenance
+}
+
+// Provenance identifies the insertion that established a record's value. A
+// tree records it only when created with Options.TrackProvenance. Provenance is
+// never written to the database.
+type Provenance struct {
+	// Network is the inserted network, normalized as Metadata.InsertedNetwork
+	// is. For a range insert, it is the individual prefix into which the range
+	// decomposed. For a loaded record, it is the network the source database
+	// returned.
+	Network netip.Prefix
+
+	// Source is the tag set with Tree.SetProvenanceSource when the insertion
+	// ran. It is empty if no tag was set.
+	Source string
+}
+
+// IsValid reports whether p identifies an insertion.
+func (p Provenance) IsValid() bool {
+	return p.Network.IsValid()
 }
 
 // InsertedDepth returns InsertedNetwork's depth in tree bits from the root,
@@ -144,6 +172,29 @@ func (m Metadata) ExistingNetwork() netip.Prefix {
 	return prefix
 }
 
+// EstablishedDepth returns the depth in tree bits of the network that
+// established the existing value, adding 96 for an IPv4 network in an IPv6
+// tree as InsertedDepth does. That is ExistingProvenance.Network's depth when
+// the tree tracks provenance. Otherwise it falls back to ExistingDepth, which
+// earlier insertions can make narrower than the establishing network.
+//
+// It returns 0 for an inconsistent Metadata.
+func (m Metadata) EstablishedDepth() int {
+	if !m.consistent() {
+		return 0
+	}
+	if !m.ExistingProvenance.IsValid() {
+		return m.ExistingDepth
+	}
+
+	network := m.ExistingProvenance.Network
+	depth := network.Bits()
+	if m.TreeDepth == 128 && network.Addr().Is4() {
+		depth += 96
+	}
+	return depth
+}
+
 // PureFunc resolves an insertion into a tree record without receiving insertion
 // metadata. existingValue is nil for an empty record, and newValue is the value
 // passed to the insert method or decoded during Load. Returning nil leaves the
@@ -200,6 +251,75 @@ func Replace(_, newValue mmdbtype.DataType) (mmdbtype.DataType, error) {
 	return newValue, nil
 }
 
+// KeepExisting is an inserter that inserts the new value only into empty
+// records. Records that already hold a value keep it, so an insert with
+// KeepExisting fills the gaps in the existing data.
+func KeepExisting(existingValue, newValue mmdbtype.DataType) (mmdbtype.DataType, error) {
+	if existingValue != nil {
+		return existingValue, nil
+	}
+	return newValue, nil
+}
+
+// OnlyIfExists returns an inserter that applies fn only to records that
+// already hold a value and leaves empty records empty, so an enrichment
+// overlay never creates records for space the existing data left empty. If fn
+// is nil, the new value replaces the existing one. For example,
+// OnlyIfExists(TopLevelMerge) merges the new Map into existing Maps only.
+//
+// The returned function is pure if fn is.
+func OnlyIfExists(fn PureFunc) PureFunc {
+	if fn == nil {
+		fn = Replace
+	}
+	return func(existingValue, newValue mmdbtype.DataType) (mmdbtype.DataType, error) {
+		if existingValue == nil {
+			return nil, nil
+		}
+		return fn(existingValue, newValue)
+	}
+}
+
+// MostSpecificWins is an inserter that keeps the value inserted for the most
+// specific network covering each address, whatever order the networks were
+// inserted in. It replaces an existing value established by a network no more
+// specific than the one being inserted, so equally specific inserts resolve to
+// the later one. A range insert competes as the prefixes it decomposes into.
+//
+// It compares InsertedDepth with EstablishedDepth, so the result is
+// order-independent only in a tree created with Options.TrackProvenance.
+// Without provenance, a record split by a more specific insert reports its
+// narrower fragment, and a later, less specific insert can lose to it.
+func MostSpecificWins(
+	existingValue,
+	newValue mmdbtype.DataType,
+	metadata Metadata,
+) (mmdbtype.DataType, error) {
+	if existingValue == nil || metadata.EstablishedDepth() <= metadata.InsertedDepth() {
+		return newValue, nil
+	}
+	return existingValue, nil
+}
+
+// LeastSpecificWins is an inserter that keeps the value inserted for the least
+// specific network covering each address, whatever order the networks were
+// inserted in. It replaces an existing value established by a network no less
+// specific than the one being inserted, so equally specific inserts resolve to
+// the later one. A range insert competes as the prefixes it decomposes into.
+//
+// Like MostSpecificWins, it is order-independent only in a tree created with
+// Options.TrackProvenance.
+func LeastSpecificWins(
+	existingValue,
+	newValue mmdbtype.DataType,
+	metadata Metadata,
+) (mmdbtype.DataType, error) {
+	if existingValue == nil || metadata.EstablishedDepth() >= metadata.InsertedDepth() {
+		return newValue, nil
+	}
+	return existingValue, nil
+}
+
 // TopLevelMerge is an inserter for Map values that will update an
 // existing Map by adding the top-level keys and values from the new Map,
 // replacing any existing values for the keys.
@@ -242,91 +362,13 @@ func TopLevelMerge(
 // merged recursively. Other values will be replaced by the new value. The
 // returned value may be the existing container or retain unchanged nested
 // containers from it. The result must therefore be treated as immutable.
+//
+// DeepMerge merges slices index by index. Use NewDeepMerge for other slice
+// strategies or to reject type changes.
 func DeepMerge(
 	existingValue,
 	newValue mmdbtype.DataType,
 ) (mmdbtype.DataType, error) {
-	value, _, err := deepMerge(existingValue, newValue)
+	value, _, err := deepMerger{}.merge(existingValue, newValue, nil, nil)
 	return value, err
 }
-
-func deepMerge(
-	existingValue,
-	newValue mmdbtype.DataType,
-) (mmdbtype.DataType, bool, error) {
-	if existingValue == nil {
-		return newValue, newValue != nil, nil
-	}
-	if newValue == nil {
-		return existingValue, false, nil
-	}
-	switch existingValue := existingValue.(type) {
-	case mmdbtype.Map:
-		newMap, ok := newValue.(mmdbtype.Map)
-		if !ok {
-			// The new value is not a map. Overwrite the existing value
-			return newValue, true, nil
-		}
-
-		var returnMap mmdbtype.Map
-		for k, v := range newMap {
-			existingChild, exists := existingValue[k]
-			nv, changed, err := deepMerge(existingChild, v)
-			if err != nil {
-				return nil, false, err
-			}
-			if exists && !changed {
-				continue
-			}
-			if returnMap == nil {
-				returnMap = make(mmdbtype.Map, len(existingValue)+len(newMap))
-				maps.Copy(returnMap, existingValue)
-			}
-			returnMap[k] = nv
-		}
-		if returnMap == nil {
-			return existingValue, false, nil
-		}
-		return returnMap, true, nil
-	case mmdbtype.Slice:
-		newSlice, ok := newValue.(mmdbtype.Slice)
-		if !ok {
-			return newValue, true, nil
-		}
-		length := max(len(newSlice), len(existingValue))
-
-		var rv mmdbtype.Slice
-		for i := range length {
-			var ev, nv mmdbtype.DataType
-			if i < len(existingValue) {
-				ev = existingValue[i]
-			}
-			if i < len(newSlice) {
-				nv = newSlice[i]
-			}
-			merged, changed, err := deepMerge(ev, nv)
-			if err != nil {
-				return nil, false, err
-			}
-			if i < len(existingValue) && !changed {
-				continue
-			}
-			if rv == nil {
-				rv = make(mmdbtype.Slice, length)
-				// Restore skipped existing indices; new tail indices are
-				// assigned below, so the result cannot contain accidental holes.
-				copy(rv, existingValue)
-			}
-			rv[i] = merged
-		}
-		if rv == nil {
-			return existingValue, false, nil
-		}
-		return rv, true, nil
-	default:
-		if existingValue.Equal(newValue) {
-			return existingValue, false, nil
-		}
-		return newValue, true, nil
-	}
-}
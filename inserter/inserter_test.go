@@ -2,6 +2,7 @@ package inserter
 
 import (
 	"fmt"
+	"net/netip"
 	"reflect"
 	"testing"
 
@@ -25,6 +26,154 @@ func TestReplace(t *testing.T) {
 	assert.Equal(t, mmdbtype.Uint64(1), v)
 }
 
+func TestKeepExisting(t *testing.T) {
+	v, err := KeepExisting(nil, mmdbtype.Uint64(1))
+	require.NoError(t, err)
+	assert.Equal(t, mmdbtype.Uint64(1), v)
+
+	v, err = KeepExisting(mmdbtype.Bool(true), mmdbtype.Uint64(1))
+	require.NoError(t, err)
+	assert.Equal(t, mmdbtype.Bool(true), v)
+}
+
+func TestOnlyIfExists(t *testing.T) {
+	tests := []struct {
+		description string
+		fn          PureFunc
+		existing    mmdbtype.DataType
+		expected    mmdbtype.DataType
+	}{
+		{
+			description: "empty record stays empty",
+			fn:          TopLevelMerge,
+			expected:    nil,
+		},
+		{
+			description: "nil fn replaces",
+			existing:    mmdbtype.Map{"a": mmdbtype.String("a")},
+			expected:    mmdbtype.Map{"b": mmdbtype.String("b")},
+		},
+		{
+			description: "top-level merge",
+			fn:          TopLevelMerge,
+			existing:    mmdbtype.Map{"a": mmdbtype.String("a")},
+			expected: mmdbtype.Map{
+				"a": mmdbtype.String("a"),
+				"b": mmdbtype.String("b"),
+			},
+		},
+		{
+			description: "deep merge",
+			fn:          DeepMerge,
+			existing:    mmdbtype.Map{"b": mmdbtype.String("old")},
+			expected:    mmdbtype.Map{"b": mmdbtype.String("b")},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			v, err := OnlyIfExists(test.fn)(test.existing, mmdbtype.Map{"b": mmdbtype.String("b")})
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, v)
+		})
+	}
+
+	_, err := OnlyIfExists(TopLevelMerge)(mmdbtype.String("a"), mmdbtype.Map{})
+	require.ErrorContains(t, err, "TopLevelMerge only works")
+}
+
+func TestEstablishedDepth(t *testing.T) {
+	tests := []struct {
+		description string
+		metadata    Metadata
+		expected    int
+	}{
+		{
+			description: "falls back to ExistingDepth",
+			metadata: Metadata{
+				InsertedNetwork: netip.MustParsePrefix("1.0.0.0/24"),
+				ExistingDepth:   20,
+				TreeDepth:       32,
+			},
+			expected: 20,
+		},
+		{
+			description: "IPv4 provenance in IPv6 tree",
+			metadata: Metadata{
+				InsertedNetwork:    netip.MustParsePrefix("1.0.0.0/24"),
+				ExistingDepth:      120,
+				TreeDepth:          128,
+				ExistingProvenance: Provenance{Network: netip.MustParsePrefix("1.0.0.0/16")},
+			},
+			expected: 112,
+		},
+		{
+			description: "IPv6 provenance",
+			metadata: Metadata{
+				InsertedNetwork:    netip.MustParsePrefix("2001:db8::/48"),
+				ExistingDepth:      48,
+				TreeDepth:          128,
+				ExistingProvenance: Provenance{Network: netip.MustParsePrefix("2001:db8::/32")},
+			},
+			expected: 32,
+		},
+		{
+			description: "inconsistent",
+			metadata:    Metadata{ExistingDepth: 20},
+			expected:    0,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			assert.Equal(t, test.expected, test.metadata.EstablishedDepth())
+		})
+	}
+}
+
+func TestSpecificityWins(t *testing.T) {
+	existing := mmdbtype.String("existing")
+	inserted := mmdbtype.String("new")
+	metadata := func(established string) Metadata {
+		return Metadata{
+			InsertedNetwork:    netip.MustParsePrefix("1.0.0.0/24"),
+			ExistingDepth:      120,
+			TreeDepth:          128,
+			ExistingProvenance: Provenance{Network: netip.MustParsePrefix(established)},
+		}
+	}
+
+	tests := []struct {
+		description   string
+		established   string
+		mostSpecific  mmdbtype.DataType
+		leastSpecific mmdbtype.DataType
+	}{
+		{"existing less specific", "1.0.0.0/16", inserted, existing},
+		{"existing more specific", "1.0.0.0/25", existing, inserted},
+		{"equally specific", "1.0.0.0/24", inserted, inserted},
+	}
+	for _, test := range tests {
+		t.Run(test.description, func(t *testing.T) {
+			v, err := MostSpecificWins(existing, inserted, metadata(test.established))
+			require.NoError(t, err)
+			assert.Equal(t, test.mostSpecific, v)
+
+			v, err = LeastSpecificWins(existing, inserted, metadata(test.established))
+			require.NoError(t, err)
+			assert.Equal(t, test.leastSpecific, v)
+		})
+	}
+
+	t.Run("empty record", func(t *testing.T) {
+		v, err := MostSpecificWins(nil, inserted, Metadata{})
+		require.NoError(t, err)
+		assert.Equal(t, inserted, v)
+
+		v, err = LeastSpecificWins(nil, inserted, Metadata{})
+		require.NoError(t, err)
+		assert.Equal(t, inserted, v)
+	})
+}
+
 func TestTopLevelMerge(t *testing.T) {
 	tests := []struct {
 		description string
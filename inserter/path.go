@@ -0,0 +1,205 @@
+package inserter
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"math/big"
+	"slices"
+	"strings"
+
+	"github.com/maxmind/mmdbwriter/v2/mmdbtype"
+)
+
+// The path inserters below edit a single value nested in Maps. A path lists the
+// Map keys leading from the top-level value to the edited value, such as
+// {"traits", "is_anycast"}. An empty path addresses the top-level value. They
+// copy only the Maps along the path, so the result shares every other
+// container with the existing value and must be treated as immutable. An edit
+// that changes nothing returns the existing value itself.
+//
+// A value along the path that is not a Map is an error. Each function clones
+// path, so the caller may reuse it, and the returned function is pure.
+
+// SetPath returns an inserter that sets the value at path to the new value,
+// creating any missing Maps along the path, including the top-level Map of an
+// empty record. A nil new value deletes the value at path, as DeletePath does.
+func SetPath(path []string) PureFunc {
+	path = slices.Clone(path)
+	return func(existingValue, newValue mmdbtype.DataType) (mmdbtype.DataType, error) {
+		value, _, err := editPath("SetPath", existingValue, path, 0, func(
+			old mmdbtype.DataType,
+		) (mmdbtype.DataType, bool, error) {
+			if old == nil {
+				return newValue, newValue != nil, nil
+			}
+			if newValue != nil && old.Equal(newValue) {
+				return old, false, nil
+			}
+			return newValue, true, nil
+		})
+		return value, err
+	}
+}
+
+// DeletePath returns an inserter that deletes the value at path and ignores
+// the new value. Maps along the path are kept even when the deletion leaves
+// them empty. A missing key, or an empty record, is left as it is.
+func DeletePath(path []string) PureFunc {
+	path = slices.Clone(path)
+	return func(existingValue, _ mmdbtype.DataType) (mmdbtype.DataType, error) {
+		value, _, err := editPath("DeletePath", existingValue, path, 0, func(
+			old mmdbtype.DataType,
+		) (mmdbtype.DataType, bool, error) {
+			return nil, old != nil, nil
+		})
+		return value, err
+	}
+}
+
+// IncrementPath returns an inserter that adds the new value to the number at
+// path, or sets the new value there if the path holds no value, creating
+// missing Maps as SetPath does. The new value and the existing number must have
+// the same type, one of Float32, Float64, Int32, Uint16, Uint32, Uint64, or
+// *Uint128. An integer result that overflows its type is an error. A negative
+// Int32 or Float new value decrements.
+func IncrementPath(path []string) PureFunc {
+	path = slices.Clone(path)
+	return func(existingValue, newValue mmdbtype.DataType) (mmdbtype.DataType, error) {
+		if newValue == nil {
+			return nil, errors.New("IncrementPath: the new value is nil")
+		}
+		value, _, err := editPath("IncrementPath", existingValue, path, 0, func(
+			old mmdbtype.DataType,
+		) (mmdbtype.DataType, bool, error) {
+			if old == nil {
+				return newValue, true, nil
+			}
+			sum, err := add(old, newValue)
+			if err != nil {
+				return nil, false, fmt.Errorf(
+					"IncrementPath: %s: %w",
+					describePath(path, len(path)),
+					err,
+				)
+			}
+			return sum, true, nil
+		})
+		return value, err
+	}
+}
+
+// editPath applies edit to the value at path[depth:] below value and returns
+// the updated value and whether it changed, copying the Maps whose children
+// change. edit receives nil for a missing value and returns nil to delete it.
+func editPath(
+	name string,
+	value mmdbtype.DataType,
+	path []string,
+	depth int,
+	edit func(mmdbtype.DataType) (mmdbtype.DataType, bool, error),
+) (mmdbtype.DataType, bool, error) {
+	if depth == len(path) {
+		return edit(value)
+	}
+
+	var m mmdbtype.Map
+	switch v := value.(type) {
+	case nil:
+	case mmdbtype.Map:
+		m = v
+	default:
+		return nil, false, fmt.Errorf(
+			"%s: %s is a %T, not a Map",
+			name,
+			describePath(path, depth),
+			value,
+		)
+	}
+
+	key := mmdbtype.String(path[depth])
+	child, exists := m[key]
+	newChild, changed, err := editPath(name, child, path, depth+1, edit)
+	if err != nil {
+		return nil, false, err
+	}
+	if !changed {
+		return value, false, nil
+	}
+
+	if newChild == nil {
+		if !exists {
+			return value, false, nil
+		}
+		rv := maps.Clone(m)
+		delete(rv, key)
+		return rv, true, nil
+	}
+	rv := make(mmdbtype.Map, len(m)+1)
+	maps.Copy(rv, m)
+	rv[key] = newChild
+	return rv, true, nil
+}
+
+// describePath names the value reached by path[:depth] for error messages.
+func describePath(path []string, depth int) string {
+	if depth == 0 {
+		return "the top-level value"
+	}
+	return fmt.Sprintf("the value at %q", strings.Join(path[:depth], "."))
+}
+
+// add returns a + b for two numbers of the same type.
+func add(a, b mmdbtype.DataType) (mmdbtype.DataType, error) {
+	switch a := a.(type) {
+	case mmdbtype.Float32:
+		if b, ok := b.(mmdbtype.Float32); ok {
+			return a + b, nil
+		}
+	case mmdbtype.Float64:
+		if b, ok := b.(mmdbtype.Float64); ok {
+			return a + b, nil
+		}
+	case mmdbtype.Int32:
+		if b, ok := b.(mmdbtype.Int32); ok {
+			sum := int64(a) + int64(b)
+			if sum < math.MinInt32 || sum > math.MaxInt32 {
+				return nil, errors.New("the sum overflows Int32")
+			}
+			return mmdbtype.Int32(sum), nil
+		}
+	case mmdbtype.Uint16:
+		if b, ok := b.(mmdbtype.Uint16); ok {
+			if a > math.MaxUint16-b {
+				return nil, errors.New("the sum overflows Uint16")
+			}
+			return a + b, nil
+		}
+	case mmdbtype.Uint32:
+		if b, ok := b.(mmdbtype.Uint32); ok {
+			if a > math.MaxUint32-b {
+				return nil, errors.New("the sum overflows Uint32")
+			}
+			return a + b, nil
+		}
+	case mmdbtype.Uint64:
+		if b, ok := b.(mmdbtype.Uint64); ok {
+			if a > math.MaxUint64-b {
+				return nil, errors.New("the sum overflows Uint64")
+			}
+			return a + b, nil
+		}
+	case *mmdbtype.Uint128:
+		if b, ok := b.(*mmdbtype.Uint128); ok {
+			sum := new(big.Int).Add((*big.Int)(a), (*big.Int)(b))
+			if sum.BitLen() > 128 {
+				return nil, errors.New("the sum overflows Uint128")
+			}
+			return (*mmdbtype.Uint128)(sum), nil
+		}
+	default:
+		return nil, fmt.Errorf("cannot increment a %T", a)
+	}
+	return nil, fmt.Errorf("cannot add a %T to a %T", b, a)
+}
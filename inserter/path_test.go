@@ -0,0 +1,166 @@
+package inserter
+
+import (
+	"math"
+	"math/big"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/maxmind/mmdbwriter/v2/mmdbtype"
+)
+
+func TestSetPath(t *testing.T) {
+	location := mmdbtype.Map{"metro_code": mmdbtype.Uint16(501)}
+	existing := mmdbtype.Map{
+		"traits":   mmdbtype.Map{"is_anycast": mmdbtype.Bool(false)},
+		"location": location,
+	}
+	path := []string{"traits", "is_anycast"}
+	setAnycast := SetPath(path)
+	path[0] = "changed"
+
+	v, err := setAnycast(existing, mmdbtype.Bool(true))
+	require.NoError(t, err)
+	assert.Equal(t, mmdbtype.Map{
+		"traits":   mmdbtype.Map{"is_anycast": mmdbtype.Bool(true)},
+		"location": location,
+	}, v)
+	assert.Equal(t, mmdbtype.Bool(false), existing["traits"].(mmdbtype.Map)["is_anycast"])
+	assert.Equal(t,
+		reflect.ValueOf(location).Pointer(),
+		reflect.ValueOf(v.(mmdbtype.Map)["location"]).Pointer(),
+	)
+
+	t.Run("unchanged returns existing", func(t *testing.T) {
+		v, err := setAnycast(existing, mmdbtype.Bool(false))
+		require.NoError(t, err)
+		assert.Equal(t, reflect.ValueOf(existing).Pointer(), reflect.ValueOf(v).Pointer())
+	})
+
+	t.Run("creates missing maps", func(t *testing.T) {
+		v, err := setAnycast(nil, mmdbtype.Bool(true))
+		require.NoError(t, err)
+		assert.Equal(t, mmdbtype.Map{
+			"traits": mmdbtype.Map{"is_anycast": mmdbtype.Bool(true)},
+		}, v)
+	})
+
+	t.Run("empty path replaces", func(t *testing.T) {
+		v, err := SetPath(nil)(existing, mmdbtype.String("x"))
+		require.NoError(t, err)
+		assert.Equal(t, mmdbtype.String("x"), v)
+	})
+
+	t.Run("nil deletes", func(t *testing.T) {
+		v, err := SetPath([]string{"location"})(existing, nil)
+		require.NoError(t, err)
+		assert.Equal(t, mmdbtype.Map{"traits": existing["traits"]}, v)
+	})
+
+	t.Run("non-map along path", func(t *testing.T) {
+		_, err := SetPath([]string{"location", "metro_code", "x"})(existing, mmdbtype.Bool(true))
+		require.EqualError(
+			t,
+			err,
+			`SetPath: the value at "location.metro_code" is a mmdbtype.Uint16, not a Map`,
+		)
+		_, err = SetPath([]string{"x"})(mmdbtype.String("a"), mmdbtype.Bool(true))
+		require.EqualError(t, err, "SetPath: the top-level value is a mmdbtype.String, not a Map")
+	})
+}
+
+func TestDeletePath(t *testing.T) {
+	traits := mmdbtype.Map{"is_anycast": mmdbtype.Bool(true)}
+	existing := mmdbtype.Map{
+		"traits":   traits,
+		"location": mmdbtype.Map{"metro_code": mmdbtype.Uint16(501)},
+	}
+	deleteMetro := DeletePath([]string{"location", "metro_code"})
+
+	v, err := deleteMetro(existing, mmdbtype.String("ignored"))
+	require.NoError(t, err)
+	assert.Equal(t, mmdbtype.Map{
+		"traits":   traits,
+		"location": mmdbtype.Map{},
+	}, v)
+	assert.Equal(t, mmdbtype.Uint16(501), existing["location"].(mmdbtype.Map)["metro_code"])
+
+	v, err = deleteMetro(v, nil)
+	require.NoError(t, err)
+	assert.Equal(t, mmdbtype.Map{
+		"traits":   traits,
+		"location": mmdbtype.Map{},
+	}, v)
+
+	v, err = DeletePath([]string{"missing", "key"})(existing, nil)
+	require.NoError(t, err)
+	assert.Equal(t, reflect.ValueOf(existing).Pointer(), reflect.ValueOf(v).Pointer())
+
+	v, err = deleteMetro(nil, nil)
+	require.NoError(t, err)
+	assert.Nil(t, v)
+
+	v, err = DeletePath(nil)(existing, nil)
+	require.NoError(t, err)
+	assert.Nil(t, v)
+}
+
+func TestIncrementPath(t *testing.T) {
+	count := IncrementPath([]string{"stats", "count"})
+
+	v, err := count(nil, mmdbtype.Uint32(2))
+	require.NoError(t, err)
+	assert.Equal(t, mmdbtype.Map{"stats": mmdbtype.Map{"count": mmdbtype.Uint32(2)}}, v)
+
+	v, err = count(v, mmdbtype.Uint32(3))
+	require.NoError(t, err)
+	assert.Equal(t, mmdbtype.Map{"stats": mmdbtype.Map{"count": mmdbtype.Uint32(5)}}, v)
+
+	tests := []struct {
+		existing mmdbtype.DataType
+		delta    mmdbtype.DataType
+		expected mmdbtype.DataType
+	}{
+		{mmdbtype.Float32(1.5), mmdbtype.Float32(1), mmdbtype.Float32(2.5)},
+		{mmdbtype.Float64(1.5), mmdbtype.Float64(-1), mmdbtype.Float64(0.5)},
+		{mmdbtype.Int32(1), mmdbtype.Int32(-3), mmdbtype.Int32(-2)},
+		{mmdbtype.Uint16(1), mmdbtype.Uint16(1), mmdbtype.Uint16(2)},
+		{mmdbtype.Uint64(1), mmdbtype.Uint64(1), mmdbtype.Uint64(2)},
+		{
+			(*mmdbtype.Uint128)(big.NewInt(1)),
+			(*mmdbtype.Uint128)(big.NewInt(1)),
+			(*mmdbtype.Uint128)(big.NewInt(2)),
+		},
+	}
+	for _, test := range tests {
+		v, err := IncrementPath(nil)(test.existing, test.delta)
+		require.NoError(t, err)
+		assert.Equal(t, test.expected, v)
+	}
+
+	errorTests := []struct {
+		existing mmdbtype.DataType
+		delta    mmdbtype.DataType
+		err      string
+	}{
+		{mmdbtype.Uint16(math.MaxUint16), mmdbtype.Uint16(1), "the sum overflows Uint16"},
+		{mmdbtype.Int32(math.MinInt32), mmdbtype.Int32(-1), "the sum overflows Int32"},
+		{
+			(*mmdbtype.Uint128)(new(big.Int).Lsh(big.NewInt(1), 127)),
+			(*mmdbtype.Uint128)(new(big.Int).Lsh(big.NewInt(1), 127)),
+			"the sum overflows Uint128",
+		},
+		{mmdbtype.Uint32(1), mmdbtype.Uint64(1), "cannot add a mmdbtype.Uint64 to a mmdbtype.Uint32"},
+		{mmdbtype.String("a"), mmdbtype.String("b"), "cannot increment a mmdbtype.String"},
+	}
+	for _, test := range errorTests {
+		_, err := IncrementPath([]string{"n"})(mmdbtype.Map{"n": test.existing}, test.delta)
+		require.EqualError(t, err, `IncrementPath: the value at "n": `+test.err)
+	}
+
+	_, err = count(nil, nil)
+	require.EqualError(t, err, "IncrementPath: the new value is nil")
+}
@@ -3,6 +3,7 @@ package mmdbwriter
 import (
 	"bytes"
 	"errors"
+	"iter"
 	"net/netip"
 	"slices"
 	"testing"
@@ -479,6 +480,37 @@ func TestOptionsInserterMemoizesAcrossRangeSubnets(t *testing.T) {
 	assert.Equal(t, 1, calls, "the configured pure result was not shared across range subnets")
 }
 
+// TestComposedPureInserterIsMemoized pins that a policy built with the pure
+// combinators keeps the memoization InsertRangePureFunc gives a PureFunc.
+func TestComposedPureInserterIsMemoized(t *testing.T) {
+	calls := 0
+	counting := func(existingValue, _ mmdbtype.DataType) (mmdbtype.DataType, error) {
+		calls++
+		return existingValue, nil
+	}
+	tree := newMetadataTree(t, Options{IPVersion: 4})
+	require.NoError(t, tree.Insert(
+		netip.MustParsePrefix("1.2.3.0/24"),
+		mmdbtype.Map{"a": mmdbtype.String("a")},
+	))
+	require.NoError(t, tree.InsertRangePureFunc(
+		netip.MustParseAddr("1.2.3.1"),
+		netip.MustParseAddr("1.2.3.254"),
+		mmdbtype.Map{"b": mmdbtype.String("b")},
+		inserter.Chain(
+			inserter.When(
+				func(existingValue, _ mmdbtype.DataType) bool { return existingValue != nil },
+				counting,
+			),
+			inserter.ByExistingType(inserter.TypeDispatch{Map: inserter.TopLevelMerge}),
+		),
+	))
+	assert.Equal(t, 1, calls, "the composed pure result was not shared across range subnets")
+
+	_, value := tree.Get(netip.MustParseAddr("1.2.3.1"))
+	assert.Equal(t, mmdbtype.Map{"a": mmdbtype.String("a"), "b": mmdbtype.String("b")}, value)
+}
+
 func TestFailedInsertRestoresDeepSplitChain(t *testing.T) {
 	tree := newMetadataTree(t, Options{IPVersion: 4})
 	require.NoError(t, tree.Insert(
@@ -1130,3 +1162,208 @@ func newMetadataTree(t *testing.T, options Options) *Tree {
 	require.NoError(t, err)
 	return tree
 }
+
+func TestTrackProvenance(t *testing.T) {
+	inserts := func(t *testing.T, tree *Tree) {
+		t.Helper()
+		tree.SetProvenanceSource("base.csv")
+		require.NoError(t, tree.Insert(netip.MustParsePrefix("1.0.0.0/16"), mmdbtype.String("a")))
+		tree.SetProvenanceSource("overlay.csv")
+		require.NoError(t, tree.Insert(netip.MustParsePrefix("1.0.1.0/24"), mmdbtype.String("b")))
+	}
+	tree := newMetadataTree(t, Options{IPVersion: 4, TrackProvenance: true})
+	inserts(t, tree)
+
+	base := inserter.Provenance{Network: netip.MustParsePrefix("1.0.0.0/16"), Source: "base.csv"}
+	overlay := inserter.Provenance{
+		Network: netip.MustParsePrefix("1.0.1.0/24"),
+		Source:  "overlay.csv",
+	}
+
+	// The split fragment reports its own extent but the provenance of the /16.
+	network, provenance, ok := tree.Provenance(netip.MustParseAddr("1.0.0.1"))
+	require.True(t, ok)
+	assert.Equal(t, netip.MustParsePrefix("1.0.0.0/24"), network)
+	assert.Equal(t, base, provenance)
+	_, provenance, ok = tree.Provenance(netip.MustParseAddr("1.0.1.1"))
+	require.True(t, ok)
+	assert.Equal(t, overlay, provenance)
+	_, _, ok = tree.Provenance(netip.MustParseAddr("2.0.0.1"))
+	assert.False(t, ok)
+
+	var calls []metadataCall
+	require.NoError(t, tree.InsertFunc(
+		netip.MustParsePrefix("1.0.0.0/23"),
+		mmdbtype.String("ignored"),
+		captureExisting(&calls),
+	))
+	require.Len(t, calls, 2)
+	assert.Equal(t, base, calls[0].metadata.ExistingProvenance)
+	assert.Equal(t, overlay, calls[1].metadata.ExistingProvenance)
+
+	t.Run("equal value keeps provenance", func(t *testing.T) {
+		tree.SetProvenanceSource("repeat.csv")
+		require.NoError(t, tree.Insert(
+			netip.MustParsePrefix("1.0.1.0/24"),
+			mmdbtype.String("b"),
+		))
+		_, provenance, ok := tree.Provenance(netip.MustParseAddr("1.0.1.1"))
+		require.True(t, ok)
+		assert.Equal(t, overlay, provenance)
+	})
+
+	t.Run("equal values with different provenance stay apart", func(t *testing.T) {
+		tree.SetProvenanceSource("merge.csv")
+		require.NoError(t, tree.Insert(
+			netip.MustParsePrefix("1.0.1.0/24"),
+			mmdbtype.String("a"),
+		))
+		network, provenance, ok := tree.Provenance(netip.MustParseAddr("1.0.0.1"))
+		require.True(t, ok)
+		assert.Equal(t, netip.MustParsePrefix("1.0.0.0/24"), network)
+		assert.Equal(t, base, provenance)
+		_, provenance, ok = tree.Provenance(netip.MustParseAddr("1.0.1.1"))
+		require.True(t, ok)
+		assert.Equal(t, inserter.Provenance{
+			Network: netip.MustParsePrefix("1.0.1.0/24"),
+			Source:  "merge.csv",
+		}, provenance)
+	})
+
+	t.Run("written file is unchanged", func(t *testing.T) {
+		tracked := newMetadataTree(t, Options{IPVersion: 4, TrackProvenance: true})
+		untracked := newMetadataTree(t, Options{IPVersion: 4})
+		for _, tree := range []*Tree{tracked, untracked} {
+			inserts(t, tree)
+			require.NoError(t, tree.Insert(
+				netip.MustParsePrefix("1.0.1.0/24"),
+				mmdbtype.String("a"),
+			))
+		}
+		assert.Equal(t, writeTreeBytes(t, untracked), writeTreeBytes(t, tracked))
+
+		network, _ := untracked.Get(netip.MustParseAddr("1.0.0.1"))
+		assert.Equal(t, netip.MustParsePrefix("1.0.0.0/16"), network)
+		_, _, ok := untracked.Provenance(netip.MustParseAddr("1.0.0.1"))
+		assert.False(t, ok)
+	})
+
+	t.Run("range subnets and compressed paths", func(t *testing.T) {
+		tree := newMetadataTree(t, Options{TrackProvenance: true})
+		require.NoError(t, tree.InsertRange(
+			netip.MustParseAddr("2003::"),
+			netip.MustParseAddr("2003::2"),
+			mmdbtype.String("range"),
+		))
+		_, provenance, ok := tree.Provenance(netip.MustParseAddr("2003::2"))
+		require.True(t, ok)
+		assert.Equal(t, netip.MustParsePrefix("2003::2/128"), provenance.Network)
+		_, provenance, ok = tree.Provenance(netip.MustParseAddr("2003::1"))
+		require.True(t, ok)
+		assert.Equal(t, netip.MustParsePrefix("2003::/127"), provenance.Network)
+	})
+}
+
+// TestSpecificityInserters pins that MostSpecificWins and LeastSpecificWins
+// produce the same tree for every insertion order when provenance is tracked,
+// including a range that decomposes into subnets of several depths.
+func TestSpecificityInserters(t *testing.T) {
+	type insert func(*Tree, inserter.Func) error
+	network := func(prefix string, value mmdbtype.String) insert {
+		return func(tree *Tree, fn inserter.Func) error {
+			return tree.InsertFunc(netip.MustParsePrefix(prefix), value, fn)
+		}
+	}
+	inserts := []insert{
+		network("1.0.0.0/8", "root"),
+		network("1.0.0.0/16", "wide"),
+		network("1.0.0.0/20", "mid"),
+		network("1.0.2.0/25", "narrow"),
+		// Decomposes into 1.0.0.128/25, 1.0.1.0/24, and 1.0.2.0/24.
+		func(tree *Tree, fn inserter.Func) error {
+			return tree.InsertRangeFunc(
+				netip.MustParseAddr("1.0.0.128"),
+				netip.MustParseAddr("1.0.2.255"),
+				mmdbtype.String("range"),
+				fn,
+			)
+		},
+	}
+
+	tests := []struct {
+		name     string
+		fn       inserter.Func
+		expected map[string]mmdbtype.String
+	}{
+		{
+			name: "most specific",
+			fn:   inserter.MostSpecificWins,
+			expected: map[string]mmdbtype.String{
+				"1.0.0.1":   "mid",
+				"1.0.0.129": "range",
+				"1.0.1.1":   "range",
+				"1.0.2.1":   "narrow",
+				"1.0.2.200": "range",
+				"1.0.16.1":  "wide",
+				"1.1.0.1":   "root",
+			},
+		},
+		{
+			name: "least specific",
+			fn:   inserter.LeastSpecificWins,
+			expected: map[string]mmdbtype.String{
+				"1.0.0.1":   "root",
+				"1.0.0.129": "root",
+				"1.0.2.1":   "root",
+				"1.1.0.1":   "root",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var want []byte
+			for order := range permutations(len(inserts)) {
+				tree := newMetadataTree(t, Options{IPVersion: 4, TrackProvenance: true})
+				for _, i := range order {
+					require.NoError(t, inserts[i](tree, test.fn))
+				}
+				for addr, expected := range test.expected {
+					_, value := tree.Get(netip.MustParseAddr(addr))
+					assert.Equal(t, expected, value, "%s in order %v", addr, order)
+				}
+				got := writeTreeBytes(t, tree)
+				if want == nil {
+					checkWrittenTree(t, tree)
+					want = got
+					continue
+				}
+				require.Equal(t, want, got, "order %v", order)
+			}
+		})
+	}
+}
+
+// permutations yields every ordering of [0, n). The yielded slice is reused.
+func permutations(n int) iter.Seq[[]int] {
+	return func(yield func([]int) bool) {
+		order := make([]int, n)
+		for i := range order {
+			order[i] = i
+		}
+		var permute func(int) bool
+		permute = func(k int) bool {
+			if k == n {
+				return yield(order)
+			}
+			for i := k; i < n; i++ {
+				order[k], order[i] = order[i], order[k]
+				if !permute(k + 1) {
+					return false
+				}
+				order[k], order[i] = order[i], order[k]
+			}
+			return true
+		}
+		permute(0)
+	}
+}
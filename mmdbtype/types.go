@@ -400,9 +400,9 @@ func (t Map) WriteTo(w writer) (int64, error) {
 	}
 
 	// We want database builds to be reproducible. As such, we insert
-	// the map items in order by key value. In the future, we will
-	// likely use a more relevant characteristic here (e.g., putting
-	// fields more likely to be accessed first).
+	// the map items in order by key value. The writer's data section does
+	// not pass through here, and mmdbwriter.Options.MapKeyOrder can put
+	// the fields more likely to be accessed first there.
 	//
 	// For maps with a small number of keys (the common case for record
 	// schemas), use a stack-allocated buffer to avoid a per-WriteTo
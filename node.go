@@ -3,6 +3,7 @@ package mmdbwriter
 import (
 	"errors"
 	"fmt"
+	"iter"
 
 	"github.com/maxmind/mmdbwriter/v2/inserter"
 	"github.com/maxmind/mmdbwriter/v2/internal/treeaddr"
@@ -24,7 +25,9 @@ const (
 type record struct {
 	value valueRef
 	// nodeIndex indexes Tree node blocks for node-like records and Tree.paths
-	// for compressed-path records.
+	// for compressed-path records. In a data record of a tree that tracks
+	// provenance, it indexes Tree.provenance instead, with noNodeIndex for a
+	// record that has none. Other data records leave it unread.
 	nodeIndex nodeIndex
 
 	recordType recordType
@@ -92,9 +95,13 @@ type insertRecord struct {
 	ip        [16]byte
 
 	insertedNode nodeIndex
-	value        valueRef
-	memoFirst    valueRef
-	memoResult   valueRef
+	// provenance is the Tree.provenance entry for the prefix being inserted,
+	// or noNodeIndex when the tree does not track provenance. insertPrepared
+	// sets it for every subnet of a range.
+	provenance nodeIndex
+	value      valueRef
+	memoFirst  valueRef
+	memoResult valueRef
 
 	recordType recordType
 	// insertedAs4 records the address family that the tree-space ip cannot
@@ -129,11 +136,12 @@ type insertRecord struct {
 func (iRec *insertRecord) resolveValue(
 	existing valueRef,
 	existingDepth int,
+	existingProvenance nodeIndex,
 ) (valueRef, bool, error) {
 	if !iRec.resolver.hasFunc() {
 		return iRec.value, false, nil
 	}
-	return iRec.resolve(existing, existingDepth)
+	return iRec.resolve(existing, existingDepth, existingProvenance)
 }
 
 // resolve returns a reference and whether the caller owns it. A pure
@@ -143,6 +151,7 @@ func (iRec *insertRecord) resolveValue(
 func (iRec *insertRecord) resolve(
 	existing valueRef,
 	existingDepth int,
+	existingProvenance nodeIndex,
 ) (valueRef, bool, error) {
 	if iRec.resolver.pure != nil {
 		if iRec.memo != nil {
@@ -174,9 +183,10 @@ func (iRec *insertRecord) resolve(
 			)
 		}
 		metadata := inserter.Metadata{
-			InsertedNetwork: insertedNetwork,
-			ExistingDepth:   existingDepth,
-			TreeDepth:       iRec.tree.treeDepth,
+			InsertedNetwork:    insertedNetwork,
+			ExistingDepth:      existingDepth,
+			TreeDepth:          iRec.tree.treeDepth,
+			ExistingProvenance: iRec.tree.provenanceAt(existingProvenance),
 		}
 		if existingDepth == iRec.prefixLen {
 			// ip is masked at prefixLen and the walk has not descended past
@@ -281,15 +291,16 @@ func (iRec *insertRecord) releaseResolved() {
 // is resolve's ownership handoff. When the caller already owns the incoming
 // reference, the record adopts it; otherwise the record retains its own. A
 // value equal to the old one leaves the record untouched, releasing the
-// incoming reference if it was owned.
+// incoming reference if it was owned. That includes its provenance: an insert
+// that resolves to the existing value did not establish it.
 func (iRec *insertRecord) replaceDataRecord(
 	r *record,
 	value valueRef,
 	owned bool,
 ) {
 	oldValue := r.value
-	r.nodeIndex = iRec.insertedNode
 	if value == nilValueRef {
+		r.nodeIndex = iRec.insertedNode
 		r.recordType = recordTypeEmpty
 		r.value = nilValueRef
 		iRec.store.release(oldValue)
@@ -298,6 +309,7 @@ func (iRec *insertRecord) replaceDataRecord(
 
 	r.recordType = recordTypeData
 	if oldValue != value {
+		r.nodeIndex = iRec.provenance
 		if !owned {
 			iRec.store.retain(value)
 		}
@@ -323,7 +335,7 @@ func newNodeIndex(index int) nodeIndex {
 func (t *Tree) newNode(children [2]record) nodeIndex {
 	index := newNodeIndex(t.nodeCountAllocated)
 	if t.nodeCountAllocated == len(t.nodeBlocks)*nodeBlockSize {
-		t.nodeBlocks = append(t.nodeBlocks, make([]node, nodeBlockSize))
+		t.nodeBlocks = append(t.nodeBlocks, t.newNodeBlock())
 	}
 	// Node blocks are never reallocated, which keeps node pointers stable while
 	// insertion allocates more nodes. Dead nodes are not reclaimed.
@@ -332,6 +344,20 @@ func (t *Tree) newNode(children [2]record) nodeIndex {
 	return index
 }
 
+// newNodeBlock allocates a node block in the tree's storage. Disk storage
+// panics if its file cannot grow, as the heap does when it is exhausted, since
+// node allocation happens deep inside inserts that cannot fail part way.
+func (t *Tree) newNodeBlock() []node {
+	if t.storage == nil {
+		return make([]node, nodeBlockSize)
+	}
+	block, err := t.storage.nodeBlock()
+	if err != nil {
+		panic(fmt.Sprintf("mmdbwriter: allocating node block: %v", err))
+	}
+	return block
+}
+
 func (t *Tree) nodeAt(index nodeIndex) *node {
 	return &t.nodeBlocks[int(index)/nodeBlockSize][int(index)%nodeBlockSize]
 }
@@ -341,6 +367,13 @@ func (t *Tree) nodeAt(index nodeIndex) *node {
 // or finalize expands it. Path entries are not reclaimed after materialization.
 func (t *Tree) newPath(ip [16]byte, endDepth int, record record) nodeIndex {
 	index := newNodeIndex(len(t.paths))
+	if t.storage != nil {
+		paths, err := growMapped(t.storage.paths, t.paths, 1)
+		if err != nil {
+			panic(fmt.Sprintf("mmdbwriter: allocating compressed path: %v", err))
+		}
+		t.paths = paths
+	}
 	t.paths = append(t.paths, compressedPath{
 		ip:       ip,
 		endDepth: endDepth,
@@ -425,7 +458,11 @@ func (iRec *insertRecord) insertRecord(
 				if iRec.splitDepth != 0 {
 					existingDepth = int(iRec.splitDepth)
 				}
-				value, owned, err := iRec.resolveValue(r.value, existingDepth)
+				existingProvenance := noNodeIndex
+				if r.recordType == recordTypeData {
+					existingProvenance = r.nodeIndex
+				}
+				value, owned, err := iRec.resolveValue(r.value, existingDepth, existingProvenance)
 				if err != nil {
 					return err
 				}
@@ -448,7 +485,7 @@ func (iRec *insertRecord) insertRecord(
 			// newDepth is the record's own extent, with no splitDepth check.
 			// Only a data record splits, so a split chain never descends into
 			// an empty record and splitDepth is necessarily zero here.
-			value, owned, err := iRec.resolveValue(nilValueRef, newDepth)
+			value, owned, err := iRec.resolveValue(nilValueRef, newDepth, noNodeIndex)
 			if err != nil {
 				return err
 			}
@@ -460,6 +497,7 @@ func (iRec *insertRecord) insertRecord(
 			}
 			r.nodeIndex = iRec.tree.newPath(iRec.ip, iRec.prefixLen, record{
 				value:      value,
+				nodeIndex:  iRec.provenance,
 				recordType: recordTypeData,
 			})
 			r.recordType = recordTypePath
@@ -484,7 +522,9 @@ func (iRec *insertRecord) insertRecord(
 		return iRec.maybeMergeChildren(r)
 	case recordTypeReserved:
 		if iRec.prefixLen >= newDepth {
-			return newReservedNetworkError(iRec.ip, newDepth, iRec.prefixLen, iRec.tree.treeDepth)
+			return iRec.conflict(func() error {
+				return newReservedNetworkError(iRec.ip, newDepth, iRec.prefixLen, iRec.tree.treeDepth)
+			})
 		}
 		// We are inserting a network that contains a reserved network. Leave
 		// the reserved record as it is, and do not report it to an inserter.
@@ -496,7 +536,9 @@ func (iRec *insertRecord) insertRecord(
 			return nil
 		}
 		// attempting to insert _into_ an aliased network
-		return newAliasedNetworkError(iRec.ip, newDepth, iRec.prefixLen, iRec.tree.treeDepth)
+		return iRec.conflict(func() error {
+			return newAliasedNetworkError(iRec.ip, newDepth, iRec.prefixLen, iRec.tree.treeDepth)
+		})
 	default:
 		return fmt.Errorf("inserting into record type %d is not implemented", r.recordType)
 	}
@@ -521,33 +563,47 @@ func (iRec *insertRecord) maybeMergeChildren(r *record) error {
 	// called from every node-level insert, so the copies add up across
 	// millions of inserts.
 	node := iRec.tree.nodeAt(r.nodeIndex)
-	child0 := &node.children[0]
-	child1 := &node.children[1]
+	merged, ok, err := iRec.mergedRecord(&node.children[0], &node.children[1])
+	if ok {
+		*r = merged
+	}
+	return err
+}
+
+// mergedRecord returns the record that replaces a node with the children
+// child0 and child1, and whether they can be merged. Merging two data records
+// releases child1's reference to their shared value.
+func (iRec *insertRecord) mergedRecord(child0, child1 *record) (record, bool, error) {
 	if child0.recordType != child1.recordType {
-		return nil
+		return record{}, false, nil
 	}
 	switch child0.recordType {
 	// Node-like and compressed-path records can't be merged by record equality.
 	case recordTypeFixedNode, recordTypeNode, recordTypePath:
-		return nil
+		return record{}, false, nil
 	case recordTypeEmpty, recordTypeReserved:
-		r.recordType = child0.recordType
-		r.nodeIndex = noNodeIndex
-		return nil
+		return record{recordType: child0.recordType, nodeIndex: noNodeIndex}, true, nil
 	case recordTypeData:
 		// The store keeps exactly one live node per wire-equal value, so
 		// reference equality here is value equality.
 		if child0.value != child1.value {
-			return nil
+			return record{}, false, nil
+		}
+		// Merging records with different provenance would lose one of them,
+		// so a tracking tree leaves them apart and collapseNodes merges them
+		// only for writing.
+		if iRec.tree.trackProvenance && child0.nodeIndex != child1.nodeIndex {
+			return record{}, false, nil
 		}
 		// Children have same data and can be merged
-		r.recordType = recordTypeData
-		r.value = child0.value
 		iRec.store.release(child1.value)
-		r.nodeIndex = noNodeIndex
-		return nil
+		merged := record{recordType: recordTypeData, value: child0.value, nodeIndex: noNodeIndex}
+		if iRec.tree.trackProvenance {
+			merged.nodeIndex = child0.nodeIndex
+		}
+		return merged, true, nil
 	default:
-		return fmt.Errorf("merging record type %d is not implemented", child0.recordType)
+		return record{}, false, fmt.Errorf("merging record type %d is not implemented", child0.recordType)
 	}
 }
 
@@ -556,6 +612,18 @@ func (t *Tree) getNode(
 	ip [16]byte,
 	depth int,
 ) (int, record) {
+	depth, r, _ := t.lookupNode(index, ip, depth)
+	return depth, r
+}
+
+// lookupNode follows ip from the node at depth to the record that decides it,
+// as a reader would. It returns that record's depth in ip and the depth of the
+// alias record it followed, or zero if it followed none.
+func (t *Tree) lookupNode(
+	index nodeIndex,
+	ip [16]byte,
+	depth int,
+) (int, record, int) {
 	n := t.nodeAt(index)
 	r := n.children[bitAt(ip, depth)]
 
@@ -568,25 +636,93 @@ func (t *Tree) getRecord(
 	r record,
 	ip [16]byte,
 	depth int,
-) (int, record) {
+) (int, record, int) {
 	if r.recordType == recordTypePath {
 		path := t.paths[r.nodeIndex]
 		for pathDepth := depth; pathDepth < path.endDepth; pathDepth++ {
 			if bitAt(ip, pathDepth) != bitAt(path.ip, pathDepth) {
-				return pathDepth + 1, record{}
+				return pathDepth + 1, record{}, 0
 			}
 		}
 		return t.getRecord(path.record, ip, path.endDepth)
 	}
 
 	switch r.recordType {
-	case recordTypeNode, recordTypeAlias, recordTypeFixedNode:
-		return t.getNode(r.nodeIndex, ip, depth)
+	case recordTypeNode, recordTypeFixedNode:
+		return t.lookupNode(r.nodeIndex, ip, depth)
+	case recordTypeAlias:
+		// An alias leads to the IPv4 subtree, whose nodes sit at depth 96, and
+		// a reader takes the next 32 bits as the IPv4 address. Move them to
+		// the subtree's position so compressed paths there compare correctly.
+		var ipv4IP [16]byte
+		for i := range 32 {
+			setBitAt(&ipv4IP, 96+i, bitAt(ip, depth+i))
+		}
+		ipv4Depth, r, _ := t.lookupNode(r.nodeIndex, ipv4IP, 96)
+		return depth + ipv4Depth - 96, r, depth
 	default:
-		return depth, r
+		return depth, r, 0
 	}
 }
 
+// dataRecord is a data record found by dataRecords. ip is its tree-space
+// address, zeroed at and below depth. provenance is the record's
+// Tree.provenance index, as record.nodeIndex holds it.
+type dataRecord struct {
+	ip         [16]byte
+	depth      int
+	value      valueRef
+	provenance nodeIndex
+}
+
+// dataRecords yields the tree's data records in address order. It reads
+// compressed paths without expanding them, and it does not follow alias
+// records, whose data is yielded once, from the IPv4 subtree. The tree must
+// not be modified during the iteration.
+func (t *Tree) dataRecords() iter.Seq[dataRecord] {
+	return func(yield func(dataRecord) bool) {
+		t.walkDataRecords(t.root, [16]byte{}, 0, yield)
+	}
+}
+
+func (t *Tree) walkDataRecords(
+	index nodeIndex,
+	ip [16]byte,
+	depth int,
+	yield func(dataRecord) bool,
+) bool {
+	n := t.nodeAt(index)
+	for i := range 2 {
+		childIP := ip
+		setBitAt(&childIP, depth, byte(i))
+		r := n.children[i]
+		childDepth := depth + 1
+		if r.recordType == recordTypePath {
+			path := t.paths[r.nodeIndex]
+			childIP = maskedTreeAddr(path.ip, path.endDepth)
+			childDepth = path.endDepth
+			r = path.record
+		}
+		switch r.recordType {
+		case recordTypeData:
+			if !yield(dataRecord{
+				ip:         childIP,
+				depth:      childDepth,
+				value:      r.value,
+				provenance: r.nodeIndex,
+			}) {
+				return false
+			}
+		case recordTypeNode, recordTypeFixedNode:
+			if !t.walkDataRecords(r.nodeIndex, childIP, childDepth, yield) {
+				return false
+			}
+		default:
+		}
+	}
+	return true
+}
+
 func (t *Tree) expandPaths(index nodeIndex, currentDepth int) {
 	n := t.nodeAt(index)
 	for i := range 2 {
@@ -608,6 +744,42 @@ func (t *Tree) expandPaths(index nodeIndex, currentDepth int) {
 	}
 }
 
+// collapseNodes finds the nodes of a provenance-tracking tree whose records
+// all hold one value, which an untracked tree would have merged into a single
+// data record, and records that value in collapsedValues. It returns the value
+// the node collapses to, or nilValueRef. Fixed nodes never merge, so only
+// their descendants can collapse. expandPaths must run before this.
+func (t *Tree) collapseNodes(index nodeIndex) valueRef {
+	n := t.nodeAt(index)
+	var values [2]valueRef
+	for i := range 2 {
+		child := &n.children[i]
+		switch child.recordType {
+		case recordTypeData:
+			values[i] = child.value
+		case recordTypeNode:
+			values[i] = t.collapseNodes(child.nodeIndex)
+		case recordTypeFixedNode:
+			t.collapseNodes(child.nodeIndex)
+		default:
+		}
+	}
+	if values[0] == nilValueRef || values[0] != values[1] {
+		return nilValueRef
+	}
+	t.collapsedValues[index] = values[0]
+	return values[0]
+}
+
+// collapsedValue returns the value a node record is written as when
+// collapseNodes merged its subtree, or nilValueRef.
+func (t *Tree) collapsedValue(r *record) valueRef {
+	if t.collapsedValues == nil || r.recordType != recordTypeNode {
+		return nilValueRef
+	}
+	return t.collapsedValues[r.nodeIndex]
+}
+
 // finalizeNode assigns node numbers depth-first. expandPaths must run before
 // this so compressed paths cannot be confused with node indexes.
 func (t *Tree) finalizeNode(index nodeIndex, currentNum int) int {
@@ -619,6 +791,9 @@ func (t *Tree) finalizeNode(index nodeIndex, currentNum int) int {
 		switch n.children[i].recordType {
 		case recordTypeFixedNode,
 			recordTypeNode:
+			if t.collapsedValue(&n.children[i]) != nilValueRef {
+				continue
+			}
 			currentNum = t.finalizeNode(n.children[i].nodeIndex, currentNum)
 		case recordTypePath:
 			panic("compressed path found after expandPaths")
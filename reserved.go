@@ -1,5 +1,31 @@
 package mmdbwriter
 
+import (
+	"net/netip"
+	"slices"
+)
+
+// DefaultReservedNetworks returns the networks a tree of the given IP version
+// reserves when Options.ReservedNetworks is nil. The list for an IPv6 tree
+// includes the IPv4 list. It returns nil for an unsupported IP version. The
+// result is a fresh slice the caller may modify.
+func DefaultReservedNetworks(ipVersion int) []netip.Prefix {
+	var networks []string
+	switch ipVersion {
+	case 4:
+		networks = reservedNetworksIPv4
+	case 6:
+		networks = append(slices.Clone(reservedNetworksIPv4), reservedNetworksIPv6...)
+	default:
+		return nil
+	}
+	prefixes := make([]netip.Prefix, 0, len(networks))
+	for _, network := range networks {
+		prefixes = append(prefixes, netip.MustParsePrefix(network))
+	}
+	return prefixes
+}
+
 // These were taken from the Perl writer.
 //
 // https://www.iana.org/assignments/iana-ipv4-special-registry
@@ -0,0 +1,178 @@
+package mmdbwriter
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/maxmind/mmdbwriter/v2/mmdbtype"
+)
+
+// MapValues replaces the value of every data record with fn's result for it,
+// such as to drop a key from every record or rename a field, without
+// re-inserting any network. A nil result removes the records holding the
+// value. Sibling records left with equal values are merged, and values no
+// longer used are released.
+//
+// fn is called once per distinct value, in the address order of the first
+// record holding it, and does not see the aliased networks or the reserved
+// ones. It receives a shared, read-only view of the value, as Get returns, and
+// must not modify it. Call Copy to build a modified value. As with an
+// Inserter, fn must be pure, since which records share a value depends on the
+// tree's shape.
+//
+// If fn returns an error, or its result cannot be stored, MapValues returns
+// the error and leaves the tree unchanged.
+func (t *Tree) MapValues(fn func(mmdbtype.DataType) (mmdbtype.DataType, error)) error {
+	mapped := map[valueRef]valueRef{}
+	// The audit only balances once mapped's references are gone, so they are
+	// released explicitly rather than deferred.
+	releaseMapped := func() {
+		for _, ref := range mapped {
+			t.valueStore.release(ref)
+		}
+	}
+	for record := range t.dataRecords() {
+		if _, ok := mapped[record.value]; ok {
+			continue
+		}
+		value, err := fn(t.valueStore.materialize(record.value))
+		ref := nilValueRef
+		if err == nil && value != nil {
+			ref, err = t.valueStore.intern(value)
+		}
+		if err != nil {
+			releaseMapped()
+			prefix, prefixErr := prefixFromInsertIP(record.ip, record.depth, t.treeDepth)
+			if prefixErr != nil {
+				return fmt.Errorf("mapping a value: %w", err)
+			}
+			return fmt.Errorf("mapping the value of %s: %w", prefix, err)
+		}
+		mapped[record.value] = ref
+	}
+
+	t.resetFinalized()
+	merge := t.newInsertRecordRef(recordTypeData, insertResolver{}, noNodeIndex, nilValueRef)
+	err := t.rewriteRecords(t.root, [16]byte{}, 0, merge, func(_ [16]byte, _ int, r *record) error {
+		t.replaceRecordValue(r, mapped[r.value])
+		return nil
+	})
+	releaseMapped()
+	if err != nil {
+		return err
+	}
+	return t.maybeAuditValueStore()
+}
+
+// rewriteRecords calls rewrite, in address order, for each data record below
+// the node at ip and depth, including the records of compressed paths, and
+// then merges any node left with equal children. rewrite receives the
+// record's tree-space network and may replace its value or empty it. It is
+// not called for the data reached through alias records.
+func (t *Tree) rewriteRecords(
+	index nodeIndex,
+	ip [16]byte,
+	depth int,
+	merge *insertRecord,
+	rewrite func(ip [16]byte, depth int, r *record) error,
+) error {
+	n := t.nodeAt(index)
+	for i := range n.children {
+		childIP := ip
+		setBitAt(&childIP, depth, byte(i))
+		r := &n.children[i]
+		switch r.recordType {
+		case recordTypeData:
+			if err := rewrite(childIP, depth+1, r); err != nil {
+				return err
+			}
+		case recordTypePath:
+			path := &t.paths[r.nodeIndex]
+			pathIP := maskedTreeAddr(path.ip, path.endDepth)
+			if err := rewrite(pathIP, path.endDepth, &path.record); err != nil {
+				return err
+			}
+			if path.record.recordType == recordTypeEmpty {
+				// The path holds nothing else, so the whole path empties.
+				*r = record{}
+			}
+		case recordTypeNode, recordTypeFixedNode:
+			if err := t.rewriteRecords(r.nodeIndex, childIP, depth+1, merge, rewrite); err != nil {
+				return err
+			}
+			if r.recordType == recordTypeNode {
+				if err := merge.maybeMergeChildren(r); err != nil {
+					return err
+				}
+			}
+		case recordTypeEmpty, recordTypeAlias, recordTypeReserved:
+		}
+	}
+	return nil
+}
+
+// replaceRecordValue makes the data record r hold ref, which it retains, and
+// releases its old value. A nil ref empties the record.
+func (t *Tree) replaceRecordValue(r *record, ref valueRef) {
+	if ref == r.value {
+		return
+	}
+	t.valueStore.retain(ref)
+	t.valueStore.release(r.value)
+	if ref == nilValueRef {
+		*r = record{}
+		return
+	}
+	r.value = ref
+}
+
+// PruneCounts reports what Tree.Prune removed.
+type PruneCounts struct {
+	// Records is the number of data records removed.
+	Records int
+	// Values is the number of distinct values that only removed records
+	// held.
+	Values int
+}
+
+// Prune removes every data record for which pred returns true, such as the
+// records of test networks or every IPv6 network longer than /48, in one
+// traversal, without re-inserting anything. Nodes left with equal children
+// are merged, and values no longer used are released.
+//
+// pred is called in address order for each data record as the tree stores
+// it, so a value inserted for one network can be seen as several records
+// where later inserts split it, and it does not see the aliased networks or
+// the reserved ones. The prefix is the record's network, in the form Get
+// returns, and the value is a shared, read-only view that pred must not
+// modify.
+func (t *Tree) Prune(pred func(prefix netip.Prefix, value mmdbtype.DataType) bool) (PruneCounts, error) {
+	var counts PruneCounts
+	removed := map[valueRef]bool{}
+	kept := map[valueRef]bool{}
+	t.resetFinalized()
+	merge := t.newInsertRecordRef(recordTypeData, insertResolver{}, noNodeIndex, nilValueRef)
+	err := t.rewriteRecords(t.root, [16]byte{}, 0, merge, func(ip [16]byte, depth int, r *record) error {
+		prefix, err := prefixFromInsertIP(ip, depth, t.treeDepth)
+		if err != nil {
+			return err
+		}
+		if !pred(prefix, t.valueStore.materialize(r.value)) {
+			kept[r.value] = true
+			return nil
+		}
+		counts.Records++
+		removed[r.value] = true
+		t.replaceRecordValue(r, nilValueRef)
+		return nil
+	})
+	for ref := range removed {
+		if !kept[ref] {
+			counts.Values++
+		}
+	}
+	if err != nil {
+		return counts, err
+	}
+	return counts, t.maybeAuditValueStore()
+}
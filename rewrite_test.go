@@ -0,0 +1,184 @@
+package mmdbwriter
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/maxmind/mmdbwriter/v2/mmdbtype"
+)
+
+// mapTestValue drops strings and turns every map into the same value, so
+// records are removed and siblings become equal.
+func mapTestValue(value mmdbtype.DataType) (mmdbtype.DataType, error) {
+	switch value.(type) {
+	case mmdbtype.String:
+		return nil, nil
+	case mmdbtype.Map:
+		return mmdbtype.Map{"merged": mmdbtype.Bool(true)}, nil
+	default:
+		return value, nil
+	}
+}
+
+// TestMapValuesMatchesInsert pins that MapValues leaves the tree that
+// inserting every record's mapped value into a Tree from New builds, with
+// newly equal siblings merged, and that it calls fn once per distinct value.
+func TestMapValuesMatchesInsert(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+	}{
+		{"IPv4", Options{IPVersion: 4}},
+		{"IPv6", Options{IPVersion: 6}},
+		{"IPv6 with provenance", Options{IPVersion: 6, TrackProvenance: true}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for seed := range uint64(5) {
+				test.options.BuildEpoch = 1
+				test.options.DatabaseType = "rewrite-test"
+				test.options.Description = map[string]string{"en": "Rewrite test"}
+				test.options.RefcountAudit = true
+				tree, err := New(test.options)
+				require.NoError(t, err)
+				for _, spec := range randomInsertSpecs(t, tree, seed, true) {
+					require.NoError(t, tree.Insert(spec.network, spec.value))
+				}
+
+				expected, err := New(test.options)
+				require.NoError(t, err)
+				distinct := map[valueRef]bool{}
+				for record := range tree.dataRecords() {
+					distinct[record.value] = true
+					value, err := mapTestValue(tree.valueStore.materialize(record.value))
+					require.NoError(t, err)
+					if value == nil {
+						continue
+					}
+					network, err := prefixFromInsertIP(record.ip, record.depth, tree.treeDepth)
+					require.NoError(t, err)
+					require.NoError(t, expected.Insert(network, value))
+				}
+
+				calls := 0
+				require.NoError(t, tree.MapValues(func(value mmdbtype.DataType) (mmdbtype.DataType, error) {
+					calls++
+					return mapTestValue(value)
+				}))
+				assert.Equal(t, len(distinct), calls)
+				require.Equal(t, writeTreeBytes(t, expected), writeTreeBytes(t, tree), "seed %d", seed)
+			}
+		})
+	}
+}
+
+// TestMapValuesErrorLeavesTree pins that an error from fn leaves the tree as
+// it was.
+func TestMapValuesErrorLeavesTree(t *testing.T) {
+	tree, err := New(Options{IPVersion: 4, BuildEpoch: 1, RefcountAudit: true})
+	require.NoError(t, err)
+	for _, insert := range []struct {
+		network string
+		value   mmdbtype.DataType
+	}{
+		{"1.0.0.0/8", mmdbtype.String("a")},
+		{"1.1.0.0/16", mmdbtype.Map{"country": mmdbtype.String("US")}},
+		{"2.0.0.0/8", mmdbtype.Map{"country": mmdbtype.String("FR")}},
+	} {
+		require.NoError(t, tree.Insert(netip.MustParsePrefix(insert.network), insert.value))
+	}
+	before := writeTreeBytes(t, tree)
+
+	errStop := errors.New("stop")
+	calls := 0
+	err = tree.MapValues(func(value mmdbtype.DataType) (mmdbtype.DataType, error) {
+		calls++
+		if calls == 2 {
+			return nil, errStop
+		}
+		return mmdbtype.String("replaced"), nil
+	})
+	require.ErrorIs(t, err, errStop)
+	assert.Regexp(t, `^mapping the value of [0-9./]+: stop$`, err.Error())
+	assert.Equal(t, before, writeTreeBytes(t, tree))
+
+	err = tree.MapValues(func(mmdbtype.DataType) (mmdbtype.DataType, error) {
+		return mmdbtype.Slice{nil}, nil
+	})
+	require.ErrorContains(t, err, "slice index 0 has a nil value")
+	assert.Equal(t, before, writeTreeBytes(t, tree))
+}
+
+// TestPruneMatchesInsert pins that Prune leaves the tree that inserting only
+// the records pred keeps into a Tree from New builds, and that it counts what
+// it removed.
+func TestPruneMatchesInsert(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+	}{
+		{"IPv4", Options{IPVersion: 4}},
+		{"IPv6", Options{IPVersion: 6}},
+		{"IPv6 with provenance", Options{IPVersion: 6, TrackProvenance: true}},
+	}
+	// pred drops strings and every network longer than /20, which also
+	// removes whole values.
+	pred := func(prefix netip.Prefix, value mmdbtype.DataType) bool {
+		_, isString := value.(mmdbtype.String)
+		return isString || prefix.Bits() > 20
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for seed := range uint64(5) {
+				test.options.BuildEpoch = 1
+				test.options.DatabaseType = "rewrite-test"
+				test.options.Description = map[string]string{"en": "Rewrite test"}
+				test.options.RefcountAudit = true
+				tree, err := New(test.options)
+				require.NoError(t, err)
+				for _, spec := range randomInsertSpecs(t, tree, seed, true) {
+					require.NoError(t, tree.Insert(spec.network, spec.value))
+				}
+
+				expected, err := New(test.options)
+				require.NoError(t, err)
+				var want PruneCounts
+				kept := map[valueRef]bool{}
+				removed := map[valueRef]bool{}
+				var prefixes []netip.Prefix
+				for record := range tree.dataRecords() {
+					network, err := prefixFromInsertIP(record.ip, record.depth, tree.treeDepth)
+					require.NoError(t, err)
+					prefixes = append(prefixes, network)
+					value := tree.valueStore.materialize(record.value)
+					if pred(network, value) {
+						want.Records++
+						removed[record.value] = true
+						continue
+					}
+					kept[record.value] = true
+					require.NoError(t, expected.Insert(network, value))
+				}
+				for ref := range removed {
+					if !kept[ref] {
+						want.Values++
+					}
+				}
+
+				var seen []netip.Prefix
+				counts, err := tree.Prune(func(prefix netip.Prefix, value mmdbtype.DataType) bool {
+					seen = append(seen, prefix)
+					return pred(prefix, value)
+				})
+				require.NoError(t, err)
+				assert.Equal(t, want, counts)
+				assert.Equal(t, prefixes, seen)
+				require.Equal(t, writeTreeBytes(t, expected), writeTreeBytes(t, tree), "seed %d", seed)
+			}
+		})
+	}
+}
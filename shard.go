@@ -0,0 +1,599 @@
+package mmdbwriter
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"iter"
+	"maps"
+	"net/netip"
+	"runtime"
+	"slices"
+	"sync"
+
+	"github.com/maxmind/mmdbwriter/v2/internal/treeaddr"
+	"github.com/maxmind/mmdbwriter/v2/mmdbtype"
+)
+
+// ShardOptions configures a ShardedBuilder.
+type ShardOptions struct {
+	// Workers is the number of goroutines building shards. The default is
+	// runtime.GOMAXPROCS(0).
+	Workers int
+
+	// IPv4PrefixLength is the prefix length of the IPv4 shards, from 1 to 32.
+	// The default, 0, selects 8, one shard per /8.
+	IPv4PrefixLength int
+
+	// IPv6PrefixLength is the prefix length of the IPv6 shards, from 1 to 128.
+	// The default, 0, selects 16. In an IPv6 tree, the IPv4 subtree at ::/96
+	// is sharded by IPv4PrefixLength instead. It is ignored for an IPv4 tree.
+	IPv6PrefixLength int
+
+	// QueueSize is the number of inserts buffered for each worker before
+	// Insert blocks. The default is 1024.
+	QueueSize int
+}
+
+// ShardedBuilder builds a Tree on several goroutines. It divides the address
+// space into shards by prefix, such as one per IPv4 /8, and gives each worker
+// goroutine its own Tree for the shards assigned to it. Tree then grafts each
+// shard's subtree into one Tree in place of the record at the shard's network,
+// translating each distinct value into the Tree's single value store once,
+// and merges the records above the shards as Insert would have.
+//
+// The result is the same Tree as calling Tree.Insert for each network, in the
+// same order, on a Tree from New. A network shorter than its shard is inserted
+// as its shard-sized subnets, as InsertRange inserts the subnets of a range, so
+// in a tree created with Options.TrackProvenance its provenance is recorded per
+// subnet. Only networks in the same shard are inserted in order relative to
+// each other, which is all that matters, since networks in different shards do
+// not overlap.
+type ShardedBuilder struct {
+	tree    *Tree
+	workers []*shardWorker
+	wg      sync.WaitGroup
+	shards  map[shardKey]int
+	source  string
+	opts    ShardOptions
+	seq     int
+	done    bool
+}
+
+// shardKey identifies a shard by its tree-space network.
+type shardKey struct {
+	ip    [16]byte
+	depth int
+}
+
+type shardEntry struct {
+	value  mmdbtype.DataType
+	source string
+	prefix netip.Prefix
+	input  netip.Prefix
+	seq    int
+}
+
+type shardWorker struct {
+	tree       *Tree
+	queue      chan shardEntry
+	panicValue any
+	errs       []shardError
+	// conflicts are the conflicts the worker's tree collected, tagged with
+	// the insert that caused them.
+	conflicts []shardError
+	panicked  bool
+}
+
+type shardError struct {
+	err error
+	seq int
+}
+
+// NewShardedBuilder returns a ShardedBuilder for a Tree created with opts, as
+// New creates it, and starts its workers. Call Tree to stop them.
+func NewShardedBuilder(opts Options, shardOpts ShardOptions) (*ShardedBuilder, error) {
+	if shardOpts.Workers == 0 {
+		shardOpts.Workers = runtime.GOMAXPROCS(0)
+	}
+	if shardOpts.IPv4PrefixLength == 0 {
+		shardOpts.IPv4PrefixLength = 8
+	}
+	if shardOpts.IPv6PrefixLength == 0 {
+		shardOpts.IPv6PrefixLength = 16
+	}
+	if shardOpts.QueueSize == 0 {
+		shardOpts.QueueSize = 1024
+	}
+	switch {
+	case shardOpts.Workers < 0:
+		return nil, fmt.Errorf("invalid ShardOptions.Workers: %d", shardOpts.Workers)
+	case shardOpts.IPv4PrefixLength < 0 || shardOpts.IPv4PrefixLength > 32:
+		return nil, fmt.Errorf(
+			"invalid ShardOptions.IPv4PrefixLength: %d",
+			shardOpts.IPv4PrefixLength,
+		)
+	case shardOpts.IPv6PrefixLength < 0 || shardOpts.IPv6PrefixLength > 128:
+		return nil, fmt.Errorf(
+			"invalid ShardOptions.IPv6PrefixLength: %d",
+			shardOpts.IPv6PrefixLength,
+		)
+	case shardOpts.QueueSize < 0:
+		return nil, fmt.Errorf("invalid ShardOptions.QueueSize: %d", shardOpts.QueueSize)
+	}
+
+	tree, err := New(opts)
+	if err != nil {
+		return nil, err
+	}
+	b := &ShardedBuilder{
+		tree:   tree,
+		shards: map[shardKey]int{},
+		opts:   shardOpts,
+	}
+	for range shardOpts.Workers {
+		tree, err := New(opts)
+		if err != nil {
+			return nil, err
+		}
+		b.workers = append(b.workers, &shardWorker{
+			tree:  tree,
+			queue: make(chan shardEntry, shardOpts.QueueSize),
+		})
+	}
+	for _, w := range b.workers {
+		b.wg.Go(w.run)
+	}
+	return b, nil
+}
+
+func (w *shardWorker) run() {
+	defer func() {
+		if r := recover(); r != nil {
+			w.panicked = true
+			w.panicValue = r
+			// Drain the queue so Insert cannot block on a dead worker.
+			for range w.queue {
+			}
+		}
+	}()
+	for entry := range w.queue {
+		w.tree.provenanceSource = entry.source
+		if err := w.tree.Insert(entry.prefix, entry.value); err != nil {
+			w.errs = append(w.errs, shardError{
+				err: fmt.Errorf("inserting %s: %w", entry.input, err),
+				seq: entry.seq,
+			})
+		}
+		for _, conflict := range w.tree.TakeConflicts() {
+			w.conflicts = append(w.conflicts, shardError{err: conflict, seq: entry.seq})
+		}
+	}
+	// Expand the compressed paths while still in parallel, so grafting only
+	// copies nodes.
+	w.tree.expandPaths(w.tree.root, 0)
+}
+
+// SetProvenanceSource sets the provenance source for later inserts, as
+// Tree.SetProvenanceSource does.
+func (b *ShardedBuilder) SetProvenanceSource(source string) {
+	b.source = source
+}
+
+// Insert queues value for prefix on the workers for the shards it covers. It
+// returns an error only for an invalid prefix. Errors from the insert itself,
+// such as a conflict with a reserved network, are returned by Tree. The value
+// ownership rules are the same as for Tree.Insert, and a worker may read the
+// value at any time until Tree returns.
+//
+// Insert is not safe to call from multiple threads. The parallelism comes from
+// the workers.
+func (b *ShardedBuilder) Insert(prefix netip.Prefix, value mmdbtype.DataType) error {
+	if b.done {
+		return errShardedBuilderDone
+	}
+	t := b.tree
+	prefix, err := t.normalizeInsertPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	seq := b.seq
+	b.seq++
+
+	ip, prefixLen := t.prefixInsertIP(prefix)
+	if depth, recordType := t.coveringRecord(ip, prefixLen); depth <= prefixLen &&
+		(recordType == recordTypeReserved || recordType == recordTypeAlias) {
+		// The whole network is inside a reserved or aliased network. Send it
+		// unsplit, so it fails once, as Tree.Insert would.
+		b.enqueue(b.shardFor(ip, prefixLen), prefix, prefix, value, seq)
+		return nil
+	}
+	for pieceIP, pieceLen := range b.pieces(ip, prefixLen) {
+		if pieceLen == prefixLen {
+			b.enqueue(b.shardFor(pieceIP, pieceLen), prefix, prefix, value, seq)
+			continue
+		}
+		// Tree.Insert silently skips the reserved and aliased networks an
+		// insert contains, so skip the subnets inside them.
+		depth, recordType := t.coveringRecord(pieceIP, pieceLen)
+		if depth <= pieceLen && (recordType == recordTypeReserved || recordType == recordTypeAlias) {
+			continue
+		}
+		piece, err := prefixFromInsertIP(pieceIP, pieceLen, t.treeDepth)
+		if err != nil {
+			return err
+		}
+		b.enqueue(b.shardFor(pieceIP, pieceLen), piece, prefix, value, seq)
+	}
+	return nil
+}
+
+func (b *ShardedBuilder) enqueue(
+	worker int,
+	prefix, input netip.Prefix,
+	value mmdbtype.DataType,
+	seq int,
+) {
+	b.workers[worker].queue <- shardEntry{
+		value:  value,
+		source: b.source,
+		prefix: prefix,
+		input:  input,
+		seq:    seq,
+	}
+}
+
+// shardDepth returns the tree depth of the shards for the network at ip and
+// prefixLen, which must not contain the IPv4 subtree of an IPv6 tree.
+func (b *ShardedBuilder) shardDepth(ip [16]byte, prefixLen int) int {
+	t := b.tree
+	if t.treeDepth == 32 {
+		return b.opts.IPv4PrefixLength
+	}
+	if prefixLen >= 96 && treeaddr.IsIPv4SubtreeIP(ip) {
+		return 96 + b.opts.IPv4PrefixLength
+	}
+	return b.opts.IPv6PrefixLength
+}
+
+// pieces yields the networks the network at ip and prefixLen divides into, so
+// each lies within one shard. In an IPv6 tree, a network containing the IPv4
+// subtree is first halved until no half contains it.
+func (b *ShardedBuilder) pieces(ip [16]byte, prefixLen int) iter.Seq2[[16]byte, int] {
+	return func(yield func([16]byte, int) bool) {
+		b.yieldPieces(ip, prefixLen, yield)
+	}
+}
+
+func (b *ShardedBuilder) yieldPieces(
+	ip [16]byte,
+	prefixLen int,
+	yield func([16]byte, int) bool,
+) bool {
+	if b.tree.treeDepth == 128 && prefixLen < 96 && treeaddr.IsIPv4SubtreeIP(ip) {
+		for bit := range byte(2) {
+			half := ip
+			setBitAt(&half, prefixLen, bit)
+			if !b.yieldPieces(half, prefixLen+1, yield) {
+				return false
+			}
+		}
+		return true
+	}
+
+	shardDepth := b.shardDepth(ip, prefixLen)
+	if prefixLen >= shardDepth {
+		return yield(ip, prefixLen)
+	}
+	last := lastTreeAddr(ip, prefixLen, b.tree.treeDepth)
+	last = maskedTreeAddr(last, shardDepth)
+	for piece := ip; ; {
+		if !yield(piece, shardDepth) {
+			return false
+		}
+		if piece == last {
+			return true
+		}
+		piece = nextTreeNetwork(piece, shardDepth)
+	}
+}
+
+// nextTreeNetwork returns the address of the network of the given depth that
+// follows the one at ip.
+func nextTreeNetwork(ip [16]byte, depth int) [16]byte {
+	for bit := depth - 1; bit >= 0; bit-- {
+		if bitAt(ip, bit) == 0 {
+			setBitAt(&ip, bit, 1)
+			return ip
+		}
+		setBitAt(&ip, bit, 0)
+	}
+	return ip
+}
+
+// coveringRecord returns the depth and type of the shallowest record on the
+// path to the network at ip and prefixLen that is not a node. It does not
+// follow alias records. The ShardedBuilder calls it on its Tree before
+// grafting, which holds only what New inserted.
+func (t *Tree) coveringRecord(ip [16]byte, prefixLen int) (int, recordType) {
+	index := t.root
+	for depth := 0; depth < prefixLen; depth++ {
+		r := t.nodeAt(index).children[bitAt(ip, depth)]
+		if r.recordType != recordTypeNode && r.recordType != recordTypeFixedNode {
+			return depth + 1, r.recordType
+		}
+		index = r.nodeIndex
+	}
+	return prefixLen + 1, recordTypeNode
+}
+
+// shardFor returns the worker for the shard containing the network at ip and
+// prefixLen, assigning shards to workers round-robin as they are first seen.
+func (b *ShardedBuilder) shardFor(ip [16]byte, prefixLen int) int {
+	depth := min(b.shardDepth(ip, prefixLen), prefixLen)
+	key := shardKey{ip: maskedTreeAddr(ip, depth), depth: depth}
+	worker, ok := b.shards[key]
+	if !ok {
+		worker = len(b.shards) % len(b.workers)
+		b.shards[key] = worker
+	}
+	return worker
+}
+
+var errShardedBuilderDone = errors.New("the ShardedBuilder has already built its Tree")
+
+// Tree waits for the workers to finish and grafts their shards into one Tree.
+// If any insert failed, it returns an error joining every failure in the order
+// of the Insert calls and no Tree. With Options.ConflictPolicy set to
+// ConflictCollect, the Tree's conflicts are those of every worker, in the
+// order of the Insert calls, as TakeConflicts promises. A panic in an
+// inserter is raised again here. The ShardedBuilder cannot be used afterward.
+func (b *ShardedBuilder) Tree() (*Tree, error) {
+	if b.done {
+		return nil, errShardedBuilderDone
+	}
+	b.done = true
+	for _, w := range b.workers {
+		close(w.queue)
+	}
+	b.wg.Wait()
+
+	for _, w := range b.workers {
+		if w.panicked {
+			panic(w.panicValue)
+		}
+	}
+	tree, err := b.build()
+	// The workers' trees are discarded either way, as is the grafted tree
+	// on failure, so release any disk storage now rather than when they are
+	// garbage collected.
+	discarded := make([]*Tree, 0, len(b.workers)+1)
+	for _, w := range b.workers {
+		discarded = append(discarded, w.tree)
+	}
+	if tree == nil {
+		discarded = append(discarded, b.tree)
+	}
+	var closeErrs []error
+	for _, t := range discarded {
+		if closeErr := t.Close(); closeErr != nil {
+			closeErrs = append(closeErrs, closeErr)
+		}
+	}
+	b.workers = nil
+	if len(closeErrs) > 0 {
+		if tree != nil {
+			closeErrs = append(closeErrs, tree.Close())
+		}
+		return nil, errors.Join(append([]error{err}, closeErrs...)...)
+	}
+	return tree, err
+}
+
+// build reports the workers' insert errors or grafts their shards.
+func (b *ShardedBuilder) build() (*Tree, error) {
+	var errs []shardError
+	for _, w := range b.workers {
+		errs = append(errs, w.errs...)
+	}
+	if len(errs) > 0 {
+		slices.SortStableFunc(errs, compareShardErrors)
+		joined := make([]error, 0, len(errs))
+		for i, err := range errs {
+			// A network split into subnets can fail once per subnet.
+			if i > 0 && errs[i-1].seq == err.seq {
+				continue
+			}
+			joined = append(joined, err.err)
+		}
+		return nil, errors.Join(joined...)
+	}
+
+	t := b.tree
+	if err := t.finishInsertAudit(b.graft()); err != nil {
+		return nil, err
+	}
+	var conflicts []shardError
+	for _, w := range b.workers {
+		conflicts = append(conflicts, w.conflicts...)
+	}
+	// Each worker's conflicts are in its insert order, so a stable sort
+	// interleaves them into the order of the Insert calls.
+	slices.SortStableFunc(conflicts, compareShardErrors)
+	for _, conflict := range conflicts {
+		t.conflicts = append(t.conflicts, conflict.err)
+	}
+	return t, nil
+}
+
+func compareShardErrors(a, b shardError) int {
+	return cmp.Compare(a.seq, b.seq)
+}
+
+// graft replaces the record at each shard's network in the Tree with a copy
+// of the worker's record there, shallowest shards first, so a deeper shard,
+// such as one in the IPv4 subtree, is grafted below a shallower one containing
+// it. It then merges the records above the shards, deepest first, as Insert
+// merges them when its walk unwinds.
+func (b *ShardedBuilder) graft() error {
+	t := b.tree
+	keys := slices.Collect(maps.Keys(b.shards))
+	slices.SortFunc(keys, func(a, b shardKey) int {
+		return cmp.Or(cmp.Compare(a.depth, b.depth), bytes.Compare(a.ip[:], b.ip[:]))
+	})
+
+	copiers := make([]*shardCopier, len(b.workers))
+	for i, w := range b.workers {
+		copiers[i] = &shardCopier{
+			dst:        t,
+			src:        w.tree,
+			values:     map[valueRef]valueRef{},
+			provenance: map[nodeIndex]nodeIndex{},
+			ipv4Root:   noNodeIndex,
+		}
+	}
+	defer func() {
+		for _, c := range copiers {
+			for _, ref := range c.values {
+				t.valueStore.release(ref)
+			}
+		}
+	}()
+
+	above := map[*record]int{}
+	for _, key := range keys {
+		c := copiers[b.shards[key]]
+		src := c.src.recordAtDepth(key.ip, key.depth)
+		if src.recordType == recordTypeEmpty || src.recordType == recordTypeReserved ||
+			src.recordType == recordTypeAlias {
+			// No insert changed the shard, so the Tree already holds the
+			// same record.
+			continue
+		}
+		slot := t.graftSlot(key.ip, key.depth, above)
+		if slot == nil {
+			continue
+		}
+		copied, err := c.copyRecord(src, key.ip, key.depth)
+		if err != nil {
+			return err
+		}
+		*slot = copied
+	}
+
+	records := slices.Collect(maps.Keys(above))
+	slices.SortFunc(records, func(a, b *record) int {
+		return cmp.Compare(above[b], above[a])
+	})
+	merge := t.newInsertRecordRef(recordTypeData, insertResolver{}, noNodeIndex, nilValueRef)
+	for _, r := range records {
+		if r.recordType != recordTypeNode {
+			continue
+		}
+		if err := merge.maybeMergeChildren(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordAtDepth returns the record at depth on ip's path, or the shallower
+// record that is not a node and so covers the whole network there.
+func (t *Tree) recordAtDepth(ip [16]byte, depth int) record {
+	index := t.root
+	for d := range depth {
+		r := t.nodeAt(index).children[bitAt(ip, d)]
+		if d+1 == depth || (r.recordType != recordTypeNode && r.recordType != recordTypeFixedNode) {
+			return r
+		}
+		index = r.nodeIndex
+	}
+	return record{}
+}
+
+// graftSlot returns the record at depth on ip's path, adding nodes below the
+// empty records above it, and adds the node records above it to above with
+// their depths. It returns nil when a reserved or aliased network covers the
+// slot, since no insert can have changed it.
+func (t *Tree) graftSlot(ip [16]byte, depth int, above map[*record]int) *record {
+	index := t.root
+	for d := 0; ; d++ {
+		r := &t.nodeAt(index).children[bitAt(ip, d)]
+		if d+1 == depth {
+			if r.recordType == recordTypeReserved || r.recordType == recordTypeAlias {
+				return nil
+			}
+			return r
+		}
+		switch r.recordType {
+		case recordTypeEmpty:
+			*r = record{nodeIndex: t.newNode([2]record{}), recordType: recordTypeNode}
+		case recordTypeNode:
+			above[r] = d + 1
+		case recordTypeFixedNode:
+		default:
+			return nil
+		}
+		index = r.nodeIndex
+	}
+}
+
+// shardCopier copies records from a worker's tree into the built Tree. values
+// and provenance map the worker's value refs and provenance entries to the
+// Tree's, so each is translated once. values owns one reference to each
+// translated ref.
+type shardCopier struct {
+	dst        *Tree
+	src        *Tree
+	values     map[valueRef]valueRef
+	provenance map[nodeIndex]nodeIndex
+	// ipv4Root is dst's fixed node at ::/96, found on first use.
+	ipv4Root nodeIndex
+}
+
+// copyRecord returns a copy of r, src's record at ip and depth, with its nodes,
+// value, and provenance in dst. The fixed node at the root of the IPv4
+// subtree, and the aliases to it, refer to dst's own node instead, which
+// shards in the IPv4 subtree graft into.
+func (c *shardCopier) copyRecord(r record, ip [16]byte, depth int) (record, error) {
+	switch r.recordType {
+	case recordTypeData:
+		value, err := c.dst.valueStore.internFrom(c.src.valueStore, r.value, c.values)
+		if err != nil {
+			return record{}, err
+		}
+		provenance := noNodeIndex
+		if c.dst.trackProvenance && r.nodeIndex != noNodeIndex {
+			var ok bool
+			provenance, ok = c.provenance[r.nodeIndex]
+			if !ok {
+				provenance = c.dst.newProvenance(c.src.provenance[r.nodeIndex])
+				c.provenance[r.nodeIndex] = provenance
+			}
+		}
+		return record{value: value, nodeIndex: provenance, recordType: recordTypeData}, nil
+	case recordTypeNode:
+		n := c.src.nodeAt(r.nodeIndex)
+		var children [2]record
+		for i := range 2 {
+			childIP := ip
+			setBitAt(&childIP, depth, byte(i))
+			child, err := c.copyRecord(n.children[i], childIP, depth+1)
+			if err != nil {
+				return record{}, err
+			}
+			children[i] = child
+		}
+		return record{nodeIndex: c.dst.newNode(children), recordType: recordTypeNode}, nil
+	case recordTypeFixedNode, recordTypeAlias:
+		if c.ipv4Root == noNodeIndex {
+			c.ipv4Root = c.dst.recordAtDepth([16]byte{}, 96).nodeIndex
+		}
+		return record{nodeIndex: c.ipv4Root, recordType: r.recordType}, nil
+	case recordTypePath:
+		return record{}, errors.New("compressed path found after expandPaths")
+	default:
+		return r, nil
+	}
+}
@@ -0,0 +1,173 @@
+package mmdbwriter
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/maxmind/mmdbwriter/v2/inserter"
+	"github.com/maxmind/mmdbwriter/v2/mmdbtype"
+)
+
+// TestShardedBuilderMatchesInsert pins that ShardedBuilder builds the same
+// tree as repeated Insert for overlapping networks, including networks shorter
+// than a shard, networks containing the IPv4 subtree, and networks containing
+// reserved networks.
+func TestShardedBuilderMatchesInsert(t *testing.T) {
+	tests := []struct {
+		name      string
+		options   Options
+		shardOpts ShardOptions
+		// shortNetworks allows networks shorter than a shard, which record
+		// per-subnet provenance.
+		shortNetworks bool
+	}{
+		{
+			name:          "IPv4",
+			options:       Options{IPVersion: 4, IncludeReservedNetworks: true},
+			shardOpts:     ShardOptions{Workers: 3},
+			shortNetworks: true,
+		},
+		{
+			name:          "IPv4 with reserved",
+			options:       Options{IPVersion: 4},
+			shardOpts:     ShardOptions{Workers: 4, IPv4PrefixLength: 4, QueueSize: 1},
+			shortNetworks: true,
+		},
+		{
+			name:          "IPv6",
+			options:       Options{IPVersion: 6},
+			shardOpts:     ShardOptions{Workers: 5, IPv6PrefixLength: 8},
+			shortNetworks: true,
+		},
+		{
+			name: "IPv6 with deep merge",
+			options: Options{
+				IPVersion:               6,
+				IncludeReservedNetworks: true,
+				Inserter:                inserter.DeepMerge,
+			},
+			shardOpts:     ShardOptions{Workers: 2, IPv6PrefixLength: 6},
+			shortNetworks: true,
+		},
+		{
+			name:      "IPv6 with provenance",
+			options:   Options{IPVersion: 6, TrackProvenance: true},
+			shardOpts: ShardOptions{Workers: 4, IPv4PrefixLength: 4, IPv6PrefixLength: 8},
+		},
+		{
+			name:          "IPv4 with ConflictSkip",
+			options:       Options{IPVersion: 4, ConflictPolicy: ConflictSkip},
+			shardOpts:     ShardOptions{Workers: 2},
+			shortNetworks: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for seed := range uint64(10) {
+				test.options.BuildEpoch = 1
+				test.options.DatabaseType = "shard-test"
+				test.options.Description = map[string]string{"en": "Shard test"}
+				sequential, err := New(test.options)
+				require.NoError(t, err)
+				builder, err := NewShardedBuilder(test.options, test.shardOpts)
+				require.NoError(t, err)
+
+				for i, spec := range randomInsertSpecs(t, sequential, seed, test.shortNetworks) {
+					source := []string{"first", "second"}[i%2]
+					sequential.SetProvenanceSource(source)
+					builder.SetProvenanceSource(source)
+					require.NoError(t, sequential.Insert(spec.network, spec.value))
+					require.NoError(t, builder.Insert(spec.network, spec.value))
+				}
+				sharded, err := builder.Tree()
+				require.NoError(t, err)
+				require.Equal(t, writeTreeBytes(t, sequential), writeTreeBytes(t, sharded), "seed %d", seed)
+				if test.options.TrackProvenance {
+					r := rand.New(rand.NewPCG(seed, 0))
+					for range 100 {
+						addr := ipv4Addr(r.Uint32())
+						if r.IntN(2) == 0 {
+							addr = netip.AddrFrom16([16]byte{0x20, byte(r.IntN(4)), byte(r.IntN(256))})
+						}
+						wantPrefix, want, wantOK := sequential.Provenance(addr)
+						gotPrefix, got, gotOK := sharded.Provenance(addr)
+						assert.Equal(t, wantOK, gotOK, addr)
+						assert.Equal(t, wantPrefix, gotPrefix, addr)
+						assert.Equal(t, want, got, addr)
+					}
+				}
+				if seed == 0 {
+					checkWrittenTree(t, sharded)
+				}
+			}
+		})
+	}
+}
+
+// TestShardedBuilderReportsInsertErrors pins that Tree reports each failed
+// insert once, in Insert order, and returns no Tree.
+func TestShardedBuilderReportsInsertErrors(t *testing.T) {
+	builder, err := NewShardedBuilder(Options{IPVersion: 6}, ShardOptions{Workers: 2})
+	require.NoError(t, err)
+
+	value := mmdbtype.String("a")
+	require.NoError(t, builder.Insert(netip.MustParsePrefix("192.168.1.0/24"), value))
+	require.NoError(t, builder.Insert(netip.MustParsePrefix("2001:db9::/32"), value))
+	require.NoError(t, builder.Insert(netip.MustParsePrefix("10.0.0.0/9"), value))
+	require.Error(t, builder.Insert(netip.Prefix{}, value))
+
+	tree, err := builder.Tree()
+	require.Error(t, err)
+	assert.Nil(t, tree)
+	assert.Equal(t,
+		"inserting 192.168.1.0/24: attempt to insert 192.168.1.0/24 into 192.168.0.0/16, which is a reserved network\n"+
+			"inserting 10.0.0.0/9: attempt to insert 10.0.0.0/9 into 10.0.0.0/8, which is a reserved network",
+		err.Error(),
+	)
+
+	_, err = builder.Tree()
+	require.EqualError(t, err, "the ShardedBuilder has already built its Tree")
+	require.EqualError(t,
+		builder.Insert(netip.MustParsePrefix("1.0.0.0/8"), value),
+		"the ShardedBuilder has already built its Tree",
+	)
+}
+
+// TestShardedBuilderCollectsConflicts pins that the built Tree keeps the
+// conflicts the workers collected, in the order of the Insert calls.
+func TestShardedBuilderCollectsConflicts(t *testing.T) {
+	builder, err := NewShardedBuilder(
+		Options{IPVersion: 4, ConflictPolicy: ConflictCollect},
+		ShardOptions{Workers: 2},
+	)
+	require.NoError(t, err)
+
+	conflicting := []netip.Prefix{
+		netip.MustParsePrefix("192.168.1.0/24"),
+		netip.MustParsePrefix("10.1.0.0/16"),
+		netip.MustParsePrefix("172.16.1.0/24"),
+		netip.MustParsePrefix("10.2.0.0/16"),
+		netip.MustParsePrefix("192.168.2.0/24"),
+	}
+	// The shards are assigned to the workers in turn, so the 192.168.0.0/16
+	// and 172.16.0.0/12 conflicts are one worker's and the 10.0.0.0/8 ones
+	// the other's.
+	for _, prefix := range conflicting {
+		require.NoError(t, builder.Insert(prefix, mmdbtype.String("a")))
+	}
+	require.NoError(t, builder.Insert(netip.MustParsePrefix("1.1.1.0/24"), mmdbtype.String("b")))
+	tree, err := builder.Tree()
+	require.NoError(t, err)
+
+	var inserted []netip.Prefix
+	for _, conflict := range tree.TakeConflicts() {
+		var reservedErr *ReservedNetworkError
+		require.ErrorAs(t, conflict, &reservedErr)
+		inserted = append(inserted, reservedErr.InsertedNetwork)
+	}
+	assert.Equal(t, conflicting, inserted)
+}
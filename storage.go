@@ -0,0 +1,256 @@
+package mmdbwriter
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Storage selects where a Tree keeps its search tree nodes and the encoded
+// bytes of its values.
+type Storage int
+
+const (
+	// StorageMemory keeps the tree on the Go heap. It is the default.
+	StorageMemory Storage = iota
+	// StorageDisk keeps the node blocks, the compressed insertion paths, and
+	// the value-store arenas in memory-mapped temporary files, so the
+	// operating system can page them out and a tree larger than memory
+	// degrades to disk speed instead of exhausting it. The per-value
+	// bookkeeping, the provenance table, and lookup views stay on the heap.
+	//
+	// The files are created in Options.StorageDir and removed as soon as they
+	// are open, so nothing is left behind if the process dies. Call
+	// Tree.Close to release the mappings and the disk space. Otherwise they
+	// are held until the process exits. Disk storage is supported only on
+	// Linux, macOS, and the BSDs.
+	//
+	// On Linux the file space is allocated before it is used, so a full file
+	// system is reported when the space is needed: as an insert error for
+	// value data, and as a panic for nodes and compressed paths, which are
+	// allocated where an insert cannot fail. Elsewhere the files are sparse,
+	// and a full file system can instead crash the process when a page is
+	// first written.
+	StorageDisk
+)
+
+const (
+	// nodeSegmentBlocks is the number of node blocks mapped at a time. Node
+	// blocks must never move, so each segment is a separate mapping, and a
+	// large segment keeps the mapping count low.
+	nodeSegmentBlocks = 256
+	// minMappedArenaSize is the smallest mapping of a growable arena, in
+	// bytes. It is a multiple of every supported page size.
+	minMappedArenaSize = 1 << 20
+)
+
+// initStorage allocates the root node block of a new tree in the storage
+// opts selects.
+func (t *Tree) initStorage(opts Options) error {
+	switch opts.Storage {
+	case StorageMemory:
+		t.nodeBlocks = [][]node{make([]node, nodeBlockSize)}
+		return nil
+	case StorageDisk:
+		return t.useDiskStorage(opts.StorageDir)
+	default:
+		return fmt.Errorf("unsupported Storage: %d", opts.Storage)
+	}
+}
+
+// useDiskStorage moves the empty tree's nodes, paths, and value arenas to
+// disk storage in dir.
+func (t *Tree) useDiskStorage(dir string) error {
+	storage, err := newDiskStorage(dir)
+	if err != nil {
+		return err
+	}
+	block, err := storage.nodeBlock()
+	if err != nil {
+		return errors.Join(err, storage.close())
+	}
+	t.storage = storage
+	t.nodeBlocks = [][]node{block}
+	t.valueStore.payloads.file = storage.payloads
+	t.valueStore.children.file = storage.children
+	return nil
+}
+
+// Close releases the temporary files of a Tree created with StorageDisk, and
+// the value arenas the Tree shares with the trees it was cloned from or into,
+// which can then reuse the space freed there. The Tree must not be used
+// afterward. For a Tree kept in memory, Close is optional: the garbage
+// collector reclaims its memory, and an arena it shares stops being shared
+// once the other tree grows it.
+//
+// There is no finalizer to close a forgotten Tree. Code working on a Tree's
+// nodes or arenas can outlive its last reference to the Tree itself, and a
+// finalizer could unmap memory still in use.
+func (t *Tree) Close() error {
+	err := errors.Join(t.valueStore.payloads.leave(), t.valueStore.children.leave())
+	t.valueStore.payloads = byteArena{}
+	t.valueStore.children = refArena{}
+	if t.storage == nil {
+		return err
+	}
+	err = errors.Join(err, t.storage.close())
+	t.storage = nil
+	t.nodeBlocks = nil
+	t.nodeCountAllocated = 0
+	t.paths = nil
+	return err
+}
+
+// closeAfter closes a Tree that New is abandoning because of err.
+func (t *Tree) closeAfter(err error) error {
+	if closeErr := t.Close(); closeErr != nil {
+		return errors.Join(err, closeErr)
+	}
+	return err
+}
+
+// diskStorage holds the files of a Tree created with StorageDisk.
+type diskStorage struct {
+	// dir is the directory the files were created in.
+	dir      string
+	nodes    *mappedFile
+	paths    *mappedFile
+	payloads *mappedFile
+	children *mappedFile
+	// nodeSegment is the unused remainder of the last mapped node segment.
+	nodeSegment []node
+}
+
+func newDiskStorage(dir string) (*diskStorage, error) {
+	if !mmapSupported {
+		return nil, errors.New("StorageDisk is not supported on this platform")
+	}
+	s := &diskStorage{dir: dir}
+	for _, file := range []**mappedFile{&s.nodes, &s.paths, &s.payloads, &s.children} {
+		f, err := newMappedFile(dir)
+		if err != nil {
+			return nil, errors.Join(err, s.close())
+		}
+		*file = f
+	}
+	return s, nil
+}
+
+// nodeBlock returns a new block of nodeBlockSize zeroed nodes.
+func (s *diskStorage) nodeBlock() ([]node, error) {
+	if len(s.nodeSegment) == 0 {
+		length := nodeSegmentBlocks * nodeBlockSize * int(unsafe.Sizeof(node{}))
+		data, err := s.nodes.mapRange(s.nodes.size, length)
+		if err != nil {
+			return nil, err
+		}
+		s.nodeSegment = mappedSlice[node](data)
+	}
+	block := s.nodeSegment[:nodeBlockSize:nodeBlockSize]
+	s.nodeSegment = s.nodeSegment[nodeBlockSize:]
+	return block, nil
+}
+
+// close unmaps and closes the files. It is safe to call more than once.
+func (s *diskStorage) close() error {
+	var errs []error
+	for _, file := range []**mappedFile{&s.nodes, &s.paths, &s.payloads, &s.children} {
+		if *file != nil {
+			errs = append(errs, (*file).close())
+			*file = nil
+		}
+	}
+	s.nodeSegment = nil
+	return errors.Join(errs...)
+}
+
+// mappedFile is an unlinked temporary file and its mappings. A mapping stays
+// valid until the last close, even after a larger one replaces it, so a slice
+// of an arena taken before the arena grew can still be read.
+type mappedFile struct {
+	file     *os.File
+	mappings [][]byte
+	// size is the allocated length of the file.
+	size int
+	// refs counts the holders of the file: its tree's storage, and the
+	// clones whose value arenas still read its mappings.
+	refs atomic.Int32
+}
+
+func newMappedFile(dir string) (*mappedFile, error) {
+	f, err := os.CreateTemp(dir, "mmdbwriter-*")
+	if err != nil {
+		return nil, fmt.Errorf("creating tree storage file: %w", err)
+	}
+	if err := os.Remove(f.Name()); err != nil {
+		return nil, errors.Join(fmt.Errorf("removing tree storage file: %w", err), f.Close())
+	}
+	m := &mappedFile{file: f}
+	m.refs.Store(1)
+	return m, nil
+}
+
+func (m *mappedFile) retain() {
+	m.refs.Add(1)
+}
+
+// mapRange grows the file to cover length bytes at offset, which must be a
+// multiple of the page size, and maps them.
+func (m *mappedFile) mapRange(offset, length int) ([]byte, error) {
+	if end := offset + length; end > m.size {
+		if err := allocateFile(m.file, m.size, end); err != nil {
+			return nil, fmt.Errorf("growing tree storage file: %w", err)
+		}
+		m.size = end
+	}
+	data, err := mapFile(m.file, offset, length)
+	if err != nil {
+		return nil, fmt.Errorf("mapping tree storage file: %w", err)
+	}
+	m.mappings = append(m.mappings, data)
+	return data, nil
+}
+
+// close releases a reference to the file, and unmaps and closes it with the
+// last one.
+func (m *mappedFile) close() error {
+	if m.refs.Add(-1) > 0 {
+		return nil
+	}
+	var errs []error
+	for _, data := range m.mappings {
+		errs = append(errs, unmapFile(data))
+	}
+	m.mappings = nil
+	errs = append(errs, m.file.Close())
+	return errors.Join(errs...)
+}
+
+// growMapped returns data with room to append n more elements without
+// reallocating. If data is backed by m, it remaps the whole file at a larger
+// size, doubling it at least, and returns the same elements in the new
+// mapping. A nil m leaves data to append's own growth.
+func growMapped[T any](m *mappedFile, data []T, n int) ([]T, error) {
+	if m == nil || len(data)+n <= cap(data) {
+		return data, nil
+	}
+	elemSize := int(unsafe.Sizeof(*new(T)))
+	size := max(2*m.size, minMappedArenaSize)
+	for size < (len(data)+n)*elemSize {
+		size *= 2
+	}
+	mapped, err := m.mapRange(0, size)
+	if err != nil {
+		return nil, err
+	}
+	return mappedSlice[T](mapped)[:len(data)], nil
+}
+
+// mappedSlice views mapped bytes as elements of T, which must not contain
+// pointers, since the garbage collector does not scan mappings.
+func mappedSlice[T any](data []byte) []T {
+	elemSize := int(unsafe.Sizeof(*new(T)))
+	return unsafe.Slice((*T)(unsafe.Pointer(unsafe.SliceData(data))), len(data)/elemSize)
+}
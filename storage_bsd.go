@@ -0,0 +1,11 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package mmdbwriter
+
+import "os"
+
+// allocateFile extends f from size bytes to newSize bytes. The extension is
+// sparse, so disk space is allocated only as the mapping is written.
+func allocateFile(f *os.File, _, newSize int) error {
+	return f.Truncate(int64(newSize))
+}
@@ -0,0 +1,18 @@
+package mmdbwriter
+
+import (
+	"os"
+	"syscall"
+)
+
+// allocateFile extends f from size bytes to newSize bytes. fallocate reserves
+// the disk space now, so a full file system is reported here rather than by a
+// SIGBUS when the mapping is first written.
+func allocateFile(f *os.File, size, newSize int) error {
+	return syscall.Fallocate(
+		int(f.Fd()), //nolint:gosec // file descriptors fit in an int
+		0,
+		int64(size),
+		int64(newSize-size),
+	)
+}
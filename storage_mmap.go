@@ -0,0 +1,24 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package mmdbwriter
+
+import (
+	"os"
+	"syscall"
+)
+
+const mmapSupported = true
+
+func mapFile(f *os.File, offset, length int) ([]byte, error) {
+	return syscall.Mmap(
+		int(f.Fd()), //nolint:gosec // file descriptors fit in an int
+		int64(offset),
+		length,
+		syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_SHARED,
+	)
+}
+
+func unmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
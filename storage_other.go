@@ -0,0 +1,24 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package mmdbwriter
+
+import (
+	"errors"
+	"os"
+)
+
+const mmapSupported = false
+
+var errMmapUnsupported = errors.New("memory-mapped files are not supported on this platform")
+
+func mapFile(*os.File, int, int) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func unmapFile([]byte) error {
+	return errMmapUnsupported
+}
+
+func allocateFile(*os.File, int, int) error {
+	return errMmapUnsupported
+}
@@ -0,0 +1,136 @@
+package mmdbwriter
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/maxmind/mmdbwriter/v2/inserter"
+	"github.com/maxmind/mmdbwriter/v2/mmdbtype"
+)
+
+// TestDiskStorageMatchesMemory pins that a tree kept on disk writes the same
+// file as one kept in memory, and that its storage files are never visible in
+// StorageDir.
+func TestDiskStorageMatchesMemory(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+	}{
+		{"IPv4", Options{IPVersion: 4}},
+		{"IPv6", Options{IPVersion: 6}},
+		{"IPv6 with provenance", Options{IPVersion: 6, TrackProvenance: true}},
+		{"IPv6 with deep merge", Options{IPVersion: 6, Inserter: inserter.DeepMerge}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			test.options.BuildEpoch = 1
+			test.options.DatabaseType = "storage-test"
+			test.options.Description = map[string]string{"en": "Storage test"}
+			memory, err := New(test.options)
+			require.NoError(t, err)
+			diskOptions := test.options
+			diskOptions.Storage = StorageDisk
+			diskOptions.StorageDir = dir
+			disk, err := New(diskOptions)
+			require.NoError(t, err)
+
+			for _, spec := range randomInsertSpecs(t, memory, 1, true) {
+				require.NoError(t, memory.Insert(spec.network, spec.value))
+				require.NoError(t, disk.Insert(spec.network, spec.value))
+			}
+			written := writeTreeBytes(t, memory)
+			require.Equal(t, written, writeTreeBytes(t, disk))
+			checkWrittenTree(t, disk)
+
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			assert.Empty(t, entries)
+
+			path := filepath.Join(t.TempDir(), "tree.mmdb")
+			require.NoError(t, os.WriteFile(path, written, 0o600))
+			loaded, err := Load(path, diskOptions)
+			require.NoError(t, err)
+			assert.Equal(t, written, writeTreeBytes(t, loaded))
+
+			require.NoError(t, disk.Close())
+			require.NoError(t, disk.Close())
+			require.NoError(t, loaded.Close())
+		})
+	}
+}
+
+// TestDiskStorageGrows pins that disk storage keeps nodes and values intact
+// while it maps more node segments and remaps its arenas at larger sizes.
+func TestDiskStorageGrows(t *testing.T) {
+	opts := Options{
+		IPVersion:               6,
+		DatabaseType:            "storage-test",
+		Description:             map[string]string{"en": "Storage test"},
+		IncludeReservedNetworks: true,
+		Storage:                 StorageDisk,
+		StorageDir:              t.TempDir(),
+	}
+	tree, err := New(opts)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, tree.Close()) }()
+
+	const count = 40000
+	for i := range uint32(count) {
+		network := netip.PrefixFrom(ipv4Addr(i*214013+2531011), 32)
+		value := mmdbtype.Map{
+			"index":   mmdbtype.Uint32(i),
+			"payload": mmdbtype.String(fmt.Sprintf("%0100d", i)),
+			"tags":    mmdbtype.Slice{mmdbtype.Uint32(i), mmdbtype.Uint32(i + 1)},
+		}
+		require.NoError(t, tree.Insert(network, value))
+	}
+	require.Greater(t, tree.nodeCountAllocated, nodeSegmentBlocks*nodeBlockSize)
+	require.Greater(t, len(tree.valueStore.payloads.data), minMappedArenaSize)
+
+	for i := range uint32(count) {
+		network, value := tree.Get(ipv4Addr(i*214013 + 2531011))
+		require.Equal(t, 32, network.Bits())
+		require.Equal(t, mmdbtype.Uint32(i), value.(mmdbtype.Map)["index"])
+	}
+	checkWrittenTree(t, tree)
+}
+
+// TestShardedBuilderDiskStorage pins that a ShardedBuilder can build a tree
+// kept on disk.
+func TestShardedBuilderDiskStorage(t *testing.T) {
+	opts := Options{
+		IPVersion:    6,
+		BuildEpoch:   1,
+		DatabaseType: "storage-test",
+		Description:  map[string]string{"en": "Storage test"},
+	}
+	sequential, err := New(opts)
+	require.NoError(t, err)
+	opts.Storage = StorageDisk
+	opts.StorageDir = t.TempDir()
+	builder, err := NewShardedBuilder(opts, ShardOptions{Workers: 3})
+	require.NoError(t, err)
+	for _, spec := range randomInsertSpecs(t, sequential, 2, true) {
+		require.NoError(t, sequential.Insert(spec.network, spec.value))
+		require.NoError(t, builder.Insert(spec.network, spec.value))
+	}
+	sharded, err := builder.Tree()
+	require.NoError(t, err)
+	assert.Equal(t, writeTreeBytes(t, sequential), writeTreeBytes(t, sharded))
+	require.NoError(t, sharded.Close())
+}
+
+func TestUnsupportedStorage(t *testing.T) {
+	_, err := New(Options{Storage: Storage(2)})
+	require.EqualError(t, err, "unsupported Storage: 2")
+
+	_, err = New(Options{Storage: StorageDisk, StorageDir: filepath.Join(t.TempDir(), "missing")})
+	require.ErrorContains(t, err, "creating tree storage file")
+}
@@ -4,15 +4,20 @@ package mmdbwriter
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"iter"
+	"maps"
 	"math"
 	"net/netip"
 	"os"
+	"slices"
 	"time"
 
 	"github.com/oschwald/maxminddb-golang/v2"
+	"github.com/oschwald/maxminddb-golang/v2/mmdbdata"
 	"go4.org/netipx"
 
 	"github.com/maxmind/mmdbwriter/v2/inserter"
@@ -44,6 +49,15 @@ type Options struct {
 	// ::ffff:0:0/96.
 	DisableIPv4Aliasing bool
 
+	// IPv4Aliases replaces the default IPv6 networks aliased to the IPv4
+	// subtree in an IPv6 tree. A nil slice selects DefaultIPv4Aliases, and an
+	// empty non-nil slice keeps the IPv4 subtree at ::/96 but aliases nothing
+	// to it. Each alias must be an IPv6 network no longer than /96 that
+	// overlaps neither ::/96 nor another alias. For example, appending
+	// 64:ff9b::/96 adds the NAT64 well-known prefix. It is ignored for IPv4
+	// trees and when DisableIPv4Aliasing is set.
+	IPv4Aliases []netip.Prefix
+
 	// IncludeReservedNetworks will allow reserved networks to be added to the
 	// database.
 	//
@@ -54,6 +68,20 @@ type Options struct {
 	// Teredo, may still be added.
 	IncludeReservedNetworks bool
 
+	// ReservedNetworks replaces the default list of reserved networks when
+	// IncludeReservedNetworks is false. A nil slice selects
+	// DefaultReservedNetworks for the tree's IP version, and an empty non-nil
+	// slice reserves nothing. To allow one default network, such as
+	// 100.64.0.0/10, filter it out of DefaultReservedNetworks and pass the
+	// rest. IPv4 networks in an IPv6 tree are reserved in the IPv4 subtree.
+	ReservedNetworks []netip.Prefix
+
+	// ConflictPolicy selects how inserts handle networks inside a reserved or
+	// aliased network: return an error, the default, skip the conflicting
+	// portion, or skip it and record the conflict for Tree.TakeConflicts. It
+	// applies to every insert method and to Load.
+	ConflictPolicy ConflictPolicy
+
 	// IPVersion indicates whether an IPv4 or IPv6 database should be built. An
 	// IPv6 database supports both IPv4 and IPv6 lookups. The default value is
 	// "6" for IPv6.
@@ -71,12 +99,23 @@ type Options struct {
 	// The default is 28.
 	RecordSize int
 
+	// PreserveMetadata makes Load keep the source database's build_epoch,
+	// binary_format_minor_version, and any metadata keys this writer does not
+	// set itself, writing them back verbatim, including a build_epoch of zero.
+	// A nonzero BuildEpoch still takes precedence. New ignores it.
+	PreserveMetadata bool
+
 	// DisableMetadataPointers prevents the use of pointers in the metadata
 	// section of the database. This option exists to avoid bugs in reader
 	// implementations that do not correctly handle metadata pointers. Its
 	// use should primarily be limited to existing database types.
 	DisableMetadataPointers bool
 
+	// MapKeyOrder selects the order in which WriteTo writes the keys of the
+	// maps in the data section. The zero value writes them in lexical order.
+	// It does not apply to the metadata.
+	MapKeyOrder MapKeyOrder
+
 	// RefcountAudit makes this tree audit its value-store reference counts
 	// after every insert that reaches the value store, including failed
 	// inserts, and after every successful load. The audit is a debugging tool.
@@ -87,6 +126,34 @@ type Options struct {
 	// tree in the process.
 	RefcountAudit bool
 
+	// TrackProvenance makes the tree remember, for every data record, the
+	// inserted network that established its value and the tag set with
+	// Tree.SetProvenanceSource at the time. InsertFunc and InsertRangeFunc
+	// callbacks receive it as inserter.Metadata.ExistingProvenance, and
+	// Tree.Provenance looks it up by address. Provenance is never written to
+	// the database, and tracking it does not change the written file.
+	//
+	// A value established by an insert keeps that insert's provenance until a
+	// later insert changes the value, so an insert that resolves to the
+	// existing value leaves it alone.
+	//
+	// Sibling records with equal values but different provenance are kept
+	// apart, so Get can report narrower networks than in an untracked tree,
+	// and the tree can hold more nodes. WriteTo merges them as an untracked
+	// tree would. The tree also keeps one entry per inserted network, or per
+	// decomposed subnet of a range, until it is discarded.
+	TrackProvenance bool
+
+	// Storage selects where the tree keeps its nodes and encoded values. The
+	// default, StorageMemory, keeps them on the heap. StorageDisk places them
+	// in memory-mapped temporary files for trees larger than memory. Inserts
+	// and WriteTo behave the same either way.
+	Storage Storage
+
+	// StorageDir is the directory for StorageDisk's temporary files. The
+	// default is os.TempDir. It is ignored for StorageMemory.
+	StorageDir string
+
 	// Inserter is the pure function used by Insert, InsertRange, and Load.
 	// Leaving it nil is equivalent to inserter.Replace, which replaces any
 	// conflicting old value entirely with the new, and allows Insert and
@@ -117,9 +184,19 @@ type Tree struct {
 	valueStore              *valueStore
 	description             map[string]string
 	disableMetadataPointers bool
+	mapKeyOrder             MapKeyOrder
 	ipVersion               int
 	languages               []string
 	recordSize              int
+	// ipv4Aliases is the masked list of networks New aliased to the IPv4
+	// subtree.
+	ipv4Aliases []netip.Prefix
+	// reservedNetworks is the masked list of networks New reserved.
+	reservedNetworks []netip.Prefix
+	// extraMetadata holds metadata keys outside the standard set, written back
+	// verbatim. Load fills it when Options.PreserveMetadata is set.
+	extraMetadata            mmdbtype.Map
+	binaryFormatMinorVersion int
 	// nodeBlocks is an append-only arena split into fixed-size blocks. Blocks
 	// preserve pointer stability during inserts but grow monotonically; merged
 	// or abandoned nodes are not reclaimed until the Tree is discarded.
@@ -128,6 +205,9 @@ type Tree struct {
 	// nodeNumbers and nodeCount are invalidated by mutation and rebuilt lazily
 	// by finalize before writing.
 	nodeNumbers []int
+	// collapsedValues is indexed like nodeNumbers. finalize fills it for a
+	// provenance-tracking tree, whose equal sibling records can stay unmerged.
+	collapsedValues []valueRef
 	// paths is an append-only arena for compressed sparse insertion paths. Path
 	// entries are not reclaimed after materialization.
 	paths     []compressedPath
@@ -136,6 +216,19 @@ type Tree struct {
 
 	nodeCount int
 	inserter  inserter.PureFunc
+	// conflictPolicy applies only to data inserts. New sets it after it has
+	// inserted the aliases and reserved networks, so a conflict among those
+	// is always an error.
+	conflictPolicy ConflictPolicy
+	conflicts      []error
+	// provenance is an append-only table indexed by the nodeIndex of data
+	// records. It is used only when trackProvenance is set.
+	provenance       []inserter.Provenance
+	provenanceSource string
+	trackProvenance  bool
+	// storage holds the files of a tree created with StorageDisk, and is nil
+	// for one kept in memory.
+	storage *diskStorage
 	// refcountAudit runs the full ownership audit after every insert that
 	// reaches the value store and after every successful load. New sets it from
 	// Options.RefcountAudit or the MMDBWRITER_REFCOUNT_AUDIT environment variable.
@@ -151,9 +244,9 @@ func New(opts Options) (*Tree, error) {
 		disableMetadataPointers: opts.DisableMetadataPointers,
 		ipVersion:               6,
 		recordSize:              28,
-		nodeBlocks:              [][]node{make([]node, nodeBlockSize)},
 		nodeCountAllocated:      1,
 		root:                    rootNodeIndex,
+		trackProvenance:         opts.TrackProvenance,
 		refcountAudit: opts.RefcountAudit ||
 			os.Getenv("MMDBWRITER_REFCOUNT_AUDIT") != "",
 	}
@@ -204,19 +297,47 @@ func New(opts Options) (*Tree, error) {
 		return nil, fmt.Errorf("BuildEpoch must not be negative: %d", tree.buildEpoch)
 	}
 
+	switch opts.ConflictPolicy {
+	case ConflictError, ConflictSkip, ConflictCollect:
+	default:
+		return nil, fmt.Errorf("unsupported ConflictPolicy: %d", opts.ConflictPolicy)
+	}
+
+	if err := opts.MapKeyOrder.validate(); err != nil {
+		return nil, err
+	}
+	tree.mapKeyOrder = MapKeyOrder{
+		Priority:    slices.Clone(opts.MapKeyOrder.Priority),
+		ByFrequency: opts.MapKeyOrder.ByFrequency,
+	}
+
+	if err := tree.initStorage(opts); err != nil {
+		return nil, err
+	}
+
 	if tree.ipVersion == 6 && !opts.DisableIPv4Aliasing {
-		if err := tree.insertIPv4Aliases(); err != nil {
-			return nil, err
+		aliases := opts.IPv4Aliases
+		if aliases == nil {
+			aliases = DefaultIPv4Aliases()
+		}
+		if err := tree.insertIPv4Aliases(aliases); err != nil {
+			return nil, tree.closeAfter(err)
 		}
 	}
 
 	if !opts.IncludeReservedNetworks {
-		err := tree.insertReservedNetworks()
+		networks := opts.ReservedNetworks
+		if networks == nil {
+			networks = DefaultReservedNetworks(tree.ipVersion)
+		}
+		err := tree.insertReservedNetworks(networks)
 		if err != nil {
-			return nil, err
+			return nil, tree.closeAfter(err)
 		}
 	}
 
+	tree.conflictPolicy = opts.ConflictPolicy
+
 	return tree, nil
 }
 
@@ -241,6 +362,11 @@ func metadataDimension(name string, value uint) (int, error) {
 // Options.Inserter also receives a materialized view of each decoded
 // record. The inserter must treat its value arguments as immutable and must copy
 // a value before modifying it.
+//
+// Load copies the database type, description, IP version, languages, and
+// record size from the source metadata unless opts sets them. The build epoch
+// resets to the load time and other metadata keys are dropped, unless
+// Options.PreserveMetadata is set.
 func Load(path string, opts Options) (*Tree, error) {
 	db, err := maxminddb.Open(path)
 	if err != nil {
@@ -275,10 +401,42 @@ func Load(path string, opts Options) (*Tree, error) {
 		}
 	}
 
+	// New replaces a zero BuildEpoch with the current time, so the source
+	// epoch is copied after New, where a source epoch of zero survives too.
+	preserveEpoch := opts.PreserveMetadata && opts.BuildEpoch == 0
+	var extraMetadata mmdbtype.Map
+	if opts.PreserveMetadata {
+		if preserveEpoch && metadata.BuildEpoch > math.MaxInt64 {
+			return nil, fmt.Errorf(
+				"loading %s: build_epoch %d in metadata is too large",
+				path,
+				metadata.BuildEpoch,
+			)
+		}
+		extraMetadata, err = readExtraMetadata(path)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %w", path, err)
+		}
+	}
+
 	tree, err := New(opts)
 	if err != nil {
 		return nil, fmt.Errorf("creating tree for %s: %w", path, err)
 	}
+	if opts.PreserveMetadata {
+		if metadata.BinaryFormatMinorVersion > math.MaxUint16 {
+			return nil, fmt.Errorf(
+				"loading %s: unsupported binary_format_minor_version in metadata: %d",
+				path,
+				metadata.BinaryFormatMinorVersion,
+			)
+		}
+		tree.extraMetadata = extraMetadata
+		tree.binaryFormatMinorVersion = int(metadata.BinaryFormatMinorVersion)
+	}
+	if preserveEpoch {
+		tree.buildEpoch = int64(metadata.BuildEpoch)
+	}
 
 	// The decoder interns records straight into the value store. It caches
 	// one reference per source data offset, so shared records decode once.
@@ -323,6 +481,67 @@ func Load(path string, opts Options) (*Tree, error) {
 	return tree, nil
 }
 
+// metadataMaxSize is the largest metadata section the format permits. The
+// section is at the end of the file, so reading this much of the tail is
+// enough to find it.
+const metadataMaxSize = 128 * 1024
+
+// standardMetadataKeys are the metadata keys writeMetadata always sets.
+// Anything else in a source database is an extra key.
+var standardMetadataKeys = []mmdbtype.String{
+	"binary_format_major_version",
+	"binary_format_minor_version",
+	"build_epoch",
+	"database_type",
+	"description",
+	"ip_version",
+	"languages",
+	"node_count",
+	"record_size",
+}
+
+// readExtraMetadata decodes the metadata section of the database at path and
+// returns the keys outside standardMetadataKeys. The reader exposes only the
+// standard keys, so the section is located and decoded here.
+func readExtraMetadata(path string) (mmdbtype.Map, error) {
+	file, err := os.Open(path) //nolint:gosec // the caller chose the path
+	if err != nil {
+		return nil, fmt.Errorf("opening metadata: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("reading metadata: %w", err)
+	}
+	size := min(info.Size(), metadataMaxSize)
+	buf := make([]byte, size)
+	if _, err := file.ReadAt(buf, info.Size()-size); err != nil {
+		return nil, fmt.Errorf("reading metadata: %w", err)
+	}
+	start := bytes.LastIndex(buf, metadataStartMarker)
+	if start == -1 {
+		return nil, errors.New("metadata start marker not found")
+	}
+
+	unmarshaler := mmdbtype.NewUnmarshaler()
+	decoder := mmdbdata.NewDecoder(buf[start+len(metadataStartMarker):], 0)
+	if err := unmarshaler.UnmarshalMaxMindDB(decoder); err != nil {
+		return nil, fmt.Errorf("decoding metadata: %w", err)
+	}
+	metadata, ok := unmarshaler.Result().(mmdbtype.Map)
+	if !ok {
+		return nil, fmt.Errorf("metadata is a %T, not a Map", unmarshaler.Result())
+	}
+	for _, key := range standardMetadataKeys {
+		delete(metadata, key)
+	}
+	if len(metadata) == 0 {
+		return nil, nil
+	}
+	return metadata, nil
+}
+
 func (t *Tree) normalizeLoadPrefix(prefix netip.Prefix) (netip.Prefix, error) {
 	// Database readers should already return valid, masked prefixes. Only
 	// normalize mapped IPv4 prefixes so loaded data follows Insert semantics.
@@ -503,17 +722,31 @@ func (t *Tree) insertPrepared(
 	prefix netip.Prefix,
 	iRec *insertRecord,
 ) error {
+	t.targetInsert(prefix, iRec)
+	if iRec.recordType == recordTypeData {
+		iRec.provenance = t.insertProvenance(prefix)
+	}
+	return iRec.insertNode(t.root, 0)
+}
+
+// targetInsert points iRec at prefix before a walk.
+func (t *Tree) targetInsert(prefix netip.Prefix, iRec *insertRecord) {
 	// Any insert can change the reachable node graph, so cached finalization
 	// state must be rebuilt before the next write.
-	t.nodeCount = 0
-	t.nodeNumbers = nil
+	t.resetFinalized()
 
 	ip, prefixLen := t.prefixInsertIP(prefix)
 	iRec.ip = ip
 	iRec.prefixLen = prefixLen
 	iRec.splitDepth = 0
 	iRec.insertedAs4 = prefix.Addr().Is4()
-	return iRec.insertNode(t.root, 0)
+}
+
+// resetFinalized discards the state finalize caches for writing.
+func (t *Tree) resetFinalized() {
+	t.nodeCount = 0
+	t.nodeNumbers = nil
+	t.collapsedValues = nil
 }
 
 func (t *Tree) newInsertRecord(
@@ -556,6 +789,7 @@ func (t *Tree) newInsertRecordRef(
 		recordType:   recordType,
 		resolver:     resolver,
 		insertedNode: node,
+		provenance:   noNodeIndex,
 		tree:         t,
 		value:        ref,
 
@@ -800,17 +1034,8 @@ func (t *Tree) insertRange(
 	return t.finishInsert(iRec, err)
 }
 
-func (t *Tree) insertStringNetwork(
-	network string,
-	recordType recordType,
-	node nodeIndex,
-) error {
-	prefix, err := netip.ParsePrefix(network)
-	if err != nil {
-		return fmt.Errorf("parsing network (%s): %w", network, err)
-	}
-	return t.insert(prefix, recordType, insertResolver{}, node, nil)
-}
+// ipv4Root is the IPv4 subtree of an IPv6 tree.
+var ipv4Root = netip.MustParsePrefix("::/96")
 
 var ipv4AliasNetworks = []string{
 	"::ffff:0:0/96",
@@ -818,45 +1043,157 @@ var ipv4AliasNetworks = []string{
 	"2002::/16",
 }
 
-func (t *Tree) insertIPv4Aliases() error {
-	ipv4Root, err := netip.ParsePrefix("::/96")
-	if err != nil {
-		return fmt.Errorf("parsing IPv4 root: %w", err)
+// DefaultIPv4Aliases returns the networks an IPv6 tree aliases to its IPv4
+// subtree when Options.IPv4Aliases is nil: IPv4-mapped addresses, Teredo, and
+// 6to4. The result is a fresh slice the caller may modify.
+func DefaultIPv4Aliases() []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(ipv4AliasNetworks))
+	for _, network := range ipv4AliasNetworks {
+		prefixes = append(prefixes, netip.MustParsePrefix(network))
+	}
+	return prefixes
+}
+
+func validateIPv4Aliases(aliases []netip.Prefix) error {
+	for index, alias := range aliases {
+		if !alias.IsValid() {
+			return errors.New("IPv4 alias network is invalid")
+		}
+		if alias.Addr().Is4() {
+			return fmt.Errorf("IPv4 alias network %s is not an IPv6 network", alias)
+		}
+		if alias.Bits() > 96 {
+			return fmt.Errorf(
+				"IPv4 alias network %s is longer than /96 and cannot hold an IPv4 address",
+				alias,
+			)
+		}
+		if alias.Overlaps(ipv4Root) {
+			return fmt.Errorf("IPv4 alias network %s overlaps the IPv4 subtree %s", alias, ipv4Root)
+		}
+		for _, other := range aliases[:index] {
+			if alias.Overlaps(other) {
+				return fmt.Errorf("IPv4 alias networks %s and %s overlap", other, alias)
+			}
+		}
+	}
+	return nil
+}
+
+func (t *Tree) insertIPv4Aliases(aliases []netip.Prefix) error {
+	if err := validateIPv4Aliases(aliases); err != nil {
+		return err
 	}
 
 	ipv4RootNode := t.newNode([2]record{})
 
 	// Make ::/96, the IPv4 root, a fixed node.
-	err = t.insert(ipv4Root, recordTypeFixedNode, insertResolver{}, ipv4RootNode, nil)
+	err := t.insert(ipv4Root, recordTypeFixedNode, insertResolver{}, ipv4RootNode, nil)
 	if err != nil {
 		return err
 	}
 
-	for _, network := range ipv4AliasNetworks {
-		err := t.insertStringNetwork(network, recordTypeAlias, ipv4RootNode)
+	t.ipv4Aliases = make([]netip.Prefix, 0, len(aliases))
+	for _, alias := range aliases {
+		err := t.insert(alias, recordTypeAlias, insertResolver{}, ipv4RootNode, nil)
 		if err != nil {
-			return err
+			return fmt.Errorf("inserting IPv4 alias network %s: %w", alias, err)
 		}
+		t.ipv4Aliases = append(t.ipv4Aliases, alias.Masked())
 	}
 	return nil
 }
 
-func (t *Tree) insertReservedNetworks() error {
-	// the reserved networks are in reserved.go
-	networks := reservedNetworksIPv4
-	if t.ipVersion == 6 {
-		networks = append(networks, reservedNetworksIPv6...)
-	}
+// IPv4Aliases returns the IPv6 networks aliased to the IPv4 subtree, in the
+// order they were configured. An insert into one of them returns an
+// *AliasedNetworkError. It returns an empty slice for an IPv4 tree or a tree
+// created with Options.DisableIPv4Aliasing.
+func (t *Tree) IPv4Aliases() []netip.Prefix {
+	return slices.Clone(t.ipv4Aliases)
+}
 
-	for _, network := range networks {
-		err := t.insertStringNetwork(network, recordTypeReserved, noNodeIndex)
+func (t *Tree) insertReservedNetworks(networks []netip.Prefix) error {
+	// A reserved record rejects an insert into it, so a network inside one
+	// already inserted would fail. Inserting the most specific networks first
+	// lets a wider one skip the narrower records it contains.
+	ordered := slices.Clone(networks)
+	slices.SortStableFunc(ordered, func(left, right netip.Prefix) int {
+		return right.Bits() - left.Bits()
+	})
+	for _, network := range ordered {
+		err := t.insert(network, recordTypeReserved, insertResolver{}, noNodeIndex, nil)
 		if err != nil {
-			return err
+			return fmt.Errorf("inserting reserved network %s: %w", network, err)
 		}
 	}
+	t.reservedNetworks = make([]netip.Prefix, 0, len(networks))
+	for _, network := range networks {
+		t.reservedNetworks = append(t.reservedNetworks, network.Masked())
+	}
 	return nil
 }
 
+// ReservedNetworks returns the networks reserved when the tree was created, in
+// the order they were configured. It returns an empty slice for a tree created
+// with Options.IncludeReservedNetworks.
+func (t *Tree) ReservedNetworks() []netip.Prefix {
+	return slices.Clone(t.reservedNetworks)
+}
+
+// SetProvenanceSource sets the tag recorded as inserter.Provenance.Source for
+// later inserts, such as the name of the file being imported. It has no effect
+// on a tree created without Options.TrackProvenance.
+func (t *Tree) SetProvenanceSource(source string) {
+	t.provenanceSource = source
+}
+
+// Provenance returns the network of the record containing ip and the
+// provenance of its value. The bool is false when the record holds no data,
+// ip cannot be looked up in this tree, or the tree was created without
+// Options.TrackProvenance.
+func (t *Tree) Provenance(ip netip.Addr) (netip.Prefix, inserter.Provenance, bool) {
+	if !t.trackProvenance {
+		return netip.Prefix{}, inserter.Provenance{}, false
+	}
+	lookupIP, ok := t.lookupIP(ip)
+	if !ok {
+		return netip.Prefix{}, inserter.Provenance{}, false
+	}
+	prefixLen, r := t.getNode(t.root, lookupIP, 0)
+	if r.recordType != recordTypeData {
+		return netip.Prefix{}, inserter.Provenance{}, false
+	}
+	return t.getPrefixForAddr(ip, prefixLen), t.provenanceAt(r.nodeIndex), true
+}
+
+// insertProvenance returns the provenance index for a data insert of prefix,
+// or noNodeIndex when the tree does not track provenance.
+func (t *Tree) insertProvenance(prefix netip.Prefix) nodeIndex {
+	if !t.trackProvenance {
+		return noNodeIndex
+	}
+	return t.newProvenance(inserter.Provenance{
+		Network: prefix,
+		Source:  t.provenanceSource,
+	})
+}
+
+// newProvenance records one provenance entry and returns its index.
+func (t *Tree) newProvenance(provenance inserter.Provenance) nodeIndex {
+	index := newNodeIndex(len(t.provenance))
+	t.provenance = append(t.provenance, provenance)
+	return index
+}
+
+// provenanceAt returns the provenance at index, or the zero Provenance when the
+// tree does not track it or the record has none.
+func (t *Tree) provenanceAt(index nodeIndex) inserter.Provenance {
+	if !t.trackProvenance || index == noNodeIndex {
+		return inserter.Provenance{}
+	}
+	return t.provenance[index]
+}
+
 // Get the value for the given IP address from the tree. If the nil interface
 // is returned, that means the tree does not have a value for the IP. If ip is
 // invalid or cannot be looked up in this tree's IP version, the returned prefix
@@ -881,9 +1218,228 @@ func (t *Tree) Get(ip netip.Addr) (netip.Prefix, mmdbtype.DataType) {
 	return t.getPrefixForAddr(ip, prefixLen), value
 }
 
+// RecordKind is the kind of search tree record an address resolves to.
+//
+// There is no kind for an IPv4 alias record. Every alias record points to the
+// fixed node at ::/96, the root of the IPv4 subtree, and an alias network is
+// at most a /96, so a lookup that reaches an alias always has the 32 bits it
+// needs to continue into that subtree and ends at the record of the IPv4
+// address, as a reader's lookup does. LookupResult.IPv4Alias reports the alias
+// it passed through.
+type RecordKind int
+
+const (
+	// RecordEmpty is a record without data. No inserted network contains the
+	// address, or the inserts that did removed its data.
+	RecordEmpty RecordKind = iota
+	// RecordData is a record with a value.
+	RecordData
+	// RecordReserved is a record of a reserved network, which holds no data
+	// and rejects inserts.
+	RecordReserved
+)
+
+// LookupResult explains how a Tree resolves an address.
+type LookupResult struct {
+	// Network is the network the record covers, as Get returns it.
+	Network netip.Prefix
+	// Value is the record's value. It is nil unless Kind is RecordData.
+	Value mmdbtype.DataType
+	// IPv4Alias is the aliased network the lookup passed through to reach the
+	// IPv4 subtree, or the zero Prefix if it did not pass through one.
+	IPv4Alias netip.Prefix
+	// Kind is the kind of record the lookup ended at. Lookup follows aliases
+	// as a reader does, so it never ends at one; see RecordKind.
+	Kind RecordKind
+	// Depth is the number of address bits a reader reads to reach the record.
+	// It is the record's depth in the search tree, so for an IPv4 address in
+	// an IPv6 tree it includes the 96 bits leading to the IPv4 subtree.
+	Depth int
+}
+
+// Lookup returns the record the tree holds for ip, with the details Get leaves
+// out. If ip is invalid or cannot be looked up in this tree's IP version, it
+// returns the zero LookupResult.
+//
+// Lookup is not safe to call concurrently with any other Tree method, for the
+// same reason as Get.
+func (t *Tree) Lookup(ip netip.Addr) LookupResult {
+	lookupIP, ok := t.lookupIP(ip)
+	if !ok {
+		return LookupResult{}
+	}
+	depth, r, aliasDepth := t.lookupNode(t.root, lookupIP, 0)
+
+	result := LookupResult{
+		Network: t.getPrefixForAddr(ip, depth),
+		Depth:   depth,
+	}
+	switch r.recordType {
+	case recordTypeData:
+		result.Kind = RecordData
+		result.Value = t.valueStore.materialize(r.value)
+	case recordTypeReserved:
+		result.Kind = RecordReserved
+	default:
+		result.Kind = RecordEmpty
+	}
+	if aliasDepth != 0 {
+		result.IPv4Alias = netip.PrefixFrom(netip.AddrFrom16(lookupIP), aliasDepth).Masked()
+	}
+	return result
+}
+
+// NetworksWithValue returns the networks whose value pred accepts, with their
+// values, in address order, such as every network mapped to one ASN. pred
+// runs once per distinct value the records hold, before the iteration walks
+// the tree. When it accepts none, the iteration ends without a walk.
+// Otherwise it walks every data record and skips those holding a rejected
+// value without materializing it, so it costs about as much as iterating the
+// tree's records however few networks match.
+//
+// The networks are the data records as the tree stores them, in the form Get
+// returns, so a value inserted for one network can be reported in pieces
+// where later inserts split it. The aliased networks are not reported, since
+// their data is reported once, from the IPv4 subtree. The values are shared,
+// read-only views, as Get returns them. The tree must not be modified during
+// the iteration.
+func (t *Tree) NetworksWithValue(
+	pred func(mmdbtype.DataType) bool,
+) iter.Seq2[netip.Prefix, mmdbtype.DataType] {
+	return func(yield func(netip.Prefix, mmdbtype.DataType) bool) {
+		// Values are interned, so a ref stands for one value wherever it
+		// occurs.
+		accepted := t.valueStore.recordHeldRefs()
+		matched := false
+		for ref, held := range accepted {
+			if held {
+				accepted[ref] = pred(t.valueStore.materialize(valueRef(ref)))
+				matched = matched || accepted[ref]
+			}
+		}
+		if !matched {
+			return
+		}
+		for record := range t.dataRecords() {
+			if !accepted[record.value] {
+				continue
+			}
+			prefix, err := prefixFromInsertIP(record.ip, record.depth, t.treeDepth)
+			if err != nil {
+				// Every record of a valid tree has a network.
+				continue
+			}
+			if !yield(prefix, t.valueStore.materialize(record.value)) {
+				return
+			}
+		}
+	}
+}
+
+// Metadata describes the database metadata a Tree writes. The node count is
+// omitted because it is only known once the tree is finalized for writing.
+type Metadata struct {
+	// Description maps a language code to the description of the database in
+	// that language.
+	Description map[string]string
+	// DatabaseType is the database_type written to the metadata.
+	DatabaseType string
+	// Languages is the list of locale codes the records may be localized to.
+	Languages []string
+	// BuildEpoch is the database build timestamp as a Unix epoch value.
+	BuildEpoch int64
+	// IPVersion is 4 for an IPv4 tree and 6 for an IPv6 tree.
+	IPVersion int
+	// RecordSize is the number of bits in a search tree record.
+	RecordSize int
+	// BinaryFormatMajorVersion and BinaryFormatMinorVersion are the binary
+	// format version written to the metadata. The writer always writes major
+	// version 2. The minor version is 0 unless Load preserved the source's.
+	BinaryFormatMajorVersion int
+	BinaryFormatMinorVersion int
+	// Extra holds metadata keys outside the standard set, written verbatim.
+	Extra mmdbtype.Map
+}
+
+// Metadata returns the metadata the tree will write. The returned map and
+// slice are copies, so modifying them does not change the tree. Use the
+// setters to change the metadata after New or Load.
+func (t *Tree) Metadata() Metadata {
+	metadata := Metadata{
+		Description:  maps.Clone(t.description),
+		DatabaseType: t.databaseType,
+		Languages:    slices.Clone(t.languages),
+		BuildEpoch:   t.buildEpoch,
+		IPVersion:    t.ipVersion,
+		RecordSize:   t.recordSize,
+
+		BinaryFormatMajorVersion: 2,
+		BinaryFormatMinorVersion: t.binaryFormatMinorVersion,
+	}
+	if t.extraMetadata != nil {
+		//nolint:forcetypeassert // Map.Copy always returns a Map
+		metadata.Extra = t.extraMetadata.Copy().(mmdbtype.Map)
+	}
+	return metadata
+}
+
+// SetBuildEpoch sets the build timestamp written to the metadata. A rewriter
+// typically calls it after Load, which otherwise stamps the tree with the time
+// it was loaded. A negative epoch returns an error, as it does for New.
+func (t *Tree) SetBuildEpoch(epoch int64) error {
+	if epoch < 0 {
+		return fmt.Errorf("BuildEpoch must not be negative: %d", epoch)
+	}
+	t.buildEpoch = epoch
+	return nil
+}
+
+// SetDatabaseType sets the database_type written to the metadata.
+func (t *Tree) SetDatabaseType(databaseType string) {
+	t.databaseType = databaseType
+}
+
+// SetDescription replaces the descriptions written to the metadata. The map
+// is copied, so the caller may reuse it. A nil map writes no descriptions.
+func (t *Tree) SetDescription(description map[string]string) {
+	t.description = maps.Clone(description)
+	if t.description == nil {
+		t.description = map[string]string{}
+	}
+}
+
+// SetLanguages replaces the locale codes written to the metadata. The slice
+// is copied, so the caller may reuse it.
+func (t *Tree) SetLanguages(languages []string) {
+	t.languages = slices.Clone(languages)
+}
+
+// SetExtraMetadata replaces the metadata keys written outside the standard
+// set. The map is copied, so the caller may reuse it. A key the writer sets
+// itself, such as build_epoch or node_count, returns an error. A nil map
+// writes no extra keys.
+func (t *Tree) SetExtraMetadata(extra mmdbtype.Map) error {
+	for _, key := range standardMetadataKeys {
+		if _, ok := extra[key]; ok {
+			return fmt.Errorf("metadata key %q is set by the writer", key)
+		}
+	}
+	if len(extra) == 0 {
+		t.extraMetadata = nil
+		return nil
+	}
+	//nolint:forcetypeassert // Map.Copy always returns a Map
+	t.extraMetadata = extra.Copy().(mmdbtype.Map)
+	return nil
+}
+
 // finalize prepares the tree for writing. It is not threadsafe.
 func (t *Tree) finalize() {
 	t.expandPaths(t.root, 0)
+	if t.trackProvenance {
+		t.collapsedValues = make([]valueRef, t.nodeCountAllocated)
+		t.collapseNodes(t.root)
+	}
 	t.nodeNumbers = make([]int, t.nodeCountAllocated)
 	t.nodeCount = t.finalizeNode(t.root, 0)
 }
@@ -905,6 +1461,7 @@ func (t *Tree) WriteTo(w io.Writer) (int64, error) {
 
 	usePointers := true
 	dataWriter := newDataWriter(t.valueStore, usePointers)
+	dataWriter.keyRanks = t.mapKeyRanks()
 
 	nodeCount, numBytes, err := t.writeNode(buf, t.root, dataWriter, recordBuf)
 	if err != nil {
@@ -985,6 +1542,9 @@ func (t *Tree) writeNode(
 		if child.recordType != recordTypeNode && child.recordType != recordTypeFixedNode {
 			continue
 		}
+		if t.collapsedValue(child) != nilValueRef {
+			continue
+		}
 		addedNodes, addedBytes, err := t.writeNode(
 			w,
 			child.nodeIndex,
@@ -1014,6 +1574,10 @@ func (t *Tree) recordValue(
 	case recordTypePath:
 		return 0, errors.New("compressed path record cannot be written before finalization")
 	default:
+		if value := t.collapsedValue(r); value != nilValueRef {
+			offset, err := dataWriter.maybeWrite(value)
+			return t.nodeCount + len(dataSectionSeparator) + offset, err
+		}
 		return t.nodeNumbers[r.nodeIndex], nil
 	}
 }
@@ -1083,9 +1647,12 @@ func (t *Tree) writeMetadata(dw *dataWriter) (int64, error) {
 	if int64(t.nodeCount) > int64(math.MaxUint32) {
 		return 0, fmt.Errorf("node count of %d exceeds the maximum allowed value", t.nodeCount)
 	}
-	metadata := mmdbtype.Map{
+	metadata := make(mmdbtype.Map, len(t.extraMetadata)+len(standardMetadataKeys))
+	maps.Copy(metadata, t.extraMetadata)
+	maps.Copy(metadata, mmdbtype.Map{
 		"binary_format_major_version": mmdbtype.Uint16(2),
-		"binary_format_minor_version": mmdbtype.Uint16(0),
+		//nolint:gosec // Load bounds the minor version to a uint16
+		"binary_format_minor_version": mmdbtype.Uint16(t.binaryFormatMinorVersion),
 
 		// Although it might make sense to change the type on this, there is no use
 		// case where someone would reasonably pass a negative build epoch.
@@ -1100,7 +1667,7 @@ func (t *Tree) writeMetadata(dw *dataWriter) (int64, error) {
 		"node_count": mmdbtype.Uint32(t.nodeCount),
 		//nolint:gosec // recordSize is always 24, 28, or 32
 		"record_size": mmdbtype.Uint16(t.recordSize),
-	}
+	})
 	ref, err := dw.store.intern(metadata)
 	if err != nil {
 		return 0, err
@@ -921,3 +921,92 @@ func benchmarkDeepMergeValue(country, source string, rank uint16) mmdbtype.Map {
 		},
 	}
 }
+
+// BenchmarkTreeInsertSortedNetworks is the baseline for
+// BenchmarkBulkBuilderSortedNetworks, which builds the same tree.
+func BenchmarkTreeInsertSortedNetworks(b *testing.B) {
+	specs := sortedBenchmarkSpecs()
+	b.ReportAllocs()
+	for b.Loop() {
+		tree := newBenchmarkTree(b)
+		insertBenchmarkSpecs(b, tree, specs)
+	}
+}
+
+func BenchmarkBulkBuilderSortedNetworks(b *testing.B) {
+	specs := sortedBenchmarkSpecs()
+	b.ReportAllocs()
+	for b.Loop() {
+		builder, err := NewBulkBuilder(Options{
+			IPVersion:               4,
+			IncludeReservedNetworks: true,
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, spec := range specs {
+			if err := builder.Insert(spec.network, spec.value); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if _, err := builder.Tree(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// sortedBenchmarkSpecs returns adjacent /24s across 1.0.0.0/8 with a handful
+// of values, as a sorted ASN CSV would give.
+func sortedBenchmarkSpecs() []benchmarkInsertSpec {
+	values := benchmarkBaseValues()
+	specs := make([]benchmarkInsertSpec, 0, 1<<16)
+	for i := range uint32(1 << 16) {
+		specs = append(specs, benchmarkInsertSpec{
+			network: netip.PrefixFrom(ipv4Addr(1<<24|i<<8), 24),
+			value:   values[(i/7)%uint32(len(values))],
+		})
+	}
+	return specs
+}
+
+// BenchmarkShardedBuilderDeepMergeOverlappingPasses compares repeated Insert
+// with ShardedBuilder on the same deep-merge passes, which spread over 64 of
+// its /8 shards. The speedup grows with GOMAXPROCS; with one CPU, the
+// difference is the cost of the queues and of grafting the shards.
+func BenchmarkShardedBuilderDeepMergeOverlappingPasses(b *testing.B) {
+	specs := overlappingBenchmarkDeepMergeSpecs()
+	options := Options{
+		IPVersion:               4,
+		IncludeReservedNetworks: true,
+		Inserter:                inserter.DeepMerge,
+	}
+
+	b.Run("Insert", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			tree, err := New(options)
+			if err != nil {
+				b.Fatal(err)
+			}
+			insertBenchmarkSpecs(b, tree, specs)
+		}
+	})
+
+	b.Run("ShardedBuilder", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			builder, err := NewShardedBuilder(options, ShardOptions{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, spec := range specs {
+				if err := builder.Insert(spec.network, spec.value); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if _, err := builder.Tree(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -7,8 +7,10 @@ import (
 	"hash/maphash"
 	"math"
 	"math/big"
+	"math/rand/v2"
 	"net/netip"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"testing"
@@ -943,6 +945,232 @@ func TestTreeGetInvalidOrWrongFamilyReturnsZeroPrefix(t *testing.T) {
 	assert.Nil(t, got)
 }
 
+// TestTreeGetThroughAliasBeforeWrite pins that Get follows an IPv4 alias into
+// data that is still a compressed path, as it does after WriteTo expands it.
+func TestTreeGetThroughAliasBeforeWrite(t *testing.T) {
+	tree, err := New(Options{})
+	require.NoError(t, err)
+	value := mmdbtype.String("value")
+	require.NoError(t, tree.Insert(netip.MustParsePrefix("1.1.1.0/24"), value))
+
+	for range 2 {
+		network, got := tree.Get(netip.MustParseAddr("2002:101:101::"))
+		assert.Equal(t, netip.MustParsePrefix("2002:101:100::/40"), network)
+		assert.Equal(t, value, got)
+		writeTreeBytes(t, tree)
+	}
+}
+
+// TestTreeLookup pins the record details Lookup reports for data, reserved,
+// aliased, and empty addresses.
+func TestTreeLookup(t *testing.T) {
+	tree, err := New(Options{})
+	require.NoError(t, err)
+	ipv4Value := mmdbtype.String("ipv4")
+	ipv6Value := mmdbtype.Map{"country": mmdbtype.String("US")}
+	require.NoError(t, tree.Insert(netip.MustParsePrefix("1.1.1.0/24"), ipv4Value))
+	require.NoError(t, tree.Insert(netip.MustParsePrefix("2600::/16"), ipv6Value))
+
+	tests := []struct {
+		ip   string
+		want LookupResult
+	}{
+		{"1.1.1.1", LookupResult{
+			Network: netip.MustParsePrefix("1.1.1.0/24"),
+			Value:   ipv4Value,
+			Kind:    RecordData,
+			Depth:   120,
+		}},
+		{"2002:101:101::", LookupResult{
+			Network:   netip.MustParsePrefix("2002:101:100::/40"),
+			Value:     ipv4Value,
+			IPv4Alias: netip.MustParsePrefix("2002::/16"),
+			Kind:      RecordData,
+			Depth:     40,
+		}},
+		{"2001:0:a00:1::", LookupResult{
+			Network:   netip.MustParsePrefix("2001:0:a00::/40"),
+			IPv4Alias: netip.MustParsePrefix("2001::/32"),
+			Kind:      RecordReserved,
+			Depth:     40,
+		}},
+		{"10.1.2.3", LookupResult{
+			Network: netip.MustParsePrefix("10.0.0.0/8"),
+			Kind:    RecordReserved,
+			Depth:   104,
+		}},
+		{"2600:1::", LookupResult{
+			Network: netip.MustParsePrefix("2600::/16"),
+			Value:   ipv6Value,
+			Kind:    RecordData,
+			Depth:   16,
+		}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, tree.Lookup(netip.MustParseAddr(test.ip)), test.ip)
+	}
+
+	empty := tree.Lookup(netip.MustParseAddr("2700::"))
+	assert.Equal(t, RecordEmpty, empty.Kind)
+	assert.Nil(t, empty.Value)
+	assert.True(t, empty.Network.Contains(netip.MustParseAddr("2700::")))
+	assert.Equal(t, empty.Network.Bits(), empty.Depth)
+
+	assert.Equal(t, LookupResult{}, tree.Lookup(netip.Addr{}))
+}
+
+// TestTreeLookupResolvesAliases pins that a lookup through any IPv4 alias
+// network ends at the record the IPv4 address resolves to, before and after
+// WriteTo expands the IPv4 subtree, so Lookup never reports an alias record.
+func TestTreeLookupResolvesAliases(t *testing.T) {
+	tests := []struct {
+		name    string
+		aliases []netip.Prefix
+	}{
+		{"default aliases", nil},
+		{"NAT64 alias", []netip.Prefix{netip.MustParsePrefix("64:ff9b::/96")}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tree, err := New(Options{IPv4Aliases: test.aliases})
+			require.NoError(t, err)
+			require.NoError(t, tree.Insert(
+				netip.MustParsePrefix("1.1.1.0/24"),
+				mmdbtype.String("ipv4"),
+			))
+
+			for _, written := range []bool{false, true} {
+				if written {
+					writeTreeBytes(t, tree)
+				}
+				for _, alias := range tree.IPv4Aliases() {
+					for _, ip := range []string{"1.1.1.1", "10.1.2.3", "8.8.8.8"} {
+						ipv4 := tree.Lookup(netip.MustParseAddr(ip))
+						aliased := aliasedAddr(alias, netip.MustParseAddr(ip))
+						depth := alias.Bits() + ipv4.Depth - 96
+						want := LookupResult{
+							Network:   netip.PrefixFrom(aliased, depth).Masked(),
+							Value:     ipv4.Value,
+							IPv4Alias: alias,
+							Kind:      ipv4.Kind,
+							Depth:     depth,
+						}
+						if aliased.Is4In6() {
+							// Lookup unmaps an IPv4-mapped address, as Get
+							// does, so it never reaches the alias.
+							want = ipv4
+						}
+						assert.Equal(t, want, tree.Lookup(aliased),
+							"%s in %s, written %t", ip, alias, written)
+					}
+				}
+			}
+		})
+	}
+}
+
+// aliasedAddr returns the address in alias that a reader maps to ipv4.
+func aliasedAddr(alias netip.Prefix, ipv4 netip.Addr) netip.Addr {
+	ip := alias.Addr().As16()
+	for i := range 32 {
+		setBitAt(&ip, alias.Bits()+i, bitAt(ipv4.As16(), 96+i))
+	}
+	return netip.AddrFrom16(ip)
+}
+
+// TestTreeNetworksWithValue pins that NetworksWithValue reports the records
+// whose value pred accepts, in address order, calling pred once per distinct
+// value before the walk, and that it stops when the loop breaks.
+func TestTreeNetworksWithValue(t *testing.T) {
+	tree, err := New(Options{})
+	require.NoError(t, err)
+	us := mmdbtype.Map{"country": mmdbtype.String("US")}
+	for _, insert := range []struct {
+		network string
+		value   mmdbtype.DataType
+	}{
+		{"1.0.0.0/24", us},
+		{"1.0.1.0/24", mmdbtype.Map{"country": mmdbtype.String("CA")}},
+		{"2.0.0.0/16", us},
+		// Splits 2.0.0.0/16 into the records around it.
+		{"2.0.5.0/24", mmdbtype.String("other")},
+		// No record holds FR once it is replaced, so pred never sees it.
+		{"3.0.0.0/24", mmdbtype.Map{"country": mmdbtype.String("FR")}},
+		{"3.0.0.0/24", mmdbtype.String("other")},
+		{"2600::/16", us},
+		{"2a00::/16", mmdbtype.Map{"country": mmdbtype.String("DE")}},
+	} {
+		require.NoError(t, tree.Insert(netip.MustParsePrefix(insert.network), insert.value))
+	}
+	isUS := func(value mmdbtype.DataType) bool {
+		m, ok := value.(mmdbtype.Map)
+		return ok && m["country"] == mmdbtype.String("US")
+	}
+
+	tests := []struct {
+		name string
+		pred func(mmdbtype.DataType) bool
+		want []string
+	}{
+		{
+			name: "US",
+			pred: isUS,
+			want: []string{
+				"1.0.0.0/24",
+				"2.0.0.0/22",
+				"2.0.4.0/24",
+				"2.0.6.0/23",
+				"2.0.8.0/21",
+				"2.0.16.0/20",
+				"2.0.32.0/19",
+				"2.0.64.0/18",
+				"2.0.128.0/17",
+				"2600::/16",
+			},
+		},
+		{
+			name: "strings",
+			pred: func(value mmdbtype.DataType) bool {
+				_, ok := value.(mmdbtype.String)
+				return ok
+			},
+			want: []string{"2.0.5.0/24", "3.0.0.0/24"},
+		},
+		{
+			name: "none",
+			pred: func(mmdbtype.DataType) bool { return false },
+			want: nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := 0
+			var got []string
+			for network, value := range tree.NetworksWithValue(func(value mmdbtype.DataType) bool {
+				calls++
+				return test.pred(value)
+			}) {
+				// pred has seen every value before the first network.
+				assert.Equal(t, 4, calls)
+				assert.True(t, test.pred(value))
+				_, stored := tree.Get(network.Addr())
+				assert.Equal(t, value, stored, network)
+				got = append(got, network.String())
+			}
+			assert.Equal(t, test.want, got)
+			// US, CA, "other", and DE.
+			assert.Equal(t, 4, calls)
+		})
+	}
+
+	var yielded []netip.Prefix
+	for network := range tree.NetworksWithValue(isUS) {
+		yielded = append(yielded, network)
+		break
+	}
+	assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("1.0.0.0/24")}, yielded)
+}
+
 func TestLoadWrapsInsertErrorWithNetwork(t *testing.T) {
 	tree, err := New(Options{
 		DisableIPv4Aliasing:     true,
@@ -2694,3 +2922,344 @@ func newTestTree(t *testing.T, databaseType string) *Tree {
 	require.NoError(t, err)
 	return tree
 }
+
+// TestTreeMetadataSetters pins that the setters change the written metadata
+// and that neither the getter nor the setters alias the caller's containers.
+func TestTreeMetadataSetters(t *testing.T) {
+	tree := newTestTree(t, "mmdbwriter-metadata")
+	require.NoError(t, tree.Insert(
+		netip.MustParsePrefix("1.2.3.0/24"),
+		mmdbtype.String("value"),
+	))
+	loaded, err := Load(writeTempDB(t, tree), Options{IncludeReservedNetworks: true})
+	require.NoError(t, err)
+
+	metadata := loaded.Metadata()
+	assert.Equal(t, "mmdbwriter-metadata", metadata.DatabaseType)
+	assert.Equal(t, map[string]string{"en": "Test database"}, metadata.Description)
+	assert.Equal(t, 4, metadata.IPVersion)
+	assert.Equal(t, 24, metadata.RecordSize)
+	metadata.Description["en"] = "modified copy"
+	assert.Equal(t, "Test database", loaded.Metadata().Description["en"])
+
+	description := map[string]string{"en": "Rewritten"}
+	languages := []string{"en", "de"}
+	require.NoError(t, loaded.SetBuildEpoch(1_700_000_000))
+	loaded.SetDatabaseType("mmdbwriter-rewritten")
+	loaded.SetDescription(description)
+	loaded.SetLanguages(languages)
+	description["en"] = "changed after set"
+	languages[0] = "fr"
+
+	require.Error(t, loaded.SetBuildEpoch(-1))
+
+	reader, err := maxminddb.Open(writeTempDB(t, loaded))
+	require.NoError(t, err)
+	defer reader.Close()
+	assert.Equal(t, uint(1_700_000_000), reader.Metadata.BuildEpoch)
+	assert.Equal(t, "mmdbwriter-rewritten", reader.Metadata.DatabaseType)
+	assert.Equal(t, map[string]string{"en": "Rewritten"}, reader.Metadata.Description)
+	assert.Equal(t, []string{"en", "de"}, reader.Metadata.Languages)
+}
+
+// TestLoadPreserveMetadata pins that PreserveMetadata carries the build epoch,
+// including an epoch of zero, and extra metadata keys through a load and a
+// second write, and that a plain load still drops them.
+func TestLoadPreserveMetadata(t *testing.T) {
+	tree := newTestTree(t, "mmdbwriter-metadata")
+	require.NoError(t, tree.Insert(
+		netip.MustParsePrefix("1.2.3.0/24"),
+		mmdbtype.String("value"),
+	))
+	extra := mmdbtype.Map{
+		"vendor":  mmdbtype.String("acme"),
+		"sources": mmdbtype.Slice{mmdbtype.String("a"), mmdbtype.Uint32(2)},
+	}
+	require.NoError(t, tree.SetExtraMetadata(extra))
+	require.NoError(t, tree.SetBuildEpoch(123))
+	require.ErrorContains(t,
+		tree.SetExtraMetadata(mmdbtype.Map{"node_count": mmdbtype.Uint32(1)}),
+		`metadata key "node_count" is set by the writer`,
+	)
+	path := writeTempDB(t, tree)
+
+	preserved, err := Load(path, Options{
+		IncludeReservedNetworks: true,
+		PreserveMetadata:        true,
+	})
+	require.NoError(t, err)
+	metadata := preserved.Metadata()
+	assert.Equal(t, int64(123), metadata.BuildEpoch)
+	assert.Equal(t, 2, metadata.BinaryFormatMajorVersion)
+	assert.Equal(t, extra, metadata.Extra)
+
+	rewritten, err := readExtraMetadata(writeTempDB(t, preserved))
+	require.NoError(t, err)
+	assert.Equal(t, extra, rewritten)
+
+	overridden, err := Load(path, Options{
+		BuildEpoch:              456,
+		IncludeReservedNetworks: true,
+		PreserveMetadata:        true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(456), overridden.Metadata().BuildEpoch)
+
+	require.NoError(t, tree.SetBuildEpoch(0))
+	zeroEpoch, err := Load(writeTempDB(t, tree), Options{
+		IncludeReservedNetworks: true,
+		PreserveMetadata:        true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), zeroEpoch.Metadata().BuildEpoch)
+
+	plain, err := Load(path, Options{IncludeReservedNetworks: true})
+	require.NoError(t, err)
+	assert.NotEqual(t, int64(123), plain.Metadata().BuildEpoch)
+	assert.Nil(t, plain.Metadata().Extra)
+}
+
+// TestCustomReservedNetworks pins that Options.ReservedNetworks replaces the
+// default list, so a caller can allow one default network while keeping the
+// rest reserved.
+func TestCustomReservedNetworks(t *testing.T) {
+	cgnat := netip.MustParsePrefix("100.64.0.0/10")
+	defaults := DefaultReservedNetworks(6)
+	require.Contains(t, defaults, cgnat)
+	require.Contains(t, defaults, netip.MustParsePrefix("fc00::/7"))
+	assert.Len(t, DefaultReservedNetworks(4), len(reservedNetworksIPv4))
+	assert.Nil(t, DefaultReservedNetworks(5))
+
+	reserved := slices.DeleteFunc(defaults, func(prefix netip.Prefix) bool {
+		return prefix == cgnat
+	})
+	tree, err := New(Options{ReservedNetworks: reserved})
+	require.NoError(t, err)
+	assert.Equal(t, reserved, tree.ReservedNetworks())
+
+	require.NoError(t, tree.Insert(
+		netip.MustParsePrefix("100.64.1.0/24"),
+		mmdbtype.String("cgnat"),
+	))
+	_, value := tree.Get(netip.MustParseAddr("100.64.1.1"))
+	assert.Equal(t, mmdbtype.String("cgnat"), value)
+
+	var rnErr *ReservedNetworkError
+	err = tree.Insert(netip.MustParsePrefix("127.0.0.1/32"), mmdbtype.String("loopback"))
+	require.ErrorAs(t, err, &rnErr)
+	assert.Equal(t, netip.MustParsePrefix("127.0.0.0/8"), rnErr.ReservedNetwork)
+
+	t.Run("overlapping networks", func(t *testing.T) {
+		tree, err := New(Options{
+			IPVersion: 4,
+			ReservedNetworks: []netip.Prefix{
+				netip.MustParsePrefix("10.0.0.0/8"),
+				netip.MustParsePrefix("10.1.2.3/16"),
+			},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []netip.Prefix{
+			netip.MustParsePrefix("10.0.0.0/8"),
+			netip.MustParsePrefix("10.1.0.0/16"),
+		}, tree.ReservedNetworks())
+		err = tree.Insert(netip.MustParsePrefix("10.2.0.0/16"), mmdbtype.String("x"))
+		require.ErrorAs(t, err, &rnErr)
+	})
+
+	t.Run("empty list reserves nothing", func(t *testing.T) {
+		tree, err := New(Options{IPVersion: 4, ReservedNetworks: []netip.Prefix{}})
+		require.NoError(t, err)
+		assert.Empty(t, tree.ReservedNetworks())
+		require.NoError(t, tree.Insert(
+			netip.MustParsePrefix("127.0.0.0/8"),
+			mmdbtype.String("loopback"),
+		))
+	})
+
+	t.Run("IPv6 network in an IPv4 tree", func(t *testing.T) {
+		_, err := New(Options{
+			IPVersion:        4,
+			ReservedNetworks: []netip.Prefix{netip.MustParsePrefix("fc00::/7")},
+		})
+		require.ErrorContains(t, err, "inserting reserved network fc00::/7")
+	})
+}
+
+// TestCustomIPv4Aliases pins that Options.IPv4Aliases replaces the default
+// alias set, that lookups through a custom alias reach the IPv4 subtree, and
+// that inserts into the configured aliases are still rejected.
+func TestCustomIPv4Aliases(t *testing.T) {
+	nat64 := netip.MustParsePrefix("64:ff9b::/96")
+	teredo := netip.MustParsePrefix("2001::/32")
+	aliases := slices.DeleteFunc(DefaultIPv4Aliases(), func(prefix netip.Prefix) bool {
+		return prefix == teredo
+	})
+	aliases = append(aliases, nat64)
+
+	tree, err := New(Options{
+		DatabaseType:            "mmdbwriter-aliases",
+		Description:             map[string]string{"en": "Test database"},
+		IncludeReservedNetworks: true,
+		IPv4Aliases:             aliases,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, aliases, tree.IPv4Aliases())
+
+	require.NoError(t, tree.Insert(
+		netip.MustParsePrefix("1.2.3.0/24"),
+		mmdbtype.String("ipv4"),
+	))
+	_, value := tree.Get(netip.MustParseAddr("64:ff9b::102:304"))
+	assert.Equal(t, mmdbtype.String("ipv4"), value)
+
+	var anErr *AliasedNetworkError
+	err = tree.Insert(netip.MustParsePrefix("64:ff9b::/120"), mmdbtype.String("x"))
+	require.ErrorAs(t, err, &anErr)
+	assert.Equal(t, nat64, anErr.AliasedNetwork)
+
+	// Teredo is no longer aliased, so it takes ordinary data.
+	require.NoError(t, tree.Insert(teredo, mmdbtype.String("teredo")))
+	_, value = tree.Get(netip.MustParseAddr("2001::1"))
+	assert.Equal(t, mmdbtype.String("teredo"), value)
+
+	checkWrittenTree(t, tree)
+
+	t.Run("disabled aliasing", func(t *testing.T) {
+		tree, err := New(Options{DisableIPv4Aliasing: true, IPv4Aliases: aliases})
+		require.NoError(t, err)
+		assert.Empty(t, tree.IPv4Aliases())
+	})
+
+	for _, test := range []struct {
+		name    string
+		aliases []netip.Prefix
+		err     string
+	}{
+		{
+			name:    "IPv4 network",
+			aliases: []netip.Prefix{netip.MustParsePrefix("1.0.0.0/8")},
+			err:     "is not an IPv6 network",
+		},
+		{
+			name:    "longer than /96",
+			aliases: []netip.Prefix{netip.MustParsePrefix("2003::/97")},
+			err:     "is longer than /96",
+		},
+		{
+			name:    "overlaps the IPv4 subtree",
+			aliases: []netip.Prefix{netip.MustParsePrefix("::/64")},
+			err:     "overlaps the IPv4 subtree",
+		},
+		{
+			name: "overlapping aliases",
+			aliases: []netip.Prefix{
+				netip.MustParsePrefix("2002::/16"),
+				netip.MustParsePrefix("2002:1::/32"),
+			},
+			err: "IPv4 alias networks 2002::/16 and 2002:1::/32 overlap",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := New(Options{IPv4Aliases: test.aliases})
+			require.ErrorContains(t, err, test.err)
+		})
+	}
+}
+
+// checkWrittenTree writes the tree and checks that the reader accepts it and
+// that its verifier passes.
+func checkWrittenTree(t *testing.T, tree *Tree) {
+	t.Helper()
+	var buf bytes.Buffer
+	_, err := tree.WriteTo(&buf)
+	require.NoError(t, err)
+	reader, err := maxminddb.OpenBytes(buf.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, reader.Verify())
+}
+
+// randomInsertSpecs returns random overlapping networks for tree, with few
+// distinct values, for the tests comparing two ways of building the same
+// tree. It leaves out the networks inside reserved and aliased networks, so
+// every insert succeeds.
+func randomInsertSpecs(t *testing.T, tree *Tree, seed uint64, shortNetworks bool) []benchmarkInsertSpec {
+	t.Helper()
+	r := rand.New(rand.NewPCG(seed, seed))
+	values := []mmdbtype.DataType{
+		mmdbtype.String("a"),
+		mmdbtype.Map{"country": mmdbtype.String("US")},
+		mmdbtype.Map{"city": mmdbtype.String("Paris"), "tags": mmdbtype.Slice{mmdbtype.Uint32(1)}},
+	}
+	minLen := 12
+	if shortNetworks {
+		minLen = 0
+	}
+	var specs []benchmarkInsertSpec
+	for range 200 {
+		var prefix netip.Prefix
+		switch {
+		case tree.treeDepth == 32 || r.IntN(2) == 0:
+			addr := ipv4Addr(r.Uint32())
+			prefix = netip.PrefixFrom(addr, minLen+r.IntN(33-minLen))
+		case shortNetworks && r.IntN(8) == 0:
+			// Networks around the IPv4 subtree and the whole space.
+			prefix = netip.PrefixFrom(netip.IPv6Unspecified(), r.IntN(97))
+		default:
+			var addr [16]byte
+			addr[0] = 0x20
+			addr[1] = byte(r.IntN(4))
+			addr[2] = byte(r.IntN(256))
+			prefix = netip.PrefixFrom(netip.AddrFrom16(addr), minLen+r.IntN(49-minLen))
+		}
+		prefix = prefix.Masked()
+		normalized, err := tree.normalizeInsertPrefix(prefix)
+		require.NoError(t, err)
+		ip, prefixLen := tree.prefixInsertIP(normalized)
+		if depth, recordType := tree.coveringRecord(ip, prefixLen); depth <= prefixLen &&
+			(recordType == recordTypeReserved || recordType == recordTypeAlias) {
+			continue
+		}
+		specs = append(specs, benchmarkInsertSpec{
+			network: prefix,
+			value:   values[r.IntN(len(values))],
+		})
+	}
+	return specs
+}
+
+// TestGapFillingAndOverlayInserters pins that KeepExisting only fills empty
+// space and OnlyIfExists never creates records outside existing data.
+func TestGapFillingAndOverlayInserters(t *testing.T) {
+	tree := newTestTree(t, "overlay-test")
+	require.NoError(t, tree.Insert(
+		netip.MustParsePrefix("1.0.0.0/24"),
+		mmdbtype.Map{"base": mmdbtype.Bool(true)},
+	))
+
+	require.NoError(t, tree.InsertPureFunc(
+		netip.MustParsePrefix("1.0.0.0/23"),
+		mmdbtype.Map{"overlay": mmdbtype.Bool(true)},
+		inserter.OnlyIfExists(inserter.TopLevelMerge),
+	))
+	_, value := tree.Get(netip.MustParseAddr("1.0.0.1"))
+	assert.Equal(t, mmdbtype.Map{
+		"base":    mmdbtype.Bool(true),
+		"overlay": mmdbtype.Bool(true),
+	}, value)
+	_, value = tree.Get(netip.MustParseAddr("1.0.1.1"))
+	assert.Nil(t, value)
+
+	require.NoError(t, tree.InsertRangePureFunc(
+		netip.MustParseAddr("1.0.0.0"),
+		netip.MustParseAddr("1.0.1.255"),
+		mmdbtype.Map{"gap": mmdbtype.Bool(true)},
+		inserter.KeepExisting,
+	))
+	_, value = tree.Get(netip.MustParseAddr("1.0.0.1"))
+	assert.Equal(t, mmdbtype.Map{
+		"base":    mmdbtype.Bool(true),
+		"overlay": mmdbtype.Bool(true),
+	}, value)
+	_, value = tree.Get(netip.MustParseAddr("1.0.1.1"))
+	assert.Equal(t, mmdbtype.Map{"gap": mmdbtype.Bool(true)}, value)
+}
@@ -70,9 +70,15 @@ type valueNode struct {
 // storage. refArena.release clears its extent so a stale slot never carries
 // live-looking references; released payload bytes are inert, so byteArena
 // leaves them.
+//
+// An arena with a file keeps data in that mapped file, growing it before an
+// append would reallocate. An arena shared with a clone writes nothing
+// another tree reads, as arenaSharing describes.
 type byteArena struct {
 	data []byte
 	free map[uint32][]uint32
+	file *mappedFile
+	arenaSharing
 }
 
 func (a *byteArena) put(value []byte) (uint32, error) {
@@ -84,7 +90,7 @@ func (a *byteArena) put(value []byte) (uint32, error) {
 	}
 	length := uint32(len(value)) //nolint:gosec // length was bounded above
 	var offset uint32
-	if offsets := a.free[length]; len(offsets) != 0 {
+	if offsets := a.free[length]; len(offsets) != 0 && a.writable(offsets[len(offsets)-1]) {
 		offset = offsets[len(offsets)-1]
 		a.free[length] = offsets[:len(offsets)-1]
 		copy(a.data[offset:offset+length], value)
@@ -93,6 +99,9 @@ func (a *byteArena) put(value []byte) (uint32, error) {
 	if uint64(len(a.data))+uint64(length) > math.MaxUint32 {
 		return 0, errors.New("value payload arena exceeds the value-store limit")
 	}
+	if err := growArena(&a.arenaSharing, a.file, &a.data, len(value)); err != nil {
+		return 0, err
+	}
 	offset = uint32(len(a.data)) //nolint:gosec // arena length was bounded above
 	a.data = append(a.data, value...)
 	return offset, nil
@@ -111,6 +120,8 @@ func (a *byteArena) release(offset, length uint32) {
 type refArena struct {
 	data []valueRef
 	free map[uint32][]uint32
+	file *mappedFile
+	arenaSharing
 }
 
 func (a *refArena) put(value []valueRef) (uint32, error) {
@@ -122,7 +133,7 @@ func (a *refArena) put(value []valueRef) (uint32, error) {
 	}
 	length := uint32(len(value)) //nolint:gosec // length was bounded above
 	var offset uint32
-	if offsets := a.free[length]; len(offsets) != 0 {
+	if offsets := a.free[length]; len(offsets) != 0 && a.writable(offsets[len(offsets)-1]) {
 		offset = offsets[len(offsets)-1]
 		a.free[length] = offsets[:len(offsets)-1]
 		copy(a.data[offset:offset+length], value)
@@ -131,6 +142,9 @@ func (a *refArena) put(value []valueRef) (uint32, error) {
 	if uint64(len(a.data))+uint64(length) > math.MaxUint32 {
 		return 0, errors.New("value child arena exceeds the value-store limit")
 	}
+	if err := growArena(&a.arenaSharing, a.file, &a.data, len(value)); err != nil {
+		return 0, err
+	}
 	offset = uint32(len(a.data)) //nolint:gosec // arena length was bounded above
 	a.data = append(a.data, value...)
 	return offset, nil
@@ -140,7 +154,9 @@ func (a *refArena) release(offset, length uint32) {
 	if length == 0 {
 		return
 	}
-	clear(a.data[offset : offset+length])
+	if a.writable(offset) {
+		clear(a.data[offset : offset+length])
+	}
 	if a.free == nil {
 		a.free = map[uint32][]uint32{}
 	}
@@ -439,6 +455,29 @@ func (s *valueStore) release(ref valueRef) {
 	s.releaseScratch = worklist
 }
 
+// recordHeldRefs reports, indexed by ref, the live values some record holds.
+// These are the references left after subtracting those from containing
+// values and from the caller-identity cache, so the result is only exact
+// while no temporary reference is outstanding, as between inserts.
+func (s *valueStore) recordHeldRefs() []bool {
+	others := make([]uint32, len(s.nodes))
+	for index := range s.nodes {
+		for _, child := range s.childRefs(&s.nodes[index]) {
+			others[child]++
+		}
+	}
+	for _, entry := range s.callerIdentity {
+		if entry.ref != nilValueRef {
+			others[entry.ref]++
+		}
+	}
+	held := make([]bool, len(s.nodes))
+	for index := range s.nodes {
+		held[index] = s.nodes[index].refCount > others[index]
+	}
+	return held
+}
+
 // intern canonicalizes a value into the store and returns a reference the
 // caller owns and must release. A nil value interns to the nil reference,
 // which release ignores.
@@ -614,6 +653,51 @@ func (s *valueStore) internOwnedChildren(
 	return ref, nil
 }
 
+// internFrom interns the value at ref in src into s without materializing it,
+// and returns a reference the caller owns. refs memoizes translated refs
+// across calls. It owns one reference to each translated ref, which the
+// caller releases once it is done with refs.
+func (s *valueStore) internFrom(
+	src *valueStore,
+	ref valueRef,
+	refs map[valueRef]valueRef,
+) (valueRef, error) {
+	if translated, ok := refs[ref]; ok {
+		s.retain(translated)
+		return translated, nil
+	}
+	node := src.node(ref)
+	srcChildren := src.childRefs(node)
+	children := make([]valueRef, 0, len(srcChildren))
+	for _, child := range srcChildren {
+		translated, err := s.internFrom(src, child, refs)
+		if err != nil {
+			for _, ref := range children {
+				s.release(ref)
+			}
+			return nilValueRef, err
+		}
+		children = append(children, translated)
+	}
+	translated, created, err := s.internNode(node.kind, src.payload(node), children)
+	if err != nil {
+		for _, child := range children {
+			s.release(child)
+		}
+		return nilValueRef, err
+	}
+	// As in internOwnedChildren, a new node adopts the child references and
+	// a dedupe hit leaves them to be released here.
+	if !created {
+		for _, child := range children {
+			s.release(child)
+		}
+	}
+	s.retain(translated)
+	refs[ref] = translated
+	return translated, nil
+}
+
 // internNode returns a canonical node for the given content and whether it
 // created one. The created result decides child ownership: a new parent
 // adopts the caller's child references as its child-array edges, while a
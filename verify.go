@@ -0,0 +1,694 @@
+package mmdbwriter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"iter"
+	"math"
+	"math/bits"
+	"unicode/utf8"
+
+	"github.com/oschwald/maxminddb-golang/v2/mmdbdata"
+
+	"github.com/maxmind/mmdbwriter/v2/mmdbtype"
+)
+
+// ErrInvalidDatabase is wrapped by every error Verify returns for a database
+// that is not structurally sound, as opposed to an error reading it.
+var ErrInvalidDatabase = errors.New("invalid MaxMind DB")
+
+// maxDataDepth is the deepest nesting of maps and slices that readers decode.
+const maxDataDepth = 512
+
+// Type numbers of the data section encoding.
+const (
+	wireTypePointer = 1
+	wireTypeString  = 2
+	wireTypeFloat64 = 3
+	wireTypeBytes   = 4
+	wireTypeUint16  = 5
+	wireTypeUint32  = 6
+	wireTypeMap     = 7
+	wireTypeInt32   = 8
+	wireTypeUint64  = 9
+	wireTypeUint128 = 10
+	wireTypeSlice   = 11
+	wireTypeBool    = 14
+	wireTypeFloat32 = 15
+)
+
+var wireTypeNames = map[int]string{
+	wireTypePointer: "pointer",
+	wireTypeString:  "string",
+	wireTypeFloat64: "double",
+	wireTypeBytes:   "bytes",
+	wireTypeUint16:  "uint16",
+	wireTypeUint32:  "uint32",
+	wireTypeMap:     "map",
+	wireTypeInt32:   "int32",
+	wireTypeUint64:  "uint64",
+	wireTypeUint128: "uint128",
+	wireTypeSlice:   "array",
+	wireTypeBool:    "boolean",
+	wireTypeFloat32: "float",
+}
+
+// Verify checks that the MaxMind DB read from r is structurally sound, so a
+// pipeline can reject a corrupt file before publishing it. It checks that:
+//
+//   - the metadata decodes, holds the required keys with the expected types
+//     and supported values, and describes a search tree that fits in the
+//     file, followed by a zero data section separator;
+//   - every search tree record points to a node, the empty marker, or the
+//     start of a value in the data section, and no lookup can revisit a node
+//     or descend more levels than the IP version has bits;
+//   - every value in the data section decodes, with valid UTF-8 strings,
+//     string map keys, pointers to the start of a value other than a
+//     pointer, no value that contains itself, and no nesting deeper than
+//     readers decode;
+//   - every value at the top level of the data section is reachable from a
+//     record, directly or through pointers.
+//
+// Verify reads all of r into memory. It returns the first problem found, as
+// an error wrapping ErrInvalidDatabase, or an error from reading r. Every
+// database that WriteTo writes passes.
+func Verify(r io.ReaderAt) error {
+	buf, err := readAllAt(r)
+	if err != nil {
+		return fmt.Errorf("reading database: %w", err)
+	}
+
+	metadata, err := verifyMetadata(buf)
+	if err != nil {
+		return err
+	}
+
+	treeSize := int64(metadata.nodeCount) * int64(metadata.recordSize) / 4
+	dataStart := treeSize + int64(len(dataSectionSeparator))
+	if dataStart > int64(metadata.start) {
+		return invalidf(
+			"the search tree of %d nodes and the data section separator end at %d, after the metadata starts at %d",
+			metadata.nodeCount,
+			dataStart,
+			metadata.start,
+		)
+	}
+	if !bytes.Equal(buf[treeSize:dataStart], dataSectionSeparator) {
+		return invalidf("the data section separator is not zero")
+	}
+
+	data := newDataVerifier("data section", buf[dataStart:metadata.start])
+	if err := data.scan(); err != nil {
+		return err
+	}
+	tree := &treeVerifier{
+		tree:       buf[:treeSize],
+		nodeCount:  metadata.nodeCount,
+		recordSize: metadata.recordSize,
+		treeDepth:  metadata.treeDepth,
+		dataSize:   len(data.section),
+		levels:     make([]uint8, metadata.nodeCount),
+		referenced: newOffsetSet(len(data.section)),
+	}
+	if err := tree.verify(); err != nil {
+		return err
+	}
+	for offset := range tree.referenced.all() {
+		if !data.starts.has(offset) {
+			return invalidf(
+				"a record points to data section offset %d, which is not the start of a value",
+				offset,
+			)
+		}
+		if _, err := data.reach(offset, 0); err != nil {
+			return err
+		}
+	}
+	return data.checkReachable()
+}
+
+func invalidf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidDatabase, fmt.Sprintf(format, args...))
+}
+
+// readAllAt reads r from its start to its end. It sizes the buffer up front
+// when r reports its size, as files and bytes.Reader do.
+func readAllAt(r io.ReaderAt) ([]byte, error) {
+	size := int64(-1)
+	switch r := r.(type) {
+	case interface{ Size() int64 }:
+		size = r.Size()
+	case interface{ Stat() (fs.FileInfo, error) }:
+		if info, err := r.Stat(); err == nil && info.Mode().IsRegular() {
+			size = info.Size()
+		}
+	}
+	if size < 0 {
+		return io.ReadAll(io.NewSectionReader(r, 0, math.MaxInt64))
+	}
+
+	buf := make([]byte, size)
+	n, err := r.ReadAt(buf, 0)
+	// ReadAt may report io.EOF along with a full buffer.
+	if n == len(buf) {
+		return buf, nil
+	}
+	if err == nil || errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return nil, err
+}
+
+// verifiedMetadata holds what Verify needs from the metadata.
+type verifiedMetadata struct {
+	// start is the offset of the metadata start marker.
+	start      int
+	nodeCount  int
+	recordSize int
+	treeDepth  int
+}
+
+func verifyMetadata(buf []byte) (verifiedMetadata, error) {
+	tail := buf[max(0, len(buf)-metadataMaxSize):]
+	index := bytes.LastIndex(tail, metadataStartMarker)
+	if index == -1 {
+		return verifiedMetadata{}, invalidf("metadata start marker not found")
+	}
+	start := len(buf) - len(tail) + index
+
+	section := newDataVerifier("metadata", buf[start+len(metadataStartMarker):])
+	end, _, err := section.walk(0, 0, false)
+	if err != nil {
+		return verifiedMetadata{}, err
+	}
+	if end != len(section.section) {
+		return verifiedMetadata{}, invalidf(
+			"the metadata is followed by %d unexpected bytes",
+			len(section.section)-end,
+		)
+	}
+	if _, err := section.reach(0, 0); err != nil {
+		return verifiedMetadata{}, err
+	}
+
+	unmarshaler := mmdbtype.NewUnmarshaler()
+	decoder := mmdbdata.NewDecoder(section.section, 0)
+	if err := unmarshaler.UnmarshalMaxMindDB(decoder); err != nil {
+		return verifiedMetadata{}, invalidf("decoding metadata: %v", err)
+	}
+	metadata, ok := unmarshaler.Result().(mmdbtype.Map)
+	if !ok {
+		return verifiedMetadata{}, invalidf("the metadata is a %T, not a Map", unmarshaler.Result())
+	}
+
+	verified := verifiedMetadata{start: start}
+	for _, err := range []error{
+		checkMetadata(metadata, "binary_format_major_version", true, func(version mmdbtype.Uint16) error {
+			if version != 2 {
+				return fmt.Errorf("unsupported binary_format_major_version: %d", version)
+			}
+			return nil
+		}),
+		checkMetadata(metadata, "binary_format_minor_version", true, func(mmdbtype.Uint16) error {
+			return nil
+		}),
+		checkMetadata(metadata, "build_epoch", true, func(mmdbtype.Uint64) error {
+			return nil
+		}),
+		checkMetadata(metadata, "database_type", true, func(mmdbtype.String) error {
+			return nil
+		}),
+		checkMetadata(metadata, "description", false, func(description mmdbtype.Map) error {
+			for language, text := range description {
+				if _, ok := text.(mmdbtype.String); !ok {
+					return fmt.Errorf("the %q description is a %T, not a String", language, text)
+				}
+			}
+			return nil
+		}),
+		checkMetadata(metadata, "ip_version", true, func(version mmdbtype.Uint16) error {
+			switch version {
+			case 4:
+				verified.treeDepth = 32
+			case 6:
+				verified.treeDepth = 128
+			default:
+				return fmt.Errorf("unsupported ip_version: %d", version)
+			}
+			return nil
+		}),
+		checkMetadata(metadata, "languages", false, func(languages mmdbtype.Slice) error {
+			for _, language := range languages {
+				if _, ok := language.(mmdbtype.String); !ok {
+					return fmt.Errorf("the languages hold a %T, not a String", language)
+				}
+			}
+			return nil
+		}),
+		checkMetadata(metadata, "node_count", true, func(count mmdbtype.Uint32) error {
+			if count == 0 {
+				return errors.New("node_count is zero")
+			}
+			verified.nodeCount = int(count)
+			return nil
+		}),
+		checkMetadata(metadata, "record_size", true, func(size mmdbtype.Uint16) error {
+			switch size {
+			case 24, 28, 32:
+				verified.recordSize = int(size)
+				return nil
+			default:
+				return fmt.Errorf("unsupported record_size: %d", size)
+			}
+		}),
+	} {
+		if err != nil {
+			return verifiedMetadata{}, fmt.Errorf("%w: %w", ErrInvalidDatabase, err)
+		}
+	}
+	return verified, nil
+}
+
+// checkMetadata passes the metadata value at key to check. It reports an
+// error if the value is not a T, or if a required key is missing.
+func checkMetadata[T mmdbtype.DataType](
+	metadata mmdbtype.Map,
+	key string,
+	required bool,
+	check func(T) error,
+) error {
+	value, ok := metadata[mmdbtype.String(key)]
+	if !ok {
+		if required {
+			return fmt.Errorf("the metadata lacks %s", key)
+		}
+		return nil
+	}
+	typed, ok := value.(T)
+	if !ok {
+		var zero T
+		return fmt.Errorf("%s is a %T, not a %T", key, value, zero)
+	}
+	return check(typed)
+}
+
+// treeVerifier checks the search tree.
+type treeVerifier struct {
+	tree       []byte
+	nodeCount  int
+	recordSize int
+	treeDepth  int
+	dataSize   int
+	// levels holds, for every node, the number of nodes on the longest
+	// path from it to a record that is not a node pointer. It is zero for a
+	// node not yet walked, and treeWalking for one whose walk has not
+	// returned.
+	levels []uint8
+	// referenced holds the data section offset of every data record.
+	referenced offsetSet
+}
+
+const treeWalking = math.MaxUint8
+
+func (v *treeVerifier) verify() error {
+	for node := range v.nodeCount {
+		for side := range 2 {
+			record := v.record(node, side)
+			switch {
+			case record <= v.nodeCount:
+			case record < v.nodeCount+len(dataSectionSeparator):
+				return invalidf(
+					"node %d has a %s record pointing into the data section separator",
+					node,
+					sideNames[side],
+				)
+			default:
+				offset := record - v.nodeCount - len(dataSectionSeparator)
+				if offset >= v.dataSize {
+					return invalidf(
+						"node %d has a %s record pointing past the end of the data section",
+						node,
+						sideNames[side],
+					)
+				}
+				v.referenced.add(offset)
+			}
+		}
+	}
+	return v.walk(0, 0)
+}
+
+var sideNames = [2]string{"left", "right"}
+
+// walk computes the levels of node, which a lookup reaches at depth.
+func (v *treeVerifier) walk(node, depth int) error {
+	switch levels := v.levels[node]; levels {
+	case treeWalking:
+		return invalidf("node %d is reachable from itself", node)
+	case 0:
+	default:
+		if depth+int(levels) > v.treeDepth {
+			return invalidf("lookups descend more than %d levels at node %d", v.treeDepth, node)
+		}
+		return nil
+	}
+	if depth >= v.treeDepth {
+		return invalidf("lookups descend more than %d levels at node %d", v.treeDepth, node)
+	}
+
+	v.levels[node] = treeWalking
+	levels := 1
+	for side := range 2 {
+		child := v.record(node, side)
+		if child >= v.nodeCount {
+			continue
+		}
+		if err := v.walk(child, depth+1); err != nil {
+			return err
+		}
+		levels = max(levels, int(v.levels[child])+1)
+	}
+	v.levels[node] = uint8(levels) //nolint:gosec // bounded by treeDepth
+	return nil
+}
+
+func (v *treeVerifier) record(node, side int) int {
+	switch v.recordSize {
+	case 24:
+		b := v.tree[node*6+side*3:]
+		return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+	case 28:
+		b := v.tree[node*7:]
+		if side == 0 {
+			return int(b[3]&0xF0)<<20 | int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+		}
+		return int(b[3]&0x0F)<<24 | int(b[4])<<16 | int(b[5])<<8 | int(b[6])
+	default:
+		return int(binary.BigEndian.Uint32(v.tree[node*8+side*4:]))
+	}
+}
+
+// dataVerifier checks the values of a data or metadata section. scan decodes
+// every value in order without following pointers, and reach then follows
+// the records and pointers.
+type dataVerifier struct {
+	name    string
+	section []byte
+	// starts holds the offset of every value scan decoded, including the
+	// values nested in maps and slices, and pointers holds those of the
+	// pointers among them.
+	starts   offsetSet
+	pointers offsetSet
+	// tops holds the offsets of the values at the top level of the section,
+	// in order.
+	tops []int
+	// depths holds the nesting depth of every value reached from a record,
+	// by offset, or dataWalking while its walk has not returned.
+	depths map[int]int
+}
+
+const dataWalking = -1
+
+func newDataVerifier(name string, section []byte) *dataVerifier {
+	return &dataVerifier{
+		name:     name,
+		section:  section,
+		starts:   newOffsetSet(len(section)),
+		pointers: newOffsetSet(len(section)),
+		depths:   map[int]int{},
+	}
+}
+
+func (v *dataVerifier) invalidf(offset int, format string, args ...any) error {
+	return invalidf("%s offset %d: %s", v.name, offset, fmt.Sprintf(format, args...))
+}
+
+func (v *dataVerifier) scan() error {
+	for offset := 0; offset < len(v.section); {
+		v.tops = append(v.tops, offset)
+		end, _, err := v.walk(offset, 0, false)
+		if err != nil {
+			return err
+		}
+		offset = end
+	}
+	return nil
+}
+
+// reach walks the value at offset, which a record or pointer refers to and
+// which scan found, once, and returns its nesting depth. depth is the nesting
+// of the pointer referring to it.
+func (v *dataVerifier) reach(offset, depth int) (int, error) {
+	switch nested, ok := v.depths[offset]; {
+	case !ok:
+	case nested == dataWalking:
+		return 0, v.invalidf(offset, "the value contains a pointer to itself")
+	case depth+nested > maxDataDepth:
+		return 0, v.invalidf(offset, "maps and arrays nest more than %d levels deep", maxDataDepth)
+	default:
+		return nested, nil
+	}
+	v.depths[offset] = dataWalking
+	_, nested, err := v.walk(offset, depth, true)
+	if err != nil {
+		return 0, err
+	}
+	v.depths[offset] = nested
+	return nested, nil
+}
+
+// walk decodes the value at offset, nested depth levels deep, and returns
+// the offset after it and the depth of its own nesting. Unless follow is set,
+// it records the value in starts and does not follow pointers.
+func (v *dataVerifier) walk(offset, depth int, follow bool) (end, nested int, err error) {
+	if depth > maxDataDepth {
+		return 0, 0, v.invalidf(offset, "maps and arrays nest more than %d levels deep", maxDataDepth)
+	}
+	typeNum, size, next, err := v.header(offset)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !follow {
+		v.starts.add(offset)
+	}
+
+	switch typeNum {
+	case wireTypePointer:
+		if !follow {
+			v.pointers.add(offset)
+			return next, 0, nil
+		}
+		if !v.starts.has(size) {
+			return 0, 0, v.invalidf(offset, "the pointer to %d does not point to the start of a value", size)
+		}
+		if v.pointers.has(size) {
+			return 0, 0, v.invalidf(offset, "the pointer to %d points to another pointer", size)
+		}
+		nested, err := v.reach(size, depth)
+		return next, nested, err
+	case wireTypeMap, wireTypeSlice:
+		end = next
+		for range size {
+			if typeNum == wireTypeMap {
+				if end, err = v.key(end, depth+1, follow); err != nil {
+					return 0, 0, err
+				}
+			}
+			var childNested int
+			end, childNested, err = v.walk(end, depth+1, follow)
+			if err != nil {
+				return 0, 0, err
+			}
+			nested = max(nested, childNested)
+		}
+		return end, nested + 1, nil
+	case wireTypeBool:
+		if size > 1 {
+			return 0, 0, v.invalidf(offset, "the boolean has size %d", size)
+		}
+		return next, 0, nil
+	}
+
+	var valid bool
+	switch typeNum {
+	case wireTypeString, wireTypeBytes:
+		valid = true
+	case wireTypeFloat64:
+		valid = size == 8
+	case wireTypeFloat32:
+		valid = size == 4
+	case wireTypeUint16:
+		valid = size <= 2
+	case wireTypeUint32, wireTypeInt32:
+		valid = size <= 4
+	case wireTypeUint64:
+		valid = size <= 8
+	case wireTypeUint128:
+		valid = size <= 16
+	default:
+		return 0, 0, v.invalidf(offset, "unknown type %d", typeNum)
+	}
+	if !valid {
+		return 0, 0, v.invalidf(offset, "the %s has size %d", wireTypeNames[typeNum], size)
+	}
+	end = next + size
+	if end > len(v.section) {
+		return 0, 0, v.invalidf(offset, "the %s runs past the end of the %s", wireTypeNames[typeNum], v.name)
+	}
+	if typeNum == wireTypeString && !utf8.Valid(v.section[next:end]) {
+		return 0, 0, v.invalidf(offset, "the string is not valid UTF-8")
+	}
+	return end, 0, nil
+}
+
+// key walks the map key at offset and checks that it is a string, directly
+// or through a pointer. A pointer's target is checked only when following.
+func (v *dataVerifier) key(offset, depth int, follow bool) (int, error) {
+	end, _, err := v.walk(offset, depth, follow)
+	if err != nil {
+		return 0, err
+	}
+	typeNum, target, _, err := v.header(offset)
+	if err != nil {
+		return 0, err
+	}
+	if typeNum == wireTypePointer {
+		if !follow {
+			return end, nil
+		}
+		if typeNum, _, _, err = v.header(target); err != nil {
+			return 0, err
+		}
+	}
+	if typeNum != wireTypeString {
+		return 0, v.invalidf(offset, "the map key is a %s, not a string", wireTypeNames[typeNum])
+	}
+	return end, nil
+}
+
+// header decodes the control bytes of the value at offset. It returns the
+// value's type number, its size, or the target for a pointer, and the offset
+// after the control bytes.
+func (v *dataVerifier) header(offset int) (typeNum, size, next int, err error) {
+	read := func(n int) ([]byte, error) {
+		if next+n > len(v.section) {
+			return nil, v.invalidf(offset, "the value runs past the end of the %s", v.name)
+		}
+		b := v.section[next : next+n]
+		next += n
+		return b, nil
+	}
+
+	next = offset
+	b, err := read(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	ctrl := b[0]
+	typeNum = int(ctrl >> 5)
+	if typeNum == 0 {
+		if b, err = read(1); err != nil {
+			return 0, 0, 0, err
+		}
+		if b[0] == 0 {
+			return 0, 0, 0, v.invalidf(offset, "the extended type byte is zero")
+		}
+		typeNum = 7 + int(b[0])
+	}
+
+	if typeNum == wireTypePointer {
+		sizeBits := int(ctrl>>3) & 0x3
+		if b, err = read(sizeBits + 1); err != nil {
+			return 0, 0, 0, err
+		}
+		target := 0
+		if sizeBits < 3 {
+			target = int(ctrl & 0x7)
+		}
+		for _, c := range b {
+			target = target<<8 | int(c)
+		}
+		target += [...]int{0, 2048, 526336, 0}[sizeBits]
+		if target >= len(v.section) {
+			return 0, 0, 0, v.invalidf(offset, "the pointer to %d points past the end of the %s", target, v.name)
+		}
+		return typeNum, target, next, nil
+	}
+
+	size = int(ctrl & 0x1F)
+	if size >= 29 {
+		if b, err = read(size - 28); err != nil {
+			return 0, 0, 0, err
+		}
+		extra := 0
+		for _, c := range b {
+			extra = extra<<8 | int(c)
+		}
+		size = [...]int{29, 285, 65821}[size-29] + extra
+	}
+	return typeNum, size, next, nil
+}
+
+// checkReachable reports the first top-level value that no record reaches,
+// directly or through pointers. A value counts as reached when any value
+// inside it is.
+func (v *dataVerifier) checkReachable() error {
+	reached := newOffsetSet(len(v.section))
+	for offset := range v.depths {
+		reached.add(offset)
+	}
+	for i, start := range v.tops {
+		end := len(v.section)
+		if i+1 < len(v.tops) {
+			end = v.tops[i+1]
+		}
+		if !reached.anyIn(start, end) {
+			return v.invalidf(start, "no record reaches the value")
+		}
+	}
+	return nil
+}
+
+// offsetSet is a set of offsets into a section, with one bit per byte.
+type offsetSet []uint64
+
+func newOffsetSet(size int) offsetSet {
+	return make(offsetSet, (size+63)/64)
+}
+
+func (s offsetSet) add(offset int) {
+	s[offset/64] |= 1 << (offset % 64)
+}
+
+func (s offsetSet) has(offset int) bool {
+	return s[offset/64]&(1<<(offset%64)) != 0
+}
+
+// anyIn reports whether the set holds an offset in [start, end).
+func (s offsetSet) anyIn(start, end int) bool {
+	for offset := start; offset < end; offset += 64 - offset%64 {
+		if word := s[offset/64] >> (offset % 64); word != 0 {
+			return offset+bits.TrailingZeros64(word) < end
+		}
+	}
+	return false
+}
+
+// all yields the offsets in the set in ascending order.
+func (s offsetSet) all() iter.Seq[int] {
+	return func(yield func(int) bool) {
+		for i, word := range s {
+			for word != 0 {
+				bit := bits.TrailingZeros64(word)
+				if !yield(i*64 + bit) {
+					return
+				}
+				word &= word - 1
+			}
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package mmdbwriter
+
+import (
+	"bytes"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/maxmind/mmdbwriter/v2/mmdbtype"
+)
+
+// TestVerifyWrittenTrees pins that every database WriteTo writes passes
+// Verify.
+func TestVerifyWrittenTrees(t *testing.T) {
+	tests := []struct {
+		name    string
+		options Options
+	}{
+		{"IPv4 24-bit", Options{IPVersion: 4, RecordSize: 24}},
+		{"IPv6 28-bit", Options{IPVersion: 6}},
+		{"IPv6 32-bit", Options{IPVersion: 6, RecordSize: 32}},
+		{"IPv6 without aliasing", Options{IPVersion: 6, DisableIPv4Aliasing: true}},
+		{"IPv6 with provenance", Options{IPVersion: 6, TrackProvenance: true}},
+		{"IPv6 with map key order", Options{
+			IPVersion:   6,
+			MapKeyOrder: MapKeyOrder{Priority: []string{"map"}, ByFrequency: true},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			empty, err := New(test.options)
+			require.NoError(t, err)
+			require.NoError(t, Verify(bytes.NewReader(writeTreeBytes(t, empty))))
+
+			for seed := range uint64(3) {
+				tree, err := New(test.options)
+				require.NoError(t, err)
+				for _, spec := range randomInsertSpecs(t, tree, seed, seed%2 == 0) {
+					require.NoError(t, tree.Insert(spec.network, spec.value))
+				}
+				require.NoError(t, Verify(bytes.NewReader(writeTreeBytes(t, tree))), "seed %d", seed)
+			}
+		})
+	}
+}
+
+// TestVerifyReaders pins that Verify reads files and readers that do not
+// report their size.
+func TestVerifyReaders(t *testing.T) {
+	tree, err := New(Options{})
+	require.NoError(t, err)
+	require.NoError(t, tree.Insert(netip.MustParsePrefix("2600::/16"), mmdbtype.String("a")))
+	written := writeTreeBytes(t, tree)
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	require.NoError(t, os.WriteFile(path, written, 0o600))
+	file, err := os.Open(path) //nolint:gosec // test path
+	require.NoError(t, err)
+	defer file.Close()
+	require.NoError(t, Verify(file))
+
+	require.NoError(t, Verify(struct{ io.ReaderAt }{bytes.NewReader(written)}))
+
+	err = Verify(bytes.NewReader(written[:len(written)-1]))
+	require.ErrorIs(t, err, ErrInvalidDatabase)
+}
+
+// testDatabase assembles an IPv4 database with 24-bit records from nodes, in
+// which a negative record is the offset of a data record, minus one, and a
+// positive one is a node number or the empty marker. metadata replaces the
+// default metadata keys, and a nil value removes one.
+func testDatabase(t *testing.T, nodes [][2]int, data []byte, metadata mmdbtype.Map) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, node := range nodes {
+		for _, record := range node {
+			if record < 0 {
+				record = len(nodes) + len(dataSectionSeparator) - record - 1
+			}
+			buf.Write([]byte{byte(record >> 16), byte(record >> 8), byte(record)})
+		}
+	}
+	buf.Write(dataSectionSeparator)
+	buf.Write(data)
+	buf.Write(metadataStartMarker)
+
+	fields := mmdbtype.Map{
+		"binary_format_major_version": mmdbtype.Uint16(2),
+		"binary_format_minor_version": mmdbtype.Uint16(0),
+		"build_epoch":                 mmdbtype.Uint64(1),
+		"database_type":               mmdbtype.String("verify-test"),
+		"description":                 mmdbtype.Map{"en": mmdbtype.String("Verify test")},
+		"ip_version":                  mmdbtype.Uint16(4),
+		"languages":                   mmdbtype.Slice{mmdbtype.String("en")},
+		"node_count":                  mmdbtype.Uint32(len(nodes)), //nolint:gosec // small
+		"record_size":                 mmdbtype.Uint16(24),
+	}
+	for key, value := range metadata {
+		if value == nil {
+			delete(fields, key)
+			continue
+		}
+		fields[key] = value
+	}
+	dw := newDataWriter(newValueStore(), false)
+	_, err := fields.WriteTo(dw)
+	require.NoError(t, err)
+	buf.Write(dw.Bytes())
+	return buf.Bytes()
+}
+
+// TestVerifyRejectsCorruption pins the problems Verify reports.
+func TestVerifyRejectsCorruption(t *testing.T) {
+	// The root's left record holds the string "a" and its right one is empty.
+	validNodes := [][2]int{{-1, 1}}
+	validData := []byte{0x41, 'a'}
+
+	chain := make([][2]int, 33)
+	for i := range chain {
+		chain[i] = [2]int{i + 1, 33}
+	}
+	chain[32] = [2]int{-1, 33}
+
+	var tooDeep []byte
+	for range maxDataDepth + 1 {
+		tooDeep = append(tooDeep, 0x01, 0x04)
+	}
+	tooDeep = append(tooDeep, validData...)
+
+	tests := []struct {
+		name     string
+		nodes    [][2]int
+		data     []byte
+		metadata mmdbtype.Map
+		expected string
+	}{
+		{
+			name:     "valid",
+			nodes:    validNodes,
+			data:     validData,
+			expected: "",
+		},
+		{
+			name:     "missing metadata key",
+			nodes:    validNodes,
+			data:     validData,
+			metadata: mmdbtype.Map{"node_count": nil},
+			expected: "the metadata lacks node_count",
+		},
+		{
+			name:     "wrong metadata type",
+			nodes:    validNodes,
+			data:     validData,
+			metadata: mmdbtype.Map{"record_size": mmdbtype.Uint32(24)},
+			expected: "record_size is a mmdbtype.Uint32, not a mmdbtype.Uint16",
+		},
+		{
+			name:     "unsupported IP version",
+			nodes:    validNodes,
+			data:     validData,
+			metadata: mmdbtype.Map{"ip_version": mmdbtype.Uint16(5)},
+			expected: "unsupported ip_version: 5",
+		},
+		{
+			name:     "search tree larger than the file",
+			nodes:    validNodes,
+			data:     validData,
+			metadata: mmdbtype.Map{"node_count": mmdbtype.Uint32(100)},
+			expected: "the search tree of 100 nodes and the data section separator end at 616, " +
+				"after the metadata starts at 24",
+		},
+		{
+			name:     "record in the separator",
+			nodes:    [][2]int{{1 + 5, 1}},
+			data:     validData,
+			expected: "node 0 has a left record pointing into the data section separator",
+		},
+		{
+			name:     "record past the data section",
+			nodes:    [][2]int{{-1, -3}},
+			data:     validData,
+			expected: "node 0 has a right record pointing past the end of the data section",
+		},
+		{
+			name:     "node cycle",
+			nodes:    [][2]int{{1, 2}, {0, 2}},
+			data:     nil,
+			expected: "node 0 is reachable from itself",
+		},
+		{
+			name:     "too many levels",
+			nodes:    chain,
+			data:     validData,
+			expected: "lookups descend more than 32 levels at node 32",
+		},
+		{
+			name:     "record inside a value",
+			nodes:    [][2]int{{-2, 1}},
+			data:     validData,
+			expected: "a record points to data section offset 1, which is not the start of a value",
+		},
+		{
+			name:     "unreachable value",
+			nodes:    validNodes,
+			data:     []byte{0x41, 'a', 0x41, 'b'},
+			expected: "data section offset 2: no record reaches the value",
+		},
+		{
+			name:     "map containing itself",
+			nodes:    validNodes,
+			data:     []byte{0xE1, 0x41, 'a', 0x20, 0x00},
+			expected: "data section offset 0: the value contains a pointer to itself",
+		},
+		{
+			name:     "pointer to a pointer",
+			nodes:    validNodes,
+			data:     []byte{0x20, 0x02, 0x20, 0x04, 0x41, 'a'},
+			expected: "data section offset 0: the pointer to 2 points to another pointer",
+		},
+		{
+			name:     "pointer past the end",
+			nodes:    validNodes,
+			data:     []byte{0x20, 0x09},
+			expected: "data section offset 0: the pointer to 9 points past the end of the data section",
+		},
+		{
+			name:     "pointer inside a value",
+			nodes:    [][2]int{{-1, -4}},
+			data:     []byte{0x42, 'a', 'b', 0x20, 0x01},
+			expected: "data section offset 3: the pointer to 1 does not point to the start of a value",
+		},
+		{
+			name:     "map key that is not a string",
+			nodes:    validNodes,
+			data:     []byte{0xE1, 0xA0, 0x41, 'a'},
+			expected: "data section offset 1: the map key is a uint16, not a string",
+		},
+		{
+			name:     "map key pointing to a number",
+			nodes:    validNodes,
+			data:     []byte{0xE1, 0x20, 0x05, 0x41, 'a', 0xA0},
+			expected: "data section offset 1: the map key is a uint16, not a string",
+		},
+		{
+			name:     "invalid UTF-8",
+			nodes:    validNodes,
+			data:     []byte{0x41, 0xFF},
+			expected: "data section offset 0: the string is not valid UTF-8",
+		},
+		{
+			name:     "wrong double size",
+			nodes:    validNodes,
+			data:     []byte{0x64, 0, 0, 0, 0},
+			expected: "data section offset 0: the double has size 4",
+		},
+		{
+			name:     "unknown type",
+			nodes:    validNodes,
+			data:     []byte{0x00, 0x05},
+			expected: "data section offset 0: unknown type 12",
+		},
+		{
+			name:     "truncated value",
+			nodes:    validNodes,
+			data:     []byte{0x43, 'a'},
+			expected: "data section offset 0: the string runs past the end of the data section",
+		},
+		{
+			name:     "nesting too deep",
+			nodes:    validNodes,
+			data:     tooDeep,
+			expected: "maps and arrays nest more than 512 levels deep",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Verify(bytes.NewReader(testDatabase(t, test.nodes, test.data, test.metadata)))
+			if test.expected == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, ErrInvalidDatabase)
+			assert.ErrorContains(t, err, test.expected)
+		})
+	}
+
+	written := testDatabase(t, validNodes, validData, nil)
+	separator := bytes.Clone(written)
+	separator[6] = 1
+	require.EqualError(t, Verify(bytes.NewReader(separator)),
+		"invalid MaxMind DB: the data section separator is not zero")
+
+	trailing := append(bytes.Clone(written), 0)
+	require.EqualError(t, Verify(bytes.NewReader(trailing)),
+		"invalid MaxMind DB: the metadata is followed by 1 unexpected bytes")
+}
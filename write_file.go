@@ -0,0 +1,197 @@
+package mmdbwriter
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"iter"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+
+	"github.com/maxmind/mmdbwriter/v2/mmdbtype"
+)
+
+// defaultVerifySamples is the number of networks WriteFile looks up when
+// WriteFileOptions.VerifySamples is zero.
+const defaultVerifySamples = 1000
+
+// WriteFileOptions configures Tree.WriteFile.
+type WriteFileOptions struct {
+	// Perm is the permission of the written file. The default is 0o644.
+	// Unlike os.WriteFile, the umask does not apply.
+	Perm fs.FileMode
+
+	// Verify makes WriteFile check the written file before renaming it into
+	// place. It checks the file with Verify, then opens it with
+	// maxminddb-golang and looks up a sample of the tree's networks,
+	// comparing each value to Get's.
+	Verify bool
+
+	// VerifySamples is the number of networks Verify looks up, spread evenly
+	// over the tree's data records in address order. The default is 1000,
+	// and a negative value skips the lookups.
+	VerifySamples int
+}
+
+// WriteFile writes the tree to the file at path, so that readers see either
+// the previous file or the complete new one, never a truncated file. It
+// writes a temporary file in the same directory, syncs it to disk,
+// optionally verifies it, and then renames it over path and syncs the
+// directory.
+//
+// On any error before the rename, including a failed verification,
+// WriteFile removes the temporary file and leaves the file at path as it
+// was.
+func (t *Tree) WriteFile(path string, opts WriteFileOptions) (err error) {
+	perm := opts.Perm
+	if perm == 0 {
+		perm = 0o644
+	}
+
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	file, err := os.CreateTemp(dir, "."+name+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("creating temporary file for %s: %w", path, err)
+	}
+	tempPath := file.Name()
+	closed := false
+	renamed := false
+	defer func() {
+		if err == nil || renamed {
+			return
+		}
+		if !closed {
+			err = errors.Join(err, file.Close())
+		}
+		err = errors.Join(err, os.Remove(tempPath))
+	}()
+
+	if _, err := t.WriteTo(file); err != nil {
+		return fmt.Errorf("writing %s: %w", path, err)
+	}
+	if err := file.Chmod(perm); err != nil {
+		return fmt.Errorf("setting the permission of %s: %w", path, err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("syncing %s: %w", path, err)
+	}
+	closed = true
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("closing %s: %w", path, err)
+	}
+
+	if opts.Verify {
+		samples := opts.VerifySamples
+		if samples == 0 {
+			samples = defaultVerifySamples
+		}
+		if err := t.verifyWrittenFile(tempPath, samples); err != nil {
+			return fmt.Errorf("verifying the database written for %s: %w", path, err)
+		}
+	}
+
+	if err := os.Rename(tempPath, path); err != nil {
+		return fmt.Errorf("renaming the database written for %s: %w", path, err)
+	}
+	renamed = true
+	if err := syncDir(dir); err != nil {
+		return fmt.Errorf("syncing the directory of %s: %w", path, err)
+	}
+	return nil
+}
+
+// syncDir makes a rename in dir durable. Windows cannot sync a directory, and
+// its renames need no directory sync.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir) //nolint:gosec // the caller chose the path
+	if err != nil {
+		return err
+	}
+	return errors.Join(d.Sync(), d.Close())
+}
+
+// verifyWrittenFile checks the database the tree wrote to path with Verify
+// and compares the values of up to samples of the tree's networks, looked up
+// with maxminddb-golang, to Get's.
+func (t *Tree) verifyWrittenFile(path string, samples int) error {
+	file, err := os.Open(path) //nolint:gosec // WriteFile created the path
+	if err != nil {
+		return err
+	}
+	err = Verify(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || samples < 0 {
+		return err
+	}
+
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	unmarshaler := mmdbtype.NewUnmarshaler()
+	for addr := range t.sampleAddrs(samples) {
+		_, expected := t.Get(addr)
+		result := reader.Lookup(addr)
+		if err := result.Err(); err != nil {
+			return fmt.Errorf("looking up %s: %w", addr, err)
+		}
+		var actual mmdbtype.DataType
+		if result.Found() {
+			if err := result.Decode(unmarshaler); err != nil {
+				return fmt.Errorf("decoding the value of %s: %w", addr, err)
+			}
+			actual = unmarshaler.Result()
+		}
+		if (expected == nil) != (actual == nil) || (expected != nil && !expected.Equal(actual)) {
+			return fmt.Errorf("the file holds %v for %s, but the tree holds %v", actual, addr, expected)
+		}
+	}
+	return nil
+}
+
+// sampleAddrs yields the first address of up to samples data records, spread
+// evenly over the records in address order.
+func (t *Tree) sampleAddrs(samples int) iter.Seq[netip.Addr] {
+	return func(yield func(netip.Addr) bool) {
+		if samples == 0 {
+			return
+		}
+		count := 0
+		for range t.dataRecords() {
+			count++
+		}
+		samples = min(samples, count)
+		// Sample n is the record at index n*count/samples, so the gaps
+		// between samples differ by at most one record.
+		index := 0
+		sampled := 0
+		for record := range t.dataRecords() {
+			if sampled == samples {
+				return
+			}
+			if index == sampled*count/samples {
+				sampled++
+				prefix, err := prefixFromInsertIP(record.ip, record.depth, t.treeDepth)
+				// Every record of a valid tree has a network.
+				if err == nil && !yield(prefix.Addr()) {
+					return
+				}
+			}
+			index++
+		}
+	}
+}
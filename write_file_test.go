@@ -0,0 +1,136 @@
+package mmdbwriter
+
+import (
+	"net/netip"
+	"os"
+	"slices"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/maxmind/mmdbwriter/v2/mmdbtype"
+)
+
+// TestWriteFile pins that WriteFile replaces the file at path with what
+// WriteTo writes, with the requested permission, and leaves no temporary
+// file behind.
+func TestWriteFile(t *testing.T) {
+	tree, err := New(Options{BuildEpoch: 1, TrackProvenance: true})
+	require.NoError(t, err)
+	tree.SetProvenanceSource("feed")
+	for _, insert := range []struct {
+		network string
+		value   mmdbtype.DataType
+	}{
+		{"1.0.0.0/8", mmdbtype.String("a")},
+		{"1.1.0.0/16", mmdbtype.Map{"country": mmdbtype.String("US")}},
+		{"2600::/16", mmdbtype.Map{"country": mmdbtype.String("FR")}},
+		{"2600:1::/32", mmdbtype.Slice{mmdbtype.Uint32(1)}},
+	} {
+		require.NoError(t, tree.Insert(netip.MustParsePrefix(insert.network), insert.value))
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.mmdb")
+	require.NoError(t, os.WriteFile(path, []byte("old"), 0o600))
+	require.NoError(t, tree.WriteFile(path, WriteFileOptions{Perm: 0o640, Verify: true}))
+
+	written, err := os.ReadFile(path) //nolint:gosec // test path
+	require.NoError(t, err)
+	assert.Equal(t, writeTreeBytes(t, tree), written)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	if os.PathSeparator == '/' {
+		assert.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+	}
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "test.mmdb", entries[0].Name())
+}
+
+// TestWriteFileFailures pins that a failed WriteFile leaves the destination
+// as it was and removes its temporary file, and that verification compares
+// the written values to the tree's.
+func TestWriteFileFailures(t *testing.T) {
+	tree, err := New(Options{IPVersion: 4})
+	require.NoError(t, err)
+	require.NoError(t, tree.Insert(netip.MustParsePrefix("1.0.0.0/8"), mmdbtype.String("a")))
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.mmdb")
+	require.NoError(t, os.Mkdir(path, 0o700))
+	require.ErrorContains(t, tree.WriteFile(path, WriteFileOptions{}), "renaming the database written for")
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.True(t, entries[0].IsDir())
+
+	path = filepath.Join(dir, "other.mmdb")
+	require.NoError(t, tree.WriteFile(path, WriteFileOptions{}))
+	other, err := New(Options{IPVersion: 4})
+	require.NoError(t, err)
+	require.NoError(t, other.Insert(netip.MustParsePrefix("1.0.0.0/8"), mmdbtype.String("b")))
+	require.EqualError(t, other.verifyWrittenFile(path, 10),
+		"the file holds a for 1.0.0.0, but the tree holds b")
+	require.NoError(t, other.verifyWrittenFile(path, -1))
+}
+
+// TestWriteFileVerifyFailure pins that WriteFile with Verify rejects a file
+// that fails verification, leaving the destination as it was and removing
+// its temporary file.
+func TestWriteFileVerifyFailure(t *testing.T) {
+	tree, err := New(Options{IPVersion: 4})
+	require.NoError(t, err)
+	// The writer does not check strings, but Verify rejects invalid UTF-8.
+	require.NoError(t, tree.Insert(netip.MustParsePrefix("1.0.0.0/8"), mmdbtype.String("\xff")))
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.mmdb")
+	require.NoError(t, os.WriteFile(path, []byte("old"), 0o600))
+	require.ErrorContains(t, tree.WriteFile(path, WriteFileOptions{Verify: true}),
+		"verifying the database written for")
+
+	written, err := os.ReadFile(path) //nolint:gosec // test path
+	require.NoError(t, err)
+	assert.Equal(t, []byte("old"), written)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "test.mmdb", entries[0].Name())
+}
+
+// TestSampleAddrs pins that the sampled records are spread evenly, with gaps
+// that differ by at most one record, and that every record is sampled when
+// there are fewer records than samples.
+func TestSampleAddrs(t *testing.T) {
+	tree, err := New(Options{IPVersion: 4})
+	require.NoError(t, err)
+	var addrs []netip.Addr
+	for i := range 10 {
+		addr := netip.AddrFrom4([4]byte{1, 0, byte(2 * i), 0})
+		addrs = append(addrs, addr)
+		require.NoError(t, tree.Insert(netip.PrefixFrom(addr, 24), mmdbtype.Uint32(i)))
+	}
+
+	tests := []struct {
+		samples int
+		want    []int
+	}{
+		{samples: 1, want: []int{0}},
+		{samples: 4, want: []int{0, 2, 5, 7}},
+		{samples: 6, want: []int{0, 1, 3, 5, 6, 8}},
+		{samples: 10, want: []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}},
+		{samples: 20, want: []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}},
+	}
+	for _, test := range tests {
+		var want []netip.Addr
+		for _, index := range test.want {
+			want = append(want, addrs[index])
+		}
+		assert.Equal(t, want, slices.Collect(tree.sampleAddrs(test.samples)), "%d samples", test.samples)
+	}
+}